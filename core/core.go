@@ -0,0 +1,37 @@
+package core
+
+import (
+	"x-ui/singbox"
+	"x-ui/xray"
+)
+
+const (
+	Xray    = "xray"
+	Singbox = "sing-box"
+)
+
+// Backend is a running proxy core. Each core takes its config in its own
+// JSON format, users included.
+type Backend interface {
+	Name() string
+	Start() error
+	Stop() error
+	IsRunning() bool
+	GetVersion() string
+	GetResult() string
+	ApplyConfig(config []byte) error
+	GetTraffic(reset bool) ([]*xray.Traffic, []*xray.ClientTraffic, error)
+}
+
+var (
+	_ Backend = (*xray.Process)(nil)
+	_ Backend = (*singbox.Process)(nil)
+)
+
+// BackendOf returns the name of the core serving inbounds of the protocol.
+func BackendOf(protocol string) string {
+	if singbox.IsProtocol(protocol) {
+		return Singbox
+	}
+	return Xray
+}
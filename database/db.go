@@ -8,6 +8,7 @@ import (
 	"os"
 	"path"
 	"slices"
+	"time"
 
 	"x-ui/config"
 	"x-ui/database/model"
@@ -33,9 +34,19 @@ func initModels() error {
 		&model.OutboundTraffics{},
 		&model.Setting{},
 		&model.InboundClientIps{},
+		&model.ClientIpHistory{},
+		&model.CountryPolicy{},
+		&model.IpLimitBan{},
+		&model.AbuseEvent{},
+		&model.SubAccess{},
+		&model.SubToken{},
+		&model.SubDevice{},
+		&model.ClientSession{},
+		&model.ClientAccessStat{},
 		&xray.ClientTraffic{},
 		&model.HistoryOfSeeders{},
 		&model.BlockedDomain{},
+		&model.GeoSource{},
 	}
 	for _, model := range models {
 		if err := db.AutoMigrate(model); err != nil {
@@ -46,6 +57,13 @@ func initModels() error {
 	return nil
 }
 
+// initClientCreatedAt gives the clients created before their creation time
+// was recorded the current time, for them to age from now on.
+func initClientCreatedAt() error {
+	return db.Model(xray.ClientTraffic{}).Where("created_at = 0 or created_at is null").
+		Update("created_at", time.Now().UnixMilli()).Error
+}
+
 func initUser() error {
 	empty, err := isTableEmpty("users")
 	if err != nil {
@@ -136,10 +154,18 @@ func InitDB(dbPath string) error {
 	if err != nil {
 		return err
 	}
+	// The database may have been replaced by an imported one
+	revision.Add(1)
+	if err := registerRevisionCallbacks(); err != nil {
+		return err
+	}
 
 	if err := initModels(); err != nil {
 		return err
 	}
+	if err := initClientCreatedAt(); err != nil {
+		return err
+	}
 
 	isUsersEmpty, err := isTableEmpty("users")
 
@@ -18,6 +18,10 @@ const (
 	Shadowsocks Protocol = "shadowsocks"
 	Socks       Protocol = "socks"
 	WireGuard   Protocol = "wireguard"
+
+	// served by sing-box
+	Hysteria2 Protocol = "hysteria2"
+	TUIC      Protocol = "tuic"
 )
 
 type User struct {
@@ -62,6 +66,113 @@ type InboundClientIps struct {
 	Ips         string `json:"ips" form:"ips"`
 }
 
+// ClientIpHistory is when a client was first and last seen connecting from
+// an IP.
+type ClientIpHistory struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Email     string `json:"email" gorm:"uniqueIndex:idx_client_ip_history;not null"`
+	IP        string `json:"ip" gorm:"uniqueIndex:idx_client_ip_history;not null"`
+	FirstSeen int64  `json:"firstSeen"`
+	LastSeen  int64  `json:"lastSeen" gorm:"index"`
+	Country   string `json:"country"`
+	ASN       uint   `json:"asn"`
+	ASOrg     string `json:"asOrg"`
+}
+
+// CountryPolicy limits the countries clients may connect from and whether
+// the admins are told when a client shows up from a new country. A policy
+// with an empty Email applies to all clients of the inbound, and a policy
+// of a client takes precedence over that of its inbound. AllowedCountries
+// is a comma separated list of country codes, empty allowing any.
+type CountryPolicy struct {
+	Id               int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	InboundId        int    `json:"inboundId" form:"inboundId" gorm:"index"`
+	Email            string `json:"email" form:"email" gorm:"index"`
+	AllowedCountries string `json:"allowedCountries" form:"allowedCountries"`
+	AlertNewCountry  bool   `json:"alertNewCountry" form:"alertNewCountry"`
+}
+
+// ClientSession is a continuous period of activity of a client. A session is
+// extended while the client keeps moving traffic and a new one is started
+// once the client has been idle for longer than the session timeout.
+type ClientSession struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Email     string `json:"email" form:"email" gorm:"index"`
+	InboundId int    `json:"inboundId" form:"inboundId"`
+	StartTime int64  `json:"startTime" form:"startTime"`
+	EndTime   int64  `json:"endTime" form:"endTime"`
+	Up        int64  `json:"up" form:"up"`
+	Down      int64  `json:"down" form:"down"`
+}
+
+// ClientAccessStat counts the connections a client made to a destination
+// through an outbound within an hour. Hour is the start of the hour.
+type ClientAccessStat struct {
+	Id          int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Email       string `json:"email" gorm:"uniqueIndex:idx_client_access_stat;not null"`
+	Hour        int64  `json:"hour" gorm:"uniqueIndex:idx_client_access_stat;index"`
+	Destination string `json:"destination" gorm:"uniqueIndex:idx_client_access_stat"`
+	OutboundTag string `json:"outboundTag" gorm:"uniqueIndex:idx_client_access_stat"`
+	Count       int64  `json:"count"`
+}
+
+// IpLimitBan is an active ban of a client, or of a source IP of a client,
+// for going over its IP limit. Until is when the ban is lifted.
+type IpLimitBan struct {
+	Id    int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Email string `json:"email" gorm:"index"`
+	IP    string `json:"ip"`
+	Mode  string `json:"mode"`
+	Until int64  `json:"until" gorm:"index"`
+}
+
+// AbuseEvent is a client caught breaking an abuse rule, with what was seen.
+// A client stays suspended while any of its events is Suspended.
+type AbuseEvent struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	Email     string `json:"email" gorm:"index"`
+	Rule      string `json:"rule"`
+	Evidence  string `json:"evidence"`
+	Time      int64  `json:"time" gorm:"index"`
+	Suspended bool   `json:"suspended"`
+}
+
+// SubAccess is a request to the subscription server, with the format it was
+// served in.
+type SubAccess struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	SubId     string `json:"subId" gorm:"index"`
+	Time      int64  `json:"time" gorm:"index"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"userAgent"`
+	Format    string `json:"format"`
+}
+
+// SubToken is a token a subscription is fetched by in place of its subId. It
+// stops working at ExpiresAt, unless that is 0.
+type SubToken struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	SubId     string `json:"subId" gorm:"index"`
+	Token     string `json:"token" gorm:"uniqueIndex"`
+	CreatedAt int64  `json:"createdAt"`
+	ExpiresAt int64  `json:"expiresAt"`
+}
+
+// SubDevice is a device a subscription is bound to, known by the HWID its app
+// sends with the requests.
+type SubDevice struct {
+	Id        int    `json:"id" gorm:"primaryKey;autoIncrement"`
+	SubId     string `json:"subId" gorm:"uniqueIndex:idx_sub_device"`
+	Hwid      string `json:"hwid" gorm:"uniqueIndex:idx_sub_device"`
+	Os        string `json:"os"`
+	OsVersion string `json:"osVersion"`
+	Model     string `json:"model"`
+	UserAgent string `json:"userAgent"`
+	IP        string `json:"ip"`
+	FirstSeen int64  `json:"firstSeen"`
+	LastSeen  int64  `json:"lastSeen"`
+}
+
 type HistoryOfSeeders struct {
 	Id         int    `json:"id" gorm:"primaryKey;autoIncrement"`
 	SeederName string `json:"seederName"`
@@ -113,3 +224,19 @@ type BlockedDomain struct {
 	CreatedAt int64  `json:"createdAt" gorm:"autoCreateTime:milli"`
 	UpdatedAt int64  `json:"updatedAt" gorm:"autoUpdateTime:milli"`
 }
+
+// GeoSource is a custom geoip, geosite or MaxMind DB file kept up to date in
+// the bin folder. Spec is a cron schedule, empty for manual updates only. The
+// download is checked against Sha256, or against the checksum published at
+// ChecksumURL.
+type GeoSource struct {
+	Id          int    `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	FileName    string `json:"fileName" form:"fileName" gorm:"unique;not null"`
+	URL         string `json:"url" form:"url"`
+	Spec        string `json:"spec" form:"spec"`
+	Sha256      string `json:"sha256" form:"sha256"`
+	ChecksumURL string `json:"checksumUrl" form:"checksumUrl"`
+	Enable      bool   `json:"enable" form:"enable"`
+	LastUpdate  int64  `json:"lastUpdate"`
+	LastError   string `json:"lastError"`
+}
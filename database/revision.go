@@ -0,0 +1,42 @@
+package database
+
+import (
+	"sync/atomic"
+
+	"gorm.io/gorm"
+)
+
+// revision counts the writes to the inbounds, which hold the config of their
+// clients, for what is generated from them to be cached until it changes.
+// The traffics of the clients are written all the time and do not count.
+var revision atomic.Uint64
+
+// revisionTables are the tables whose writes bump the revision.
+var revisionTables = map[string]bool{
+	"inbounds": true,
+}
+
+// Revision returns the current revision of the inbounds and their clients.
+// It is only ever bumped, so two equal revisions mean no write in between.
+func Revision() uint64 {
+	return revision.Load()
+}
+
+func bumpRevision(tx *gorm.DB) {
+	if tx.Error == nil && tx.Statement != nil && revisionTables[tx.Statement.Table] {
+		revision.Add(1)
+	}
+}
+
+// registerRevisionCallbacks bumps the revision after every create, update
+// and delete of the revision tables, whichever service makes it.
+func registerRevisionCallbacks() error {
+	callbacks := db.Callback()
+	if err := callbacks.Create().After("gorm:create").Register("x-ui:revision", bumpRevision); err != nil {
+		return err
+	}
+	if err := callbacks.Update().After("gorm:update").Register("x-ui:revision", bumpRevision); err != nil {
+		return err
+	}
+	return callbacks.Delete().After("gorm:delete").Register("x-ui:revision", bumpRevision)
+}
@@ -0,0 +1,93 @@
+package singbox
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/xray"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// sing-box serves the v2ray stats API under its own package,
+// experimental.v2rayapi, with messages matching the xray ones field by field.
+const queryStatsMethod = "/experimental.v2rayapi.StatsService/QueryStats"
+
+// ErrStatsUnavailable is returned when sing-box does not serve the stats API,
+// as happens with builds made without the with_v2ray_api tag.
+var ErrStatsUnavailable = errors.New("sing-box stats API is unavailable")
+
+var (
+	trafficRegex       = regexp.MustCompile(`(inbound|outbound)>>>([^>]+)>>>traffic>>>(downlink|uplink)`)
+	clientTrafficRegex = regexp.MustCompile(`user>>>([^>]+)>>>traffic>>>(downlink|uplink)`)
+)
+
+func queryTraffic(listen string, reset bool) ([]*xray.Traffic, []*xray.ClientTraffic, error) {
+	conn, err := grpc.NewClient(listen, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	resp := new(statsService.QueryStatsResponse)
+	err = conn.Invoke(ctx, queryStatsMethod, &statsService.QueryStatsRequest{Reset_: reset}, resp)
+	if status.Code(err) == codes.Unimplemented {
+		return nil, nil, ErrStatsUnavailable
+	}
+	if err != nil {
+		logger.Debug("Failed to query sing-box stats:", err)
+		return nil, nil, err
+	}
+
+	tagTraffics := make(map[string]*xray.Traffic)
+	emailTraffics := make(map[string]*xray.ClientTraffic)
+	for _, stat := range resp.GetStat() {
+		if matches := trafficRegex.FindStringSubmatch(stat.Name); len(matches) == 4 {
+			traffic, ok := tagTraffics[matches[2]]
+			if !ok {
+				traffic = &xray.Traffic{
+					IsInbound:  matches[1] == "inbound",
+					IsOutbound: matches[1] == "outbound",
+					Tag:        matches[2],
+				}
+				tagTraffics[matches[2]] = traffic
+			}
+			if matches[3] == "downlink" {
+				traffic.Down = stat.Value
+			} else {
+				traffic.Up = stat.Value
+			}
+		} else if matches := clientTrafficRegex.FindStringSubmatch(stat.Name); len(matches) == 3 {
+			traffic, ok := emailTraffics[matches[1]]
+			if !ok {
+				traffic = &xray.ClientTraffic{Email: matches[1]}
+				emailTraffics[matches[1]] = traffic
+			}
+			if matches[2] == "downlink" {
+				traffic.Down = stat.Value
+			} else {
+				traffic.Up = stat.Value
+			}
+		}
+	}
+
+	traffics := make([]*xray.Traffic, 0, len(tagTraffics))
+	for _, traffic := range tagTraffics {
+		traffics = append(traffics, traffic)
+	}
+	clientTraffics := make([]*xray.ClientTraffic, 0, len(emailTraffics))
+	for _, traffic := range emailTraffics {
+		clientTraffics = append(clientTraffics, traffic)
+	}
+	return traffics, clientTraffics, nil
+}
@@ -0,0 +1,72 @@
+package singbox
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+	"google.golang.org/grpc"
+)
+
+// serveStats serves QueryStats under the name sing-box registers it with,
+// answering with stats, or serves nothing when stats is nil.
+func serveStats(t *testing.T, stats []*statsService.Stat) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	if stats != nil {
+		server.RegisterService(&grpc.ServiceDesc{
+			ServiceName: "experimental.v2rayapi.StatsService",
+			HandlerType: (*any)(nil),
+			Methods: []grpc.MethodDesc{{
+				MethodName: "QueryStats",
+				Handler: func(_ any, _ context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+					request := new(statsService.QueryStatsRequest)
+					if err := dec(request); err != nil {
+						return nil, err
+					}
+					if !request.Reset_ {
+						t.Error("reset was not asked for")
+					}
+					return &statsService.QueryStatsResponse{Stat: stats}, nil
+				},
+			}},
+		}, struct{}{})
+	}
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener.Addr().String()
+}
+
+func TestQueryTraffic(t *testing.T) {
+	listen := serveStats(t, []*statsService.Stat{
+		{Name: "inbound>>>hy2-in>>>traffic>>>uplink", Value: 10},
+		{Name: "inbound>>>hy2-in>>>traffic>>>downlink", Value: 20},
+		{Name: "user>>>alice>>>traffic>>>uplink", Value: 3},
+		{Name: "user>>>alice>>>traffic>>>downlink", Value: 4},
+	})
+
+	traffics, clientTraffics, err := queryTraffic(listen, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traffics) != 1 || traffics[0].Tag != "hy2-in" || !traffics[0].IsInbound || traffics[0].Up != 10 || traffics[0].Down != 20 {
+		t.Errorf("unexpected inbound traffics %+v", traffics)
+	}
+	if len(clientTraffics) != 1 || clientTraffics[0].Email != "alice" || clientTraffics[0].Up != 3 || clientTraffics[0].Down != 4 {
+		t.Errorf("unexpected client traffics %+v", clientTraffics)
+	}
+}
+
+func TestQueryTrafficUnavailable(t *testing.T) {
+	listen := serveStats(t, nil)
+
+	_, _, err := queryTraffic(listen, true)
+	if !errors.Is(err, ErrStatsUnavailable) {
+		t.Fatalf("expected ErrStatsUnavailable, got %v", err)
+	}
+}
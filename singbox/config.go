@@ -0,0 +1,71 @@
+package singbox
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+type Config struct {
+	Log          *LogConfig       `json:"log,omitempty"`
+	Inbounds     []map[string]any `json:"inbounds"`
+	Outbounds    []map[string]any `json:"outbounds"`
+	Experimental *Experimental    `json:"experimental,omitempty"`
+}
+
+type LogConfig struct {
+	Level     string `json:"level"`
+	Timestamp bool   `json:"timestamp"`
+}
+
+type Experimental struct {
+	V2RayAPI *V2RayAPI `json:"v2ray_api,omitempty"`
+}
+
+// V2RayAPI exposes the traffic stats. It is only available in sing-box
+// builds made with the with_v2ray_api tag.
+type V2RayAPI struct {
+	Listen string      `json:"listen"`
+	Stats  *V2RayStats `json:"stats"`
+}
+
+type V2RayStats struct {
+	Enabled  bool     `json:"enabled"`
+	Inbounds []string `json:"inbounds,omitempty"`
+	Users    []string `json:"users,omitempty"`
+}
+
+func NewConfig() *Config {
+	return &Config{
+		Log: &LogConfig{
+			Level:     "warn",
+			Timestamp: true,
+		},
+		Inbounds: make([]map[string]any, 0),
+		Outbounds: []map[string]any{
+			{"type": "direct", "tag": "direct"},
+		},
+	}
+}
+
+func (c *Config) Equals(other *Config) bool {
+	if c == nil || other == nil {
+		return c == other
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return false
+	}
+	otherData, err := json.Marshal(other)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(data, otherData)
+}
+
+// GetAPIListen returns the address of the stats API, or "" if it is disabled.
+func (c *Config) GetAPIListen() string {
+	if c.Experimental == nil || c.Experimental.V2RayAPI == nil {
+		return ""
+	}
+	return c.Experimental.V2RayAPI.Listen
+}
@@ -0,0 +1,131 @@
+package singbox
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"x-ui/util/common"
+)
+
+// protocols are the inbound protocols served by sing-box instead of xray.
+var protocols = map[string]bool{
+	"hysteria2": true,
+	"tuic":      true,
+}
+
+// IsProtocol tells whether inbounds of the protocol run on sing-box.
+func IsProtocol(protocol string) bool {
+	return protocols[protocol]
+}
+
+// NewInbound converts a panel inbound into a sing-box one. Settings are given
+// in sing-box format, except for the clients which are turned into users;
+// TLS is taken from the xray style stream settings unless set explicitly.
+func NewInbound(protocol string, tag string, listen string, port int, settings string, streamSettings string) (map[string]any, error) {
+	if !IsProtocol(protocol) {
+		return nil, common.NewErrorf("protocol %v is not served by sing-box", protocol)
+	}
+	inbound := map[string]any{}
+	if settings != "" {
+		if err := json.Unmarshal([]byte(settings), &inbound); err != nil {
+			return nil, common.NewErrorf("inbound %v: invalid settings: %v", tag, err)
+		}
+	}
+
+	clients, _ := inbound["clients"].([]any)
+	delete(inbound, "clients")
+	users := make([]map[string]any, 0, len(clients))
+	for _, client := range clients {
+		c, ok := client.(map[string]any)
+		if !ok {
+			continue
+		}
+		user, err := newUser(protocol, c)
+		if err != nil {
+			return nil, common.NewErrorf("inbound %v: %v", tag, err)
+		}
+		users = append(users, user)
+	}
+	inbound["users"] = users
+
+	if _, ok := inbound["tls"]; !ok {
+		tls, err := convertTLS(streamSettings)
+		if err != nil {
+			return nil, common.NewErrorf("inbound %v: %v", tag, err)
+		}
+		if tls != nil {
+			inbound["tls"] = tls
+		}
+	}
+	if _, ok := inbound["tls"]; !ok {
+		return nil, common.NewErrorf("inbound %v: %v requires TLS", tag, protocol)
+	}
+
+	if listen == "" {
+		listen = "::"
+	}
+	inbound["type"] = protocol
+	inbound["tag"] = tag
+	inbound["listen"] = listen
+	inbound["listen_port"] = port
+	return inbound, nil
+}
+
+func newUser(protocol string, client map[string]any) (map[string]any, error) {
+	email, _ := client["email"].(string)
+	password, _ := client["password"].(string)
+	if email == "" {
+		return nil, common.NewError("client email is empty")
+	}
+	user := map[string]any{
+		"name":     email,
+		"password": password,
+	}
+	switch protocol {
+	case "tuic":
+		id, _ := client["id"].(string)
+		if id == "" {
+			return nil, fmt.Errorf("client %v has no id", email)
+		}
+		user["uuid"] = id
+	default:
+		if password == "" {
+			return nil, fmt.Errorf("client %v has no password", email)
+		}
+	}
+	return user, nil
+}
+
+func convertTLS(streamSettings string) (map[string]any, error) {
+	if streamSettings == "" {
+		return nil, nil
+	}
+	var stream map[string]any
+	if err := json.Unmarshal([]byte(streamSettings), &stream); err != nil {
+		return nil, common.NewErrorf("invalid stream settings: %v", err)
+	}
+	if security, _ := stream["security"].(string); security != "tls" {
+		return nil, nil
+	}
+	tlsSettings, _ := stream["tlsSettings"].(map[string]any)
+	tls := map[string]any{"enabled": true}
+	if serverName, _ := tlsSettings["serverName"].(string); serverName != "" {
+		tls["server_name"] = serverName
+	}
+	if alpn, ok := tlsSettings["alpn"].([]any); ok && len(alpn) > 0 {
+		tls["alpn"] = alpn
+	}
+	certificates, _ := tlsSettings["certificates"].([]any)
+	if len(certificates) == 0 {
+		return nil, common.NewError("TLS has no certificate")
+	}
+	certificate, _ := certificates[0].(map[string]any)
+	if certFile, _ := certificate["certificateFile"].(string); certFile != "" {
+		tls["certificate_path"] = certFile
+		tls["key_path"], _ = certificate["keyFile"].(string)
+	} else {
+		tls["certificate"] = certificate["certificate"]
+		tls["key"] = certificate["key"]
+	}
+	return tls, nil
+}
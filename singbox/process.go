@@ -0,0 +1,214 @@
+package singbox
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"x-ui/config"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+func GetBinaryName() string {
+	return fmt.Sprintf("sing-box-%s-%s", runtime.GOOS, runtime.GOARCH)
+}
+
+func GetBinaryPath() string {
+	return config.GetBinFolderPath() + "/" + GetBinaryName()
+}
+
+func GetConfigPath() string {
+	return config.GetBinFolderPath() + "/sing-box.json"
+}
+
+func stopProcess(p *Process) {
+	p.Stop()
+}
+
+type Process struct {
+	*process
+}
+
+func NewProcess(singboxConfig *Config) *Process {
+	p := &Process{newProcess(singboxConfig)}
+	runtime.SetFinalizer(p, stopProcess)
+	return p
+}
+
+type process struct {
+	cmd *exec.Cmd
+
+	version string
+
+	config    *Config
+	logWriter *logWriter
+	exitErr   error
+	startTime time.Time
+}
+
+func newProcess(config *Config) *process {
+	return &process{
+		version:   "Unknown",
+		config:    config,
+		logWriter: &logWriter{},
+		startTime: time.Now(),
+	}
+}
+
+func (p *process) Name() string {
+	return "sing-box"
+}
+
+func (p *process) IsRunning() bool {
+	if p.cmd == nil || p.cmd.Process == nil {
+		return false
+	}
+	if p.cmd.ProcessState == nil {
+		return true
+	}
+	return false
+}
+
+func (p *process) GetErr() error {
+	return p.exitErr
+}
+
+func (p *process) GetResult() string {
+	if len(p.logWriter.lastLine) == 0 && p.exitErr != nil {
+		return p.exitErr.Error()
+	}
+	return p.logWriter.lastLine
+}
+
+func (p *process) GetVersion() string {
+	return p.version
+}
+
+func (p *process) GetConfig() *Config {
+	return p.config
+}
+
+func (p *process) GetUptime() uint64 {
+	return uint64(time.Since(p.startTime).Seconds())
+}
+
+func (p *process) refreshVersion() {
+	// sing-box version 1.11.0
+	data, err := exec.Command(GetBinaryPath(), "version").Output()
+	fields := strings.Fields(string(data))
+	if err != nil || len(fields) < 3 {
+		p.version = "Unknown"
+		return
+	}
+	p.version = fields[2]
+}
+
+func (p *process) Start() (err error) {
+	if p.IsRunning() {
+		return errors.New("sing-box is already running")
+	}
+
+	defer func() {
+		if err != nil {
+			logger.Error("Failure in running sing-box process: ", err)
+			p.exitErr = err
+		}
+	}()
+
+	err = p.writeConfig()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(GetBinaryPath(), "run", "-c", GetConfigPath())
+	p.cmd = cmd
+
+	cmd.Stdout = p.logWriter
+	cmd.Stderr = p.logWriter
+
+	go func() {
+		err := cmd.Run()
+		if err != nil {
+			logger.Error("Failure in running sing-box:", err)
+			p.exitErr = err
+		}
+	}()
+
+	p.refreshVersion()
+
+	return nil
+}
+
+func (p *process) Stop() error {
+	if !p.IsRunning() {
+		return errors.New("sing-box is not running")
+	}
+	return p.cmd.Process.Signal(syscall.SIGTERM)
+}
+
+// ApplyConfig writes the new config and makes the running sing-box reload it.
+func (p *process) ApplyConfig(data []byte) error {
+	newConfig := &Config{}
+	if err := json.Unmarshal(data, newConfig); err != nil {
+		return err
+	}
+	p.config = newConfig
+	if err := p.writeConfig(); err != nil {
+		return err
+	}
+	if !p.IsRunning() {
+		return nil
+	}
+	return p.cmd.Process.Signal(syscall.SIGHUP)
+}
+
+// GetTraffic returns the traffic since the last reset, or nothing when the
+// stats API is not enabled.
+func (p *process) GetTraffic(reset bool) ([]*xray.Traffic, []*xray.ClientTraffic, error) {
+	listen := p.config.GetAPIListen()
+	if listen == "" {
+		return nil, nil, nil
+	}
+	return queryTraffic(listen, reset)
+}
+
+func (p *process) writeConfig() error {
+	data, err := json.MarshalIndent(p.config, "", "  ")
+	if err != nil {
+		return common.NewErrorf("Failed to generate sing-box configuration files: %v", err)
+	}
+	err = os.WriteFile(GetConfigPath(), data, fs.ModePerm)
+	if err != nil {
+		return common.NewErrorf("Failed to write configuration file: %v", err)
+	}
+	return nil
+}
+
+type logWriter struct {
+	lastLine string
+}
+
+func (lw *logWriter) Write(m []byte) (n int, err error) {
+	for line := range strings.SplitSeq(strings.TrimSpace(string(m)), "\n") {
+		if line == "" {
+			continue
+		}
+		lower := strings.ToLower(line)
+		if strings.Contains(lower, "fatal") || strings.Contains(lower, "error") {
+			logger.Error("SING-BOX: " + line)
+		} else {
+			logger.Debug("SING-BOX: " + line)
+		}
+		lw.lastLine = line
+	}
+	return len(m), nil
+}
@@ -7,10 +7,12 @@ import (
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"x-ui/config"
 	"x-ui/logger"
 	"x-ui/util/common"
+	"x-ui/web/locale"
 	"x-ui/web/middleware"
 	"x-ui/web/network"
 	"x-ui/web/service"
@@ -48,6 +50,25 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 
 	engine := gin.Default()
 
+	// Only proxies in front of the service are trusted to tell the client IP
+	// in their headers, otherwise clients could pick it
+	trustedProxies, err := s.settingService.GetSubTrustedProxies()
+	if err != nil {
+		return nil, err
+	}
+	var proxies []string
+	for _, proxy := range strings.Split(trustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if err := engine.SetTrustedProxies(proxies); err != nil {
+		return nil, err
+	}
+
+	// Translates the page served to browsers
+	engine.Use(locale.LocalizerMiddleware())
+
 	subDomain, err := s.settingService.GetSubDomain()
 	if err != nil {
 		return nil, err
@@ -107,16 +128,63 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 		SubJsonRules = ""
 	}
 
+	ClashPath, err := s.settingService.GetSubClashPath()
+	if err != nil {
+		return nil, err
+	}
+
+	SubClashRules, err := s.settingService.GetSubClashRules()
+	if err != nil {
+		SubClashRules = ""
+	}
+
+	SingboxPath, err := s.settingService.GetSubSingboxPath()
+	if err != nil {
+		return nil, err
+	}
+
+	SubSingboxDns, err := s.settingService.GetSubSingboxDns()
+	if err != nil {
+		SubSingboxDns = ""
+	}
+
+	SubSingboxRules, err := s.settingService.GetSubSingboxRules()
+	if err != nil {
+		SubSingboxRules = ""
+	}
+
+	SubFormatRules, err := s.settingService.GetSubFormatRules()
+	if err != nil {
+		SubFormatRules = ""
+	}
+
 	SubTitle, err := s.settingService.GetSubTitle()
 	if err != nil {
 		SubTitle = ""
 	}
 
+	SubNodes, err := s.settingService.GetSubNodes()
+	if err != nil {
+		SubNodes = ""
+	}
+
+	SubNodeSecret, err := s.settingService.GetSubNodeSecret()
+	if err != nil {
+		SubNodeSecret = ""
+	}
+
+	SubNodeCacheMinutes, err := s.settingService.GetSubNodeCacheMinutes()
+	if err != nil {
+		SubNodeCacheMinutes = 5
+	}
+
 	g := engine.Group("/")
 
 	s.sub = NewSUBController(
 		g, LinksPath, JsonPath, Encrypt, ShowInfo, RemarkModel, SubUpdates,
-		SubJsonFragment, SubJsonNoises, SubJsonMux, SubJsonRules, SubTitle)
+		SubJsonFragment, SubJsonNoises, SubJsonMux, SubJsonRules, ClashPath, SubClashRules,
+		SingboxPath, SubSingboxDns, SubSingboxRules, SubFormatRules, SubTitle,
+		SubNodes, SubNodeSecret, SubNodeCacheMinutes)
 
 	return engine, nil
 }
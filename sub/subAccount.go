@@ -0,0 +1,282 @@
+package sub
+
+import (
+	"crypto/ecdh"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"x-ui/database/model"
+)
+
+// isAccountProtocol tells whether the inbounds of a protocol have accounts,
+// or peers on wireguard, in place of clients.
+func isAccountProtocol(protocol model.Protocol) bool {
+	switch protocol {
+	case model.Socks, model.HTTP, model.WireGuard:
+		return true
+	}
+	return false
+}
+
+// subAccount is an account of a socks or http inbound.
+type subAccount struct {
+	User  string `json:"user"`
+	Pass  string `json:"pass"`
+	SubID string `json:"subId"`
+}
+
+// wireguardPeer is a peer of a wireguard inbound.
+type wireguardPeer struct {
+	PrivateKey   string   `json:"privateKey"`
+	PublicKey    string   `json:"publicKey"`
+	PreSharedKey string   `json:"preSharedKey"`
+	AllowedIPs   []string `json:"allowedIPs"`
+	KeepAlive    int      `json:"keepAlive"`
+	SubID        string   `json:"subId"`
+}
+
+type wireguardSettings struct {
+	SecretKey string          `json:"secretKey"`
+	MTU       int             `json:"mtu"`
+	Peers     []wireguardPeer `json:"peers"`
+
+	// PublicKey is the key of the server the peers connect to.
+	PublicKey string `json:"-"`
+}
+
+// accountEndpoint is an address an account is reached at, the inbound
+// itself or one of its external proxies.
+type accountEndpoint struct {
+	Dest     string
+	Port     int
+	ForceTls string
+	Remark   string
+}
+
+// getSubClients returns the clients of an inbound. The accounts of socks and
+// http inbounds, and the peers of wireguard ones, stand in for clients with
+// no traffic of their own: an account by its user, password and subId, with
+// the user as email; a peer by its subId, with its number as email.
+func (s *SubService) getSubClients(inbound *model.Inbound) ([]model.Client, error) {
+	if !isAccountProtocol(inbound.Protocol) {
+		return s.inboundService.GetClients(inbound)
+	}
+
+	var clients []model.Client
+	if inbound.Protocol == model.WireGuard {
+		settings, err := parseWireguard(inbound)
+		if err != nil {
+			return nil, err
+		}
+		for index, peer := range settings.Peers {
+			clients = append(clients, model.Client{
+				ID:     peer.PublicKey,
+				Email:  strconv.Itoa(index + 1),
+				Enable: true,
+				SubID:  peer.SubID,
+			})
+		}
+		return clients, nil
+	}
+
+	var settings struct {
+		Accounts []subAccount `json:"accounts"`
+	}
+	if err := json.Unmarshal([]byte(inbound.Settings), &settings); err != nil {
+		return nil, err
+	}
+	for _, account := range settings.Accounts {
+		clients = append(clients, model.Client{
+			ID:       account.User,
+			Password: account.Pass,
+			Email:    account.User,
+			Enable:   true,
+			SubID:    account.SubID,
+		})
+	}
+	return clients, nil
+}
+
+// getSubClient returns the client of an inbound with the given email, as
+// getSubClients stands them in.
+func (s *SubService) getSubClient(inbound *model.Inbound, email string) (model.Client, bool) {
+	clients, _ := s.getSubClients(inbound)
+	for _, client := range clients {
+		if client.Email == email {
+			return client, true
+		}
+	}
+	return model.Client{}, false
+}
+
+// parseWireguard reads the settings of a wireguard inbound.
+func parseWireguard(inbound *model.Inbound) (*wireguardSettings, error) {
+	settings := &wireguardSettings{}
+	if err := json.Unmarshal([]byte(inbound.Settings), settings); err != nil {
+		return nil, err
+	}
+	secretKey, err := base64.StdEncoding.DecodeString(settings.SecretKey)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, err := ecdh.X25519().NewPrivateKey(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	settings.PublicKey = base64.StdEncoding.EncodeToString(privateKey.PublicKey().Bytes())
+	return settings, nil
+}
+
+// wireguardPeerOf returns the peer of a wireguard inbound standing in for
+// the client with the given email.
+func wireguardPeerOf(settings *wireguardSettings, email string) (*wireguardPeer, bool) {
+	index, err := strconv.Atoi(email)
+	if err != nil || index < 1 || index > len(settings.Peers) {
+		return nil, false
+	}
+	return &settings.Peers[index-1], true
+}
+
+// accountEndpoints returns where the accounts of an inbound are reached, at
+// host unless it has external proxies.
+func accountEndpoints(inbound *model.Inbound, host string) []accountEndpoint {
+	var stream map[string]any
+	json.Unmarshal([]byte(inbound.StreamSettings), &stream)
+	externalProxies, _ := stream["externalProxy"].([]any)
+	if len(externalProxies) == 0 {
+		return []accountEndpoint{{Dest: host, Port: inbound.Port, ForceTls: "same"}}
+	}
+
+	var endpoints []accountEndpoint
+	for _, externalProxy := range externalProxies {
+		ep, _ := externalProxy.(map[string]any)
+		dest, _ := ep["dest"].(string)
+		port, _ := ep["port"].(float64)
+		forceTls, _ := ep["forceTls"].(string)
+		remark, _ := ep["remark"].(string)
+		endpoints = append(endpoints, accountEndpoint{Dest: dest, Port: int(port), ForceTls: forceTls, Remark: remark})
+	}
+	return endpoints
+}
+
+// genAccountLink generates socks:// and http:// links, carrying the user and
+// password base64 encoded as v2rayN does.
+func (s *SubService) genAccountLink(inbound *model.Inbound, email string) string {
+	client, ok := s.getSubClient(inbound, email)
+	if !ok {
+		return ""
+	}
+	scheme := "socks"
+	if inbound.Protocol == model.HTTP {
+		scheme = "http"
+	}
+	userInfo := base64.StdEncoding.EncodeToString([]byte(client.ID + ":" + client.Password))
+
+	var links []string
+	for _, endpoint := range accountEndpoints(inbound, s.address) {
+		link := url.URL{
+			Scheme:   scheme,
+			User:     url.User(userInfo),
+			Host:     net.JoinHostPort(endpoint.Dest, strconv.Itoa(endpoint.Port)),
+			Fragment: s.genRemark(inbound, email, endpoint.Remark),
+		}
+		links = append(links, link.String())
+	}
+	return strings.Join(links, "\n")
+}
+
+// genWireguardLink generates wireguard:// links for a peer, as read by
+// v2rayN, Hiddify and sing-box based apps.
+func (s *SubService) genWireguardLink(inbound *model.Inbound, email string) string {
+	settings, err := parseWireguard(inbound)
+	if err != nil {
+		return ""
+	}
+	peer, ok := wireguardPeerOf(settings, email)
+	if !ok {
+		return ""
+	}
+
+	params := url.Values{}
+	params.Set("publickey", settings.PublicKey)
+	params.Set("address", strings.Join(peer.AllowedIPs, ","))
+	if settings.MTU > 0 {
+		params.Set("mtu", strconv.Itoa(settings.MTU))
+	}
+	if peer.PreSharedKey != "" {
+		params.Set("presharedkey", peer.PreSharedKey)
+	}
+	if peer.KeepAlive > 0 {
+		params.Set("keepalive", strconv.Itoa(peer.KeepAlive))
+	}
+
+	var links []string
+	for _, endpoint := range accountEndpoints(inbound, s.address) {
+		link := url.URL{
+			Scheme:   "wireguard",
+			User:     url.User(peer.PrivateKey),
+			Host:     net.JoinHostPort(endpoint.Dest, strconv.Itoa(endpoint.Port)),
+			RawQuery: params.Encode(),
+			Fragment: s.genRemark(inbound, email, endpoint.Remark),
+		}
+		links = append(links, link.String())
+	}
+	return strings.Join(links, "\n")
+}
+
+// genWireguardConfig generates the wg-quick config of a peer, for the
+// official WireGuard apps.
+func (s *SubService) genWireguardConfig(inbound *model.Inbound, email string) string {
+	settings, err := parseWireguard(inbound)
+	if err != nil {
+		return ""
+	}
+	peer, ok := wireguardPeerOf(settings, email)
+	if !ok {
+		return ""
+	}
+	endpoint := accountEndpoints(inbound, s.address)[0]
+
+	var config strings.Builder
+	config.WriteString("[Interface]\n")
+	fmt.Fprintf(&config, "PrivateKey = %s\n", peer.PrivateKey)
+	fmt.Fprintf(&config, "Address = %s\n", strings.Join(peer.AllowedIPs, ", "))
+	config.WriteString("DNS = 1.1.1.1, 1.0.0.1\n")
+	if settings.MTU > 0 {
+		fmt.Fprintf(&config, "MTU = %d\n", settings.MTU)
+	}
+	fmt.Fprintf(&config, "\n# %s\n", s.genRemark(inbound, email, endpoint.Remark))
+	config.WriteString("[Peer]\n")
+	fmt.Fprintf(&config, "PublicKey = %s\n", settings.PublicKey)
+	config.WriteString("AllowedIPs = 0.0.0.0/0, ::/0\n")
+	fmt.Fprintf(&config, "Endpoint = %s\n", net.JoinHostPort(endpoint.Dest, strconv.Itoa(endpoint.Port)))
+	if peer.PreSharedKey != "" {
+		fmt.Fprintf(&config, "PresharedKey = %s\n", peer.PreSharedKey)
+	}
+	if peer.KeepAlive > 0 {
+		fmt.Fprintf(&config, "PersistentKeepalive = %d\n", peer.KeepAlive)
+	}
+	return config.String()
+}
+
+// splitAddresses splits the addresses of a peer into its IPv4 and IPv6 ones,
+// without their prefix lengths.
+func splitAddresses(addresses []string) (string, string) {
+	var ipv4, ipv6 string
+	for _, address := range addresses {
+		ip, _, _ := strings.Cut(address, "/")
+		if strings.Contains(ip, ":") {
+			if ipv6 == "" {
+				ipv6 = ip
+			}
+		} else if ipv4 == "" {
+			ipv4 = ip
+		}
+	}
+	return ipv4, ipv6
+}
@@ -0,0 +1,113 @@
+package sub
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/xray"
+)
+
+const (
+	// subCacheTTL bounds how long a subscription is served from the cache,
+	// for the time left shown in its remarks to stay current.
+	subCacheTTL = time.Minute
+	// subCacheSize bounds the number of subscriptions kept in the cache.
+	subCacheSize = 4096
+)
+
+// subCacheKey tells the subscriptions apart that are generated differently.
+type subCacheKey struct {
+	subId  string
+	format string
+	host   string
+	merge  bool
+}
+
+// subResponse is a subscription generated in one of the formats. Its
+// Subscription-Userinfo header is not kept, as traffic changes all the time,
+// but the traffics of the nodes it was merged with are.
+type subResponse struct {
+	body         []byte
+	contentType  string
+	nodeTraffics []xray.ClientTraffic
+	etag         string
+}
+
+type subCacheEntry struct {
+	response *subResponse
+	revision uint64
+	expires  time.Time
+}
+
+// subCache keeps generated subscriptions until the inbounds or clients they
+// are generated from change, as told by the database revision.
+type subCache struct {
+	lock     sync.Mutex
+	revision uint64
+	entries  map[subCacheKey]subCacheEntry
+}
+
+func newSubCache() *subCache {
+	return &subCache{entries: make(map[subCacheKey]subCacheEntry)}
+}
+
+// get returns the cached subscription for key, unless it is stale.
+func (c *subCache) get(key subCacheKey) (*subResponse, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.flushStale()
+	entry, ok := c.entries[key]
+	if !ok || entry.revision != c.revision || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.response, true
+}
+
+// put caches a subscription generated at revision, that is from the database
+// as it was before the generation started.
+func (c *subCache) put(key subCacheKey, revision uint64, response *subResponse) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.flushStale()
+	if revision != c.revision {
+		return
+	}
+	if len(c.entries) >= subCacheSize {
+		clear(c.entries)
+	}
+	c.entries[key] = subCacheEntry{
+		response: response,
+		revision: revision,
+		expires:  time.Now().Add(subCacheTTL),
+	}
+}
+
+// flushStale drops every subscription once the database has changed.
+func (c *subCache) flushStale() {
+	if revision := database.Revision(); revision != c.revision {
+		clear(c.entries)
+		c.revision = revision
+	}
+}
+
+// genETag returns a strong ETag of the body of a subscription.
+func genETag(body []byte) string {
+	hash := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// etagMatches tells whether an If-None-Match header holds etag, compared
+// weakly as RFC 9110 asks.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
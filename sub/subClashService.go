@@ -0,0 +1,507 @@
+package sub
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/singbox"
+	"x-ui/util/random"
+	"x-ui/xray"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed clash.yaml
+var defaultClash string
+
+const (
+	clashProxyGroup = "PROXY"
+	clashAutoGroup  = "Auto"
+)
+
+// SubClashService renders subscriptions as Clash Meta (Mihomo) profiles.
+type SubClashService struct {
+	rules []string
+
+	SubService *SubService
+}
+
+// NewSubClashService takes the rules of the profiles, one per line, or ""
+// for those of the default profile.
+func NewSubClashService(rules string, subService *SubService) *SubClashService {
+	s := &SubClashService{SubService: subService}
+	hasMatch := false
+	for _, rule := range strings.Split(rules, "\n") {
+		rule = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rule), "- "))
+		if rule == "" || strings.HasPrefix(rule, "#") {
+			continue
+		}
+		if strings.HasPrefix(rule, "MATCH,") {
+			hasMatch = true
+		}
+		s.rules = append(s.rules, rule)
+	}
+	if len(s.rules) > 0 && !hasMatch {
+		s.rules = append(s.rules, "MATCH,"+clashProxyGroup)
+	}
+	return s
+}
+
+// ClashProxy is a proxy of a Mihomo profile.
+type ClashProxy struct {
+	Name                 string            `yaml:"name"`
+	Type                 string            `yaml:"type"`
+	Server               string            `yaml:"server"`
+	Port                 int               `yaml:"port"`
+	UDP                  bool              `yaml:"udp,omitempty"`
+	UUID                 string            `yaml:"uuid,omitempty"`
+	AlterID              *int              `yaml:"alterId,omitempty"`
+	Cipher               string            `yaml:"cipher,omitempty"`
+	Username             string            `yaml:"username,omitempty"`
+	Password             string            `yaml:"password,omitempty"`
+	Flow                 string            `yaml:"flow,omitempty"`
+	TLS                  bool              `yaml:"tls,omitempty"`
+	ServerName           string            `yaml:"servername,omitempty"`
+	SNI                  string            `yaml:"sni,omitempty"`
+	ALPN                 []string          `yaml:"alpn,omitempty"`
+	Fingerprint          string            `yaml:"client-fingerprint,omitempty"`
+	SkipCertVerify       bool              `yaml:"skip-cert-verify,omitempty"`
+	RealityOpts          map[string]string `yaml:"reality-opts,omitempty"`
+	Network              string            `yaml:"network,omitempty"`
+	WSOpts               map[string]any    `yaml:"ws-opts,omitempty"`
+	HTTPOpts             map[string]any    `yaml:"http-opts,omitempty"`
+	GrpcOpts             map[string]any    `yaml:"grpc-opts,omitempty"`
+	Obfs                 string            `yaml:"obfs,omitempty"`
+	ObfsPassword         string            `yaml:"obfs-password,omitempty"`
+	CongestionController string            `yaml:"congestion-controller,omitempty"`
+	IP                   string            `yaml:"ip,omitempty"`
+	IPv6                 string            `yaml:"ipv6,omitempty"`
+	PrivateKey           string            `yaml:"private-key,omitempty"`
+	PublicKey            string            `yaml:"public-key,omitempty"`
+	PreSharedKey         string            `yaml:"pre-shared-key,omitempty"`
+	MTU                  int               `yaml:"mtu,omitempty"`
+}
+
+type ClashProxyGroup struct {
+	Name      string   `yaml:"name"`
+	Type      string   `yaml:"type"`
+	URL       string   `yaml:"url,omitempty"`
+	Interval  int      `yaml:"interval,omitempty"`
+	Tolerance int      `yaml:"tolerance,omitempty"`
+	Proxies   []string `yaml:"proxies"`
+}
+
+func (s *SubClashService) GetClash(subId string, host string) (string, string, error) {
+	inbounds, err := s.SubService.getInboundsBySubId(subId)
+	if err != nil || len(inbounds) == 0 {
+		return "", "", err
+	}
+
+	var clientTraffics []xray.ClientTraffic
+	var proxies []*ClashProxy
+	for _, inbound := range inbounds {
+		clients, err := s.SubService.getSubClients(inbound)
+		if err != nil {
+			logger.Error("SubClashService - GetClients: Unable to get clients from inbound")
+		}
+		if clients == nil {
+			continue
+		}
+		if len(inbound.Listen) > 0 && inbound.Listen[0] == '@' {
+			listen, port, streamSettings, err := s.SubService.getFallbackMaster(inbound.Listen, inbound.StreamSettings)
+			if err == nil {
+				inbound.Listen = listen
+				inbound.Port = port
+				inbound.StreamSettings = streamSettings
+			}
+		}
+
+		for _, client := range clients {
+			if client.Enable && client.SubID == subId {
+				if !isAccountProtocol(inbound.Protocol) {
+					clientTraffics = append(clientTraffics, s.SubService.getClientTraffics(inbound.ClientStats, client.Email))
+				}
+				proxies = append(proxies, s.getProxies(inbound, client, host)...)
+			}
+		}
+	}
+
+	if len(proxies) == 0 {
+		return "", "", nil
+	}
+
+	profile, err := s.genProfile(proxies)
+	if err != nil {
+		return "", "", err
+	}
+	return profile, genSubHeader(clientTraffics), nil
+}
+
+// genProfile puts the proxies and their groups into the default profile,
+// before its rules.
+func (s *SubClashService) genProfile(proxies []*ClashProxy) (string, error) {
+	// Proxy names must be unique
+	names := make([]string, 0, len(proxies))
+	seen := make(map[string]int)
+	for _, proxy := range proxies {
+		seen[proxy.Name]++
+		if seen[proxy.Name] > 1 {
+			proxy.Name = fmt.Sprintf("%s %d", proxy.Name, seen[proxy.Name])
+		}
+		names = append(names, proxy.Name)
+	}
+
+	groups := []ClashProxyGroup{
+		{
+			Name:    clashProxyGroup,
+			Type:    "select",
+			Proxies: append([]string{clashAutoGroup}, append(names, "DIRECT")...),
+		},
+		{
+			Name:      clashAutoGroup,
+			Type:      "url-test",
+			URL:       "https://www.gstatic.com/generate_204",
+			Interval:  300,
+			Tolerance: 50,
+			Proxies:   names,
+		},
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(defaultClash), &doc); err != nil {
+		return "", err
+	}
+	root := doc.Content[0]
+
+	proxiesNodes, err := yamlKeyValue("proxies", proxies)
+	if err != nil {
+		return "", err
+	}
+	groupsNodes, err := yamlKeyValue("proxy-groups", groups)
+	if err != nil {
+		return "", err
+	}
+	var content []*yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "rules" {
+			content = append(content, proxiesNodes...)
+			content = append(content, groupsNodes...)
+			if len(s.rules) > 0 {
+				if err := root.Content[i+1].Encode(s.rules); err != nil {
+					return "", err
+				}
+			}
+		}
+		content = append(content, root.Content[i], root.Content[i+1])
+	}
+	root.Content = content
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return "", err
+	}
+	encoder.Close()
+	return buf.String(), nil
+}
+
+func yamlKeyValue(key string, value any) ([]*yaml.Node, error) {
+	valueNode := &yaml.Node{}
+	if err := valueNode.Encode(value); err != nil {
+		return nil, err
+	}
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+	return []*yaml.Node{keyNode, valueNode}, nil
+}
+
+// getProxies returns the proxies of a client on an inbound, one per external
+// proxy. Transports Mihomo does not support are left out.
+func (s *SubClashService) getProxies(inbound *model.Inbound, client model.Client, host string) []*ClashProxy {
+	if singbox.IsProtocol(string(inbound.Protocol)) {
+		if proxy := s.genSingboxProxy(inbound, client, host); proxy != nil {
+			return []*ClashProxy{proxy}
+		}
+		return nil
+	}
+	if inbound.Protocol == model.WireGuard {
+		return s.genWireguardProxies(inbound, client, host)
+	}
+
+	var stream map[string]any
+	json.Unmarshal([]byte(inbound.StreamSettings), &stream)
+
+	externalProxies, ok := stream["externalProxy"].([]any)
+	if !ok || len(externalProxies) == 0 {
+		externalProxies = []any{
+			map[string]any{
+				"forceTls": "same",
+				"dest":     host,
+				"port":     float64(inbound.Port),
+				"remark":   "",
+			},
+		}
+	}
+
+	var proxies []*ClashProxy
+	for _, ep := range externalProxies {
+		extPrxy, _ := ep.(map[string]any)
+		dest, _ := extPrxy["dest"].(string)
+		port, _ := extPrxy["port"].(float64)
+		remark, _ := extPrxy["remark"].(string)
+		security, _ := stream["security"].(string)
+		switch extPrxy["forceTls"] {
+		case "tls":
+			security = "tls"
+		case "none":
+			security = "none"
+		}
+
+		proxy := &ClashProxy{
+			Name:   s.SubService.genRemark(inbound, client.Email, remark),
+			Server: dest,
+			Port:   int(port),
+			UDP:    true,
+		}
+		switch inbound.Protocol {
+		case model.VMESS:
+			alterId := 0
+			proxy.Type = "vmess"
+			proxy.UUID = client.ID
+			proxy.AlterID = &alterId
+			proxy.Cipher = client.Security
+			if proxy.Cipher == "" {
+				proxy.Cipher = "auto"
+			}
+		case model.VLESS:
+			proxy.Type = "vless"
+			proxy.UUID = client.ID
+		case model.Trojan:
+			// Mihomo only speaks trojan over TLS
+			if security == "none" || security == "" {
+				continue
+			}
+			proxy.Type = "trojan"
+			proxy.Password = client.Password
+		case model.Shadowsocks:
+			var settings map[string]any
+			json.Unmarshal([]byte(inbound.Settings), &settings)
+			method, _ := settings["method"].(string)
+			proxy.Type = "ss"
+			proxy.Cipher = method
+			proxy.Password = client.Password
+			if strings.HasPrefix(method, "2022") {
+				if serverPassword, ok := settings["password"].(string); ok {
+					proxy.Password = fmt.Sprintf("%s:%s", serverPassword, client.Password)
+				}
+			}
+		case model.Socks:
+			proxy.Type = "socks5"
+			proxy.Username = client.ID
+			proxy.Password = client.Password
+		case model.HTTP:
+			proxy.Type = "http"
+			proxy.UDP = false
+			proxy.Username = client.ID
+			proxy.Password = client.Password
+		default:
+			continue
+		}
+
+		if !s.applyStream(proxy, stream, security, client) {
+			logger.Debug("SubClashService - unsupported stream settings of inbound", inbound.Tag)
+			continue
+		}
+		proxies = append(proxies, proxy)
+	}
+	return proxies
+}
+
+// genWireguardProxies returns the proxies of a peer of a wireguard inbound,
+// one per external proxy.
+func (s *SubClashService) genWireguardProxies(inbound *model.Inbound, client model.Client, host string) []*ClashProxy {
+	settings, err := parseWireguard(inbound)
+	if err != nil {
+		logger.Warning("SubClashService - genWireguardProxies:", err)
+		return nil
+	}
+	peer, ok := wireguardPeerOf(settings, client.Email)
+	if !ok {
+		return nil
+	}
+	ip, ipv6 := splitAddresses(peer.AllowedIPs)
+
+	var proxies []*ClashProxy
+	for _, endpoint := range accountEndpoints(inbound, host) {
+		proxies = append(proxies, &ClashProxy{
+			Name:         s.SubService.genRemark(inbound, client.Email, endpoint.Remark),
+			Type:         "wireguard",
+			Server:       endpoint.Dest,
+			Port:         endpoint.Port,
+			UDP:          true,
+			IP:           ip,
+			IPv6:         ipv6,
+			PrivateKey:   peer.PrivateKey,
+			PublicKey:    settings.PublicKey,
+			PreSharedKey: peer.PreSharedKey,
+			MTU:          settings.MTU,
+		})
+	}
+	return proxies
+}
+
+// applyStream sets the transport and security of a proxy, telling whether
+// Mihomo supports them.
+func (s *SubClashService) applyStream(proxy *ClashProxy, stream map[string]any, security string, client model.Client) bool {
+	network, _ := stream["network"].(string)
+	switch network {
+	case "tcp", "":
+		tcp, _ := stream["tcpSettings"].(map[string]any)
+		header, _ := tcp["header"].(map[string]any)
+		if headerType, _ := header["type"].(string); headerType == "http" {
+			request, _ := header["request"].(map[string]any)
+			requestPath, _ := request["path"].([]any)
+			path := "/"
+			if len(requestPath) > 0 {
+				path, _ = requestPath[0].(string)
+			}
+			headers, _ := request["headers"].(map[string]any)
+			proxy.Network = "http"
+			proxy.HTTPOpts = map[string]any{
+				"method": "GET",
+				"path":   []string{path},
+			}
+			if host := searchHost(headers); host != "" {
+				proxy.HTTPOpts["headers"] = map[string]any{"Host": []string{host}}
+			}
+		} else if proxy.Type == "vless" && len(client.Flow) > 0 && security != "none" {
+			proxy.Flow = client.Flow
+		}
+	case "ws", "httpupgrade":
+		settings, _ := stream[network+"Settings"].(map[string]any)
+		proxy.Network = "ws"
+		proxy.WSOpts = map[string]any{}
+		if path, ok := settings["path"].(string); ok {
+			proxy.WSOpts["path"] = path
+		}
+		host, _ := settings["host"].(string)
+		if host == "" {
+			headers, _ := settings["headers"].(map[string]any)
+			host = searchHost(headers)
+		}
+		if host != "" {
+			proxy.WSOpts["headers"] = map[string]any{"Host": host}
+		}
+		if network == "httpupgrade" {
+			proxy.WSOpts["v2ray-http-upgrade"] = true
+		}
+	case "grpc":
+		grpc, _ := stream["grpcSettings"].(map[string]any)
+		serviceName, _ := grpc["serviceName"].(string)
+		proxy.Network = "grpc"
+		proxy.GrpcOpts = map[string]any{"grpc-service-name": serviceName}
+	default:
+		return false
+	}
+
+	// Shadowsocks has no transports in Mihomo
+	if proxy.Type == "ss" && (proxy.Network != "" || (security != "none" && security != "")) {
+		return false
+	}
+	// nor do socks and http, which only go over TLS
+	if (proxy.Type == "socks5" || proxy.Type == "http") && (proxy.Network != "" || security == "reality") {
+		return false
+	}
+
+	var serverName string
+	switch security {
+	case "tls":
+		tlsSetting, _ := stream["tlsSettings"].(map[string]any)
+		tlsSettings, _ := tlsSetting["settings"].(map[string]any)
+		proxy.TLS = true
+		serverName, _ = tlsSetting["serverName"].(string)
+		if alpns, ok := tlsSetting["alpn"].([]any); ok {
+			for _, alpn := range alpns {
+				if a, ok := alpn.(string); ok {
+					proxy.ALPN = append(proxy.ALPN, a)
+				}
+			}
+		}
+		proxy.Fingerprint, _ = tlsSettings["fingerprint"].(string)
+		proxy.SkipCertVerify, _ = tlsSettings["allowInsecure"].(bool)
+	case "reality":
+		realitySetting, _ := stream["realitySettings"].(map[string]any)
+		realitySettings, _ := realitySetting["settings"].(map[string]any)
+		proxy.TLS = true
+		if serverNames, ok := realitySetting["serverNames"].([]any); ok && len(serverNames) > 0 {
+			serverName, _ = serverNames[random.Num(len(serverNames))].(string)
+		}
+		publicKey, _ := realitySettings["publicKey"].(string)
+		shortId := ""
+		if shortIds, ok := realitySetting["shortIds"].([]any); ok && len(shortIds) > 0 {
+			shortId, _ = shortIds[random.Num(len(shortIds))].(string)
+		}
+		proxy.RealityOpts = map[string]string{
+			"public-key": publicKey,
+			"short-id":   shortId,
+		}
+		proxy.Fingerprint, _ = realitySettings["fingerprint"].(string)
+		if proxy.Fingerprint == "" {
+			proxy.Fingerprint = "chrome"
+		}
+	}
+
+	if proxy.Type == "trojan" {
+		// trojan is always over TLS and names the server with sni
+		proxy.TLS = false
+		proxy.SNI = serverName
+	} else {
+		proxy.ServerName = serverName
+	}
+	return true
+}
+
+// genSingboxProxy returns the proxy of a client on a hysteria2 or tuic
+// inbound served by sing-box.
+func (s *SubClashService) genSingboxProxy(inbound *model.Inbound, client model.Client, host string) *ClashProxy {
+	config, err := singbox.NewInbound(string(inbound.Protocol), inbound.Tag, inbound.Listen, inbound.Port, inbound.Settings, inbound.StreamSettings)
+	if err != nil {
+		logger.Warning("SubClashService - genSingboxProxy:", err)
+		return nil
+	}
+
+	proxy := &ClashProxy{
+		Name:     s.SubService.genRemark(inbound, client.Email, ""),
+		Server:   host,
+		Port:     inbound.Port,
+		Password: client.Password,
+	}
+	tls, _ := config["tls"].(map[string]any)
+	proxy.SNI, _ = tls["server_name"].(string)
+	if alpns, ok := tls["alpn"].([]any); ok {
+		for _, alpn := range alpns {
+			proxy.ALPN = append(proxy.ALPN, fmt.Sprint(alpn))
+		}
+	}
+
+	switch inbound.Protocol {
+	case model.Hysteria2:
+		proxy.Type = "hysteria2"
+		if obfs, ok := config["obfs"].(map[string]any); ok {
+			proxy.Obfs, _ = obfs["type"].(string)
+			proxy.ObfsPassword, _ = obfs["password"].(string)
+		}
+	case model.TUIC:
+		proxy.Type = "tuic"
+		proxy.UUID = client.ID
+		proxy.CongestionController, _ = config["congestion_control"].(string)
+	default:
+		return nil
+	}
+	return proxy
+}
@@ -1,22 +1,44 @@
 package sub
 
 import (
+	"context"
 	"encoding/base64"
+	"html/template"
 	"net"
 	"strings"
 
+	"x-ui/database"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/locale"
+	"x-ui/web/service"
+	"x-ui/xray"
+
 	"github.com/gin-gonic/gin"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
 )
 
 type SUBController struct {
 	subTitle       string
 	subPath        string
 	subJsonPath    string
+	subClashPath   string
+	subSingboxPath string
 	subEncrypt     bool
 	updateInterval string
+	formatRules    []formatRule
+	pageTemplate   *template.Template
+	qrcodeScript   template.JS
+	subCache       *subCache
+	subNodes       *subNodes
+
+	subService      *SubService
+	subJsonService  *SubJsonService
+	subClashService *SubClashService
 
-	subService     *SubService
-	subJsonService *SubJsonService
+	subSingboxService *SubSingboxService
+	subAccessService  service.SubAccessService
+	subDeviceService  service.SubDeviceService
 }
 
 func NewSUBController(
@@ -31,18 +53,37 @@ func NewSUBController(
 	jsonNoise string,
 	jsonMux string,
 	jsonRules string,
+	clashPath string,
+	clashRules string,
+	singboxPath string,
+	singboxDns string,
+	singboxRules string,
+	formatRules string,
 	subTitle string,
+	nodes string,
+	nodeSecret string,
+	nodeCacheMinutes int,
 ) *SUBController {
 	sub := NewSubService(showInfo, rModel)
 	a := &SUBController{
 		subTitle:       subTitle,
 		subPath:        subPath,
 		subJsonPath:    jsonPath,
+		subClashPath:   clashPath,
+		subSingboxPath: singboxPath,
 		subEncrypt:     encrypt,
 		updateInterval: update,
+		formatRules:    parseFormatRules(formatRules),
+		pageTemplate:   newPageTemplate(),
+		qrcodeScript:   loadQRCodeScript(),
+		subCache:       newSubCache(),
+		subNodes:       newSubNodes(nodes, nodeSecret, nodeCacheMinutes),
 
-		subService:     sub,
-		subJsonService: NewSubJsonService(jsonFragment, jsonNoise, jsonMux, jsonRules, sub),
+		subService:      sub,
+		subJsonService:  NewSubJsonService(jsonFragment, jsonNoise, jsonMux, jsonRules, sub),
+		subClashService: NewSubClashService(clashRules, sub),
+
+		subSingboxService: NewSubSingboxService(singboxDns, singboxRules, sub),
 	}
 	a.initRouter(g)
 	return a
@@ -51,52 +92,186 @@ func NewSUBController(
 func (a *SUBController) initRouter(g *gin.RouterGroup) {
 	gLink := g.Group(a.subPath)
 	gJson := g.Group(a.subJsonPath)
+	gClash := g.Group(a.subClashPath)
+	gSingbox := g.Group(a.subSingboxPath)
+
+	gLink.GET(":subid", a.negotiate(formatLinks, true))
 
-	gLink.GET(":subid", a.subs)
+	gJson.GET(":subid", a.negotiate(formatJson, false))
 
-	gJson.GET(":subid", a.subJsons)
+	gClash.GET(":subid", a.negotiate(formatClash, false))
+
+	gSingbox.GET(":subid", a.negotiate(formatSingbox, false))
 }
 
-func (a *SUBController) subs(c *gin.Context) {
-	subId := c.Param("subid")
-	var host string
-	if h, err := getHostFromXFH(c.GetHeader("X-Forwarded-Host")); err == nil {
-		host = h
-	}
-	if host == "" {
-		host = c.GetHeader("X-Real-IP")
+// negotiate serves a subscription in the format asked for with ?format=, or
+// else in the one the User-Agent of the client maps to when byUserAgent is
+// set, or else in the format of the path. The subscription is looked up by
+// what its link stands for, and is only served to the devices it is bound
+// to, but for its page. Other nodes are served the links of the subscription
+// held here, as they are, for them to merge into theirs, and while there are
+// nodes the other formats are served a placeholder asking for the links.
+func (a *SUBController) negotiate(pathFormat string, byUserAgent bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a.subNodes.isNode(c) {
+			a.serveSub(c, c.Param("subid"), formatLinks, false)
+			return
+		}
+
+		format := c.Query("format")
+		if format == "" && byUserAgent {
+			c.Writer.Header().Set("Vary", "User-Agent")
+			format = formatOf(a.formatRules, c.GetHeader("User-Agent"))
+		}
+		if !isFormat(format) {
+			format = pathFormat
+		}
+
+		subId, err := a.subService.ResolveSubId(c.Param("subid"))
+		if err != nil {
+			logger.Debug("SUBController - unable to resolve the subscription:", err)
+			c.String(400, "Error!")
+			return
+		}
+		a.subAccessService.Record(subId, c.ClientIP(), c.GetHeader("User-Agent"), format)
+		if format != formatPage && !a.bindDevice(c, subId, format) {
+			return
+		}
+
+		switch {
+		case format == formatPage:
+			a.subPage(c, subId)
+		case a.subNodes.enabled() && format != formatLinks:
+			// only links are merged with those of the nodes, so the other
+			// formats would be missing them
+			localizer, _ := c.MustGet("localizer").(*i18n.Localizer)
+			a.subPlaceholder(c, format, locale.Localize(localizer, "pages.sub.nodesLinksOnly"))
+		default:
+			a.serveSub(c, subId, format, a.subNodes.enabled())
+		}
 	}
-	if host == "" {
+}
+
+// serveSub serves a subscription in one of the formats of apps, from the
+// cache while its inbounds and clients are unchanged, and with no body when
+// the app already has it. Links are merged with those of the other nodes
+// when merge is set.
+func (a *SUBController) serveSub(c *gin.Context, subId string, format string, merge bool) {
+	host := getHost(c)
+	key := subCacheKey{subId: subId, format: format, host: host, merge: merge}
+	response, ok := a.subCache.get(key)
+	if !ok {
+		revision := database.Revision()
 		var err error
-		host, _, err = net.SplitHostPort(c.Request.Host)
+		response, err = a.genSub(c.Request.Context(), subId, format, host, merge)
 		if err != nil {
-			host = c.Request.Host
+			c.String(400, "Error!")
+			return
 		}
-	}
-	subs, header, err := a.subService.GetSubs(subId, host)
-	if err != nil || len(subs) == 0 {
-		c.String(400, "Error!")
-	} else {
-		result := ""
-		for _, sub := range subs {
-			result += sub + "\n"
+		// The nodes are given up on when the app goes away, so what is
+		// generated then may be missing their links
+		if c.Request.Context().Err() != nil {
+			return
 		}
+		a.subCache.put(key, revision, response)
+	}
 
-		// Add headers
-		c.Writer.Header().Set("Subscription-Userinfo", header)
-		c.Writer.Header().Set("Profile-Update-Interval", a.updateInterval)
-		c.Writer.Header().Set("Profile-Title", "base64:" + base64.StdEncoding.EncodeToString([]byte(a.subTitle)))
+	clientTraffics, err := a.subService.GetSubTraffics(subId)
+	if err != nil {
+		logger.Warning("SUBController - unable to get the traffic of the subscription:", err)
+	}
+	clientTraffics = append(clientTraffics, response.nodeTraffics...)
+
+	// Add headers
+	c.Writer.Header().Set("Subscription-Userinfo", genSubHeader(clientTraffics))
+	c.Writer.Header().Set("Profile-Update-Interval", a.updateInterval)
+	c.Writer.Header().Set("Profile-Title", "base64:"+base64.StdEncoding.EncodeToString([]byte(a.subTitle)))
+	c.Writer.Header().Set("ETag", response.etag)
+
+	if etagMatches(c.GetHeader("If-None-Match"), response.etag) {
+		c.Status(304)
+		return
+	}
+	c.Data(200, response.contentType, response.body)
+}
 
+// genSub generates a subscription in one of the formats of apps.
+func (a *SUBController) genSub(ctx context.Context, subId string, format string, host string, merge bool) (*subResponse, error) {
+	var body, contentType string
+	var nodeTraffics []xray.ClientTraffic
+	var err error
+	switch format {
+	case formatJson:
+		body, _, err = a.subJsonService.GetJson(subId, host)
+		contentType = "text/plain; charset=utf-8"
+	case formatClash:
+		body, _, err = a.subClashService.GetClash(subId, host)
+		contentType = "text/yaml; charset=utf-8"
+	case formatSingbox:
+		body, _, err = a.subSingboxService.GetSingbox(subId, host)
+		contentType = "application/json; charset=utf-8"
+	default:
+		var subs []string
+		subs, _, err = a.subService.GetSubs(subId, host)
+		if merge {
+			subs, nodeTraffics, err = a.subNodes.merge(ctx, subId, subs, err)
+		}
+		for _, sub := range subs {
+			body += sub + "\n"
+		}
 		if a.subEncrypt {
-			c.String(200, base64.StdEncoding.EncodeToString([]byte(result)))
-		} else {
-			c.String(200, result)
+			body = base64.StdEncoding.EncodeToString([]byte(body))
 		}
+		contentType = "text/plain; charset=utf-8"
 	}
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return nil, common.NewError("No configs found with ", subId)
+	}
+	return &subResponse{
+		body:         []byte(body),
+		contentType:  contentType,
+		nodeTraffics: nodeTraffics,
+		etag:         genETag([]byte(body)),
+	}, nil
 }
 
-func (a *SUBController) subJsons(c *gin.Context) {
-	subId := c.Param("subid")
+func (a *SUBController) subPage(c *gin.Context, subId string) {
+	page, err := a.subService.GetSubPage(subId, getHost(c))
+	if err != nil {
+		c.String(400, "Error!")
+		return
+	}
+
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	requestHost := c.Request.Host
+	if h := c.GetHeader("X-Forwarded-Host"); h != "" {
+		requestHost = h
+	}
+	page.Title = a.subTitle
+	page.SubURL = scheme + "://" + requestHost + c.Request.URL.Path
+	page.Apps = genSubPageApps(page.SubURL, a.subTitle)
+	page.QRCodeScript = a.qrcodeScript
+	page.Localizer, _ = c.MustGet("localizer").(*i18n.Localizer)
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(200)
+	if err := a.pageTemplate.Execute(c.Writer, page); err != nil {
+		logger.Warning("SUBController - unable to render the page:", err)
+	}
+}
+
+// getHost returns the host the links of a subscription point to, the one
+// the request was made to.
+func getHost(c *gin.Context) string {
 	var host string
 	if h, err := getHostFromXFH(c.GetHeader("X-Forwarded-Host")); err == nil {
 		host = h
@@ -111,18 +286,7 @@ func (a *SUBController) subJsons(c *gin.Context) {
 			host = c.Request.Host
 		}
 	}
-	jsonSub, header, err := a.subJsonService.GetJson(subId, host)
-	if err != nil || len(jsonSub) == 0 {
-		c.String(400, "Error!")
-	} else {
-
-		// Add headers
-		c.Writer.Header().Set("Subscription-Userinfo", header)
-		c.Writer.Header().Set("Profile-Update-Interval", a.updateInterval)
-		c.Writer.Header().Set("Profile-Title", "base64:" + base64.StdEncoding.EncodeToString([]byte(a.subTitle)))
-
-		c.String(200, jsonSub)
-	}
+	return host
 }
 
 func getHostFromXFH(s string) (string, error) {
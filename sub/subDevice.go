@@ -0,0 +1,101 @@
+package sub
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strconv"
+
+	"x-ui/logger"
+	"x-ui/web/locale"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+	"gopkg.in/yaml.v3"
+)
+
+// The placeholder a refused device is served points nowhere, its name being
+// the only thing the app shows.
+const (
+	placeholderAddress = "127.0.0.1"
+	placeholderPort    = 1
+)
+
+// deviceInfo reads the headers apps like Happ and v2RayTun describe the
+// device they run on with.
+func deviceInfo(c *gin.Context) service.SubDeviceInfo {
+	return service.SubDeviceInfo{
+		Hwid:      c.GetHeader("X-Hwid"),
+		Os:        c.GetHeader("X-Device-Os"),
+		OsVersion: c.GetHeader("X-Ver-Os"),
+		Model:     c.GetHeader("X-Device-Model"),
+		UserAgent: c.GetHeader("User-Agent"),
+		IP:        c.ClientIP(),
+	}
+}
+
+// bindDevice tells whether the device fetching a subscription may be served,
+// serving it the placeholder explaining why not when it may not.
+func (a *SUBController) bindDevice(c *gin.Context, subId string, format string) bool {
+	info := deviceInfo(c)
+	allowed, err := a.subDeviceService.Bind(subId, info)
+	if err != nil {
+		logger.Warning("SUBController - unable to bind the device:", err)
+	}
+	if allowed {
+		return true
+	}
+
+	localizer, _ := c.MustGet("localizer").(*i18n.Localizer)
+	message := locale.Localize(localizer, "pages.sub.deviceLimit")
+	if info.Hwid == "" {
+		message = locale.Localize(localizer, "pages.sub.deviceHwidRequired")
+	}
+	a.subPlaceholder(c, format, message)
+	return false
+}
+
+// subPlaceholder serves a config in the format asked for holding a single
+// server named after the message, so that the app shows it to the user.
+func (a *SUBController) subPlaceholder(c *gin.Context, format string, message string) {
+	c.Writer.Header().Set("Profile-Title", "base64:"+base64.StdEncoding.EncodeToString([]byte(a.subTitle)))
+	c.Writer.Header().Set("Announce", "base64:"+base64.StdEncoding.EncodeToString([]byte(message)))
+
+	switch format {
+	case formatJson:
+		config, _ := json.MarshalIndent(map[string]any{
+			"remarks": message,
+			"outbounds": []map[string]any{
+				{"tag": "block", "protocol": "blackhole"},
+			},
+		}, "", "  ")
+		c.String(200, string(config))
+	case formatClash:
+		profile, _ := yaml.Marshal(map[string]any{
+			"proxies": []map[string]any{
+				{"name": message, "type": "socks5", "server": placeholderAddress, "port": placeholderPort},
+			},
+			"proxy-groups": []map[string]any{
+				{"name": clashProxyGroup, "type": "select", "proxies": []string{message}},
+			},
+			"rules": []string{"MATCH," + clashProxyGroup},
+		})
+		c.Data(200, "text/yaml; charset=utf-8", profile)
+	case formatSingbox:
+		profile, _ := json.MarshalIndent(map[string]any{
+			"outbounds": []map[string]any{
+				{"type": "socks", "tag": message, "server": placeholderAddress, "server_port": placeholderPort},
+			},
+		}, "", "  ")
+		c.Data(200, "application/json; charset=utf-8", profile)
+	default:
+		link := "vless://" + uuid.Nil.String() + "@" + placeholderAddress + ":" + strconv.Itoa(placeholderPort) + "?type=tcp&security=none#" + url.PathEscape(message)
+		if a.subEncrypt {
+			c.String(200, base64.StdEncoding.EncodeToString([]byte(link+"\n")))
+		} else {
+			c.String(200, link+"\n")
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package sub
+
+import (
+	"encoding/json"
+	"regexp"
+
+	"x-ui/logger"
+)
+
+// The formats a subscription is served in.
+const (
+	formatLinks   = "links"
+	formatJson    = "json"
+	formatClash   = "clash"
+	formatSingbox = "singbox"
+	formatPage    = "page"
+)
+
+func isFormat(format string) bool {
+	switch format {
+	case formatLinks, formatJson, formatClash, formatSingbox, formatPage:
+		return true
+	}
+	return false
+}
+
+// SubFormatRule maps the clients whose User-Agent matches a pattern to the
+// format they are best served in.
+type SubFormatRule struct {
+	UserAgent string `json:"userAgent"`
+	Format    string `json:"format"`
+}
+
+type formatRule struct {
+	userAgent *regexp.Regexp
+	format    string
+}
+
+// parseFormatRules reads the User-Agent to format rules, a JSON array of
+// SubFormatRule matched in order and regardless of case. Invalid rules are
+// skipped.
+func parseFormatRules(rules string) []formatRule {
+	if rules == "" {
+		return nil
+	}
+	var subFormatRules []SubFormatRule
+	if err := json.Unmarshal([]byte(rules), &subFormatRules); err != nil {
+		logger.Warning("SUBController - invalid format rules:", err)
+		return nil
+	}
+
+	var formatRules []formatRule
+	for _, rule := range subFormatRules {
+		if rule.UserAgent == "" || !isFormat(rule.Format) {
+			logger.Warning("SUBController - invalid format rule:", rule.UserAgent, rule.Format)
+			continue
+		}
+		userAgent, err := regexp.Compile("(?i)" + rule.UserAgent)
+		if err != nil {
+			logger.Warning("SUBController - invalid format rule:", err)
+			continue
+		}
+		formatRules = append(formatRules, formatRule{userAgent: userAgent, format: rule.Format})
+	}
+	return formatRules
+}
+
+// formatOf returns the format of the first rule matching the User-Agent, or
+// "" when none does.
+func formatOf(rules []formatRule, userAgent string) string {
+	if userAgent == "" {
+		return ""
+	}
+	for _, rule := range rules {
+		if rule.userAgent.MatchString(userAgent) {
+			return rule.format
+		}
+	}
+	return ""
+}
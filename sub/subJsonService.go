@@ -4,10 +4,13 @@ import (
 	_ "embed"
 	"encoding/json"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
 
 	"x-ui/database/model"
 	"x-ui/logger"
+	"x-ui/singbox"
 	"x-ui/util/json_util"
 	"x-ui/util/random"
 	"x-ui/xray"
@@ -74,13 +77,12 @@ func (s *SubJsonService) GetJson(subId string, host string) (string, string, err
 	}
 
 	var header string
-	var traffic xray.ClientTraffic
 	var clientTraffics []xray.ClientTraffic
 	var configArray []json_util.RawMessage
 
 	// Prepare Inbounds
 	for _, inbound := range inbounds {
-		clients, err := s.inboundService.GetClients(inbound)
+		clients, err := s.SubService.getSubClients(inbound)
 		if err != nil {
 			logger.Error("SubJsonService - GetClients: Unable to get clients from inbound")
 		}
@@ -98,7 +100,13 @@ func (s *SubJsonService) GetJson(subId string, host string) (string, string, err
 
 		for _, client := range clients {
 			if client.Enable && client.SubID == subId {
-				clientTraffics = append(clientTraffics, s.SubService.getClientTraffics(inbound.ClientStats, client.Email))
+				if !isAccountProtocol(inbound.Protocol) {
+					clientTraffics = append(clientTraffics, s.SubService.getClientTraffics(inbound.ClientStats, client.Email))
+				}
+				if singbox.IsProtocol(string(inbound.Protocol)) {
+					// xray json configs can not describe sing-box protocols
+					continue
+				}
 				newConfigs := s.getConfig(inbound, client, host)
 				configArray = append(configArray, newConfigs...)
 			}
@@ -109,29 +117,6 @@ func (s *SubJsonService) GetJson(subId string, host string) (string, string, err
 		return "", "", nil
 	}
 
-	// Prepare statistics
-	for index, clientTraffic := range clientTraffics {
-		if index == 0 {
-			traffic.Up = clientTraffic.Up
-			traffic.Down = clientTraffic.Down
-			traffic.Total = clientTraffic.Total
-			if clientTraffic.ExpiryTime > 0 {
-				traffic.ExpiryTime = clientTraffic.ExpiryTime
-			}
-		} else {
-			traffic.Up += clientTraffic.Up
-			traffic.Down += clientTraffic.Down
-			if traffic.Total == 0 || clientTraffic.Total == 0 {
-				traffic.Total = 0
-			} else {
-				traffic.Total += clientTraffic.Total
-			}
-			if clientTraffic.ExpiryTime != traffic.ExpiryTime {
-				traffic.ExpiryTime = 0
-			}
-		}
-	}
-
 	// Combile outbounds
 	var finalJson []byte
 	if len(configArray) == 1 {
@@ -140,7 +125,7 @@ func (s *SubJsonService) GetJson(subId string, host string) (string, string, err
 		finalJson, _ = json.MarshalIndent(configArray, "", "  ")
 	}
 
-	header = fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", traffic.Up, traffic.Down, traffic.Total, traffic.ExpiryTime/1000)
+	header = genSubHeader(clientTraffics)
 	return string(finalJson), header, nil
 }
 
@@ -188,6 +173,14 @@ func (s *SubJsonService) getConfig(inbound *model.Inbound, client model.Client,
 			newOutbounds = append(newOutbounds, s.genVnext(inbound, streamSettings, client))
 		case "trojan", "shadowsocks":
 			newOutbounds = append(newOutbounds, s.genServer(inbound, streamSettings, client))
+		case "socks", "http":
+			newOutbounds = append(newOutbounds, s.genAccountServer(inbound, streamSettings, client))
+		case "wireguard":
+			outbound := s.genWireguard(inbound, client)
+			if outbound == nil {
+				continue
+			}
+			newOutbounds = append(newOutbounds, outbound)
 		}
 
 		newOutbounds = append(newOutbounds, s.defaultOutbounds...)
@@ -356,6 +349,70 @@ func (s *SubJsonService) genServer(inbound *model.Inbound, streamSettings json_u
 	return result
 }
 
+// genAccountServer generates the outbound of an account of a socks or http
+// inbound.
+func (s *SubJsonService) genAccountServer(inbound *model.Inbound, streamSettings json_util.RawMessage, client model.Client) json_util.RawMessage {
+	outbound := map[string]any{
+		"protocol":       string(inbound.Protocol),
+		"tag":            "proxy",
+		"streamSettings": streamSettings,
+		"settings": map[string]any{
+			"servers": []map[string]any{
+				{
+					"address": inbound.Listen,
+					"port":    inbound.Port,
+					"users": []map[string]any{
+						{"user": client.ID, "pass": client.Password, "level": 8},
+					},
+				},
+			},
+		},
+	}
+	result, _ := json.MarshalIndent(outbound, "", "  ")
+	return result
+}
+
+// genWireguard generates the outbound of a peer of a wireguard inbound.
+func (s *SubJsonService) genWireguard(inbound *model.Inbound, client model.Client) json_util.RawMessage {
+	settings, err := parseWireguard(inbound)
+	if err != nil {
+		logger.Warning("SubJsonService - genWireguard:", err)
+		return nil
+	}
+	peer, ok := wireguardPeerOf(settings, client.Email)
+	if !ok {
+		return nil
+	}
+
+	serverPeer := map[string]any{
+		"publicKey":  settings.PublicKey,
+		"endpoint":   net.JoinHostPort(inbound.Listen, strconv.Itoa(inbound.Port)),
+		"allowedIPs": []string{"0.0.0.0/0", "::/0"},
+	}
+	if peer.PreSharedKey != "" {
+		serverPeer["preSharedKey"] = peer.PreSharedKey
+	}
+	if peer.KeepAlive > 0 {
+		serverPeer["keepAlive"] = peer.KeepAlive
+	}
+	wireguard := map[string]any{
+		"secretKey": peer.PrivateKey,
+		"address":   peer.AllowedIPs,
+		"peers":     []any{serverPeer},
+	}
+	if settings.MTU > 0 {
+		wireguard["mtu"] = settings.MTU
+	}
+
+	outbound := map[string]any{
+		"protocol": string(inbound.Protocol),
+		"tag":      "proxy",
+		"settings": wireguard,
+	}
+	result, _ := json.MarshalIndent(outbound, "", "  ")
+	return result
+}
+
 type Outbound struct {
 	Protocol       string               `json:"protocol"`
 	Tag            string               `json:"tag"`
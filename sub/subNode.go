@@ -0,0 +1,310 @@
+package sub
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/xray"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// subNodeSecretHeader carries the secret shared by the nodes, telling a
+	// node that the request comes from another one.
+	subNodeSecretHeader = "X-Sub-Node-Secret"
+	// subNodeTimeout is how long a node is waited for unless it says.
+	subNodeTimeout = 5 * time.Second
+	// subNodeMaxBody bounds what is read of the subscription of a node.
+	subNodeMaxBody = 4 << 20
+	// subNodeMaxStale bounds how long what a node served is still served
+	// while the node cannot be reached.
+	subNodeMaxStale = 24 * time.Hour
+)
+
+// SubNode is a remote panel whose links are merged into the subscriptions
+// served here, fetched from its subscription endpoint.
+type SubNode struct {
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	Prefix  string `json:"prefix"`
+	Timeout int    `json:"timeout"`
+}
+
+// subNodeResult is the subscription of a node for a subId.
+type subNodeResult struct {
+	links      []string
+	traffic    xray.ClientTraffic
+	hasTraffic bool
+	fetched    time.Time
+}
+
+type subNodeKey struct {
+	node  int
+	subId string
+}
+
+// subNodes merges the subscriptions of the remote nodes into the ones served
+// here. What a node serves is kept for cacheTTL, and served for up to
+// subNodeMaxStale when the node cannot be reached.
+type subNodes struct {
+	nodes    []SubNode
+	secret   string
+	cacheTTL time.Duration
+	client   *http.Client
+
+	lock  sync.Mutex
+	cache map[subNodeKey]*subNodeResult
+}
+
+func newSubNodes(nodes string, secret string, cacheMinutes int) *subNodes {
+	return &subNodes{
+		nodes:    parseSubNodes(nodes),
+		secret:   secret,
+		cacheTTL: time.Duration(cacheMinutes) * time.Minute,
+		client:   &http.Client{},
+		cache:    make(map[subNodeKey]*subNodeResult),
+	}
+}
+
+// parseSubNodes reads the nodes, a JSON array of SubNode. Nodes with no
+// valid http or https URL are skipped.
+func parseSubNodes(nodes string) []SubNode {
+	if nodes == "" {
+		return nil
+	}
+	var subNodes []SubNode
+	if err := json.Unmarshal([]byte(nodes), &subNodes); err != nil {
+		logger.Warning("SUBController - invalid nodes:", err)
+		return nil
+	}
+
+	var validNodes []SubNode
+	for _, node := range subNodes {
+		nodeURL, err := url.Parse(node.URL)
+		if err != nil || (nodeURL.Scheme != "http" && nodeURL.Scheme != "https") || nodeURL.Host == "" {
+			logger.Warning("SUBController - invalid node:", node.Name, node.URL)
+			continue
+		}
+		validNodes = append(validNodes, node)
+	}
+	return validNodes
+}
+
+func (n *subNodes) enabled() bool {
+	return len(n.nodes) > 0
+}
+
+// isNode tells whether a request comes from another node, by the secret the
+// nodes share.
+func (n *subNodes) isNode(c *gin.Context) bool {
+	secret := c.GetHeader(subNodeSecretHeader)
+	return n.secret != "" && secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(n.secret)) == 1
+}
+
+// merge adds the links of the nodes to the links of a subscription served
+// here, and returns their usage for its Subscription-Userinfo header. The
+// subscription is only missing when it is missing everywhere.
+func (n *subNodes) merge(ctx context.Context, subId string, links []string, err error) ([]string, []xray.ClientTraffic, error) {
+	var clientTraffics []xray.ClientTraffic
+	found := false
+	for _, result := range n.fetchAll(ctx, subId) {
+		if result == nil || len(result.links) == 0 {
+			continue
+		}
+		found = true
+		links = append(links, result.links...)
+		if result.hasTraffic {
+			clientTraffics = append(clientTraffics, result.traffic)
+		}
+	}
+	if err != nil && !found {
+		return nil, nil, err
+	}
+	return links, clientTraffics, nil
+}
+
+// fetchAll fetches a subscription from all the nodes at once, returning what
+// each serves in the order of the nodes, nil for those that failed. The
+// fetches are given up with ctx, that of the request being served.
+func (n *subNodes) fetchAll(ctx context.Context, subId string) []*subNodeResult {
+	results := make([]*subNodeResult, len(n.nodes))
+	var wg sync.WaitGroup
+	for index := range n.nodes {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			results[index] = n.fetch(ctx, index, subId)
+		}(index)
+	}
+	wg.Wait()
+	return results
+}
+
+// fetch returns what a node serves for a subscription, from the cache while
+// it is fresh, or while the node fails and it is not too stale.
+func (n *subNodes) fetch(ctx context.Context, index int, subId string) *subNodeResult {
+	key := subNodeKey{node: index, subId: subId}
+	n.lock.Lock()
+	cached := n.cache[key]
+	n.lock.Unlock()
+	if cached != nil && time.Since(cached.fetched) < n.cacheTTL {
+		return cached
+	}
+
+	node := n.nodes[index]
+	result, err := n.request(ctx, node, subId)
+	if err != nil {
+		logger.Warning("SUBController - unable to fetch the subscription from node", node.Name+":", err)
+		if cached != nil && time.Since(cached.fetched) < subNodeMaxStale {
+			return cached
+		}
+		return nil
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for key, result := range n.cache {
+		if time.Since(result.fetched) >= subNodeMaxStale {
+			delete(n.cache, key)
+		}
+	}
+	n.cache[key] = result
+	return result
+}
+
+// request fetches the links of a subscription from a node. A node that has
+// no such subscription serves it empty.
+func (n *subNodes) request(ctx context.Context, node SubNode, subId string) (*subNodeResult, error) {
+	timeout := subNodeTimeout
+	if node.Timeout > 0 {
+		timeout = time.Duration(node.Timeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	subURL := strings.TrimSuffix(node.URL, "/") + "/" + url.PathEscape(subId) + "?format=" + formatLinks
+	req, err := http.NewRequestWithContext(ctx, "GET", subURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "x-ui")
+	if n.secret != "" {
+		req.Header.Set(subNodeSecretHeader, n.secret)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	result := &subNodeResult{fetched: time.Now()}
+	if resp.StatusCode == http.StatusBadRequest {
+		return result, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, subNodeMaxBody))
+	if err != nil {
+		return nil, err
+	}
+
+	result.traffic, result.hasTraffic = parseUserInfo(resp.Header.Get("Subscription-Userinfo"))
+	for _, link := range strings.Split(decodeLinks(string(body)), "\n") {
+		link = strings.TrimSpace(link)
+		if link != "" {
+			result.links = append(result.links, prefixRemark(link, node.Prefix))
+		}
+	}
+	return result, nil
+}
+
+// decodeLinks returns the links of a subscription, decoding them when the
+// node serves them base64 encoded.
+func decodeLinks(body string) string {
+	body = strings.TrimSpace(body)
+	if strings.Contains(body, "://") {
+		return body
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if decoded, err := encoding.DecodeString(body); err == nil {
+			return string(decoded)
+		}
+	}
+	return body
+}
+
+// parseUserInfo reads a Subscription-Userinfo header, the expiry of which is
+// in seconds.
+func parseUserInfo(header string) (xray.ClientTraffic, bool) {
+	var traffic xray.ClientTraffic
+	found := false
+	for _, field := range strings.Split(header, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			continue
+		}
+		number, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "upload":
+			traffic.Up = number
+		case "download":
+			traffic.Down = number
+		case "total":
+			traffic.Total = number
+		case "expire":
+			traffic.ExpiryTime = number * 1000
+		default:
+			continue
+		}
+		found = true
+	}
+	return traffic, found
+}
+
+// prefixRemark prepends the prefix of a node to the remark of a link, in the
+// ps field of vmess links and in the fragment of the others.
+func prefixRemark(link string, prefix string) string {
+	if prefix == "" {
+		return link
+	}
+	if config, ok := strings.CutPrefix(link, "vmess://"); ok {
+		decoded, err := base64.StdEncoding.DecodeString(config)
+		if err != nil {
+			decoded, err = base64.RawStdEncoding.DecodeString(config)
+		}
+		var obj map[string]any
+		if err != nil || json.Unmarshal(decoded, &obj) != nil {
+			return link
+		}
+		remark, _ := obj["ps"].(string)
+		obj["ps"] = prefix + remark
+		encoded, err := json.MarshalIndent(obj, "", "  ")
+		if err != nil {
+			return link
+		}
+		return "vmess://" + base64.StdEncoding.EncodeToString(encoded)
+	}
+
+	link, fragment, _ := strings.Cut(link, "#")
+	remark, err := url.PathUnescape(fragment)
+	if err != nil {
+		remark = fragment
+	}
+	return link + "#" + url.PathEscape(prefix+remark)
+}
@@ -0,0 +1,178 @@
+package sub
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"html/template"
+	"net/url"
+	"strings"
+	"time"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web"
+	"x-ui/web/locale"
+	"x-ui/xray"
+
+	"github.com/nicksnyder/go-i18n/v2/i18n"
+)
+
+//go:embed page.html
+var pageHtml string
+
+// The statuses of a subscription shown on its page.
+const (
+	subStatusActive   = "active"
+	subStatusDepleted = "depleted"
+	subStatusExpired  = "expired"
+	subStatusDisabled = "disabled"
+)
+
+// SubPage is what the landing page of a subscription shows to browsers.
+type SubPage struct {
+	Title   string
+	SubURL  string
+	Status  string
+	Traffic xray.ClientTraffic
+	Links   []SubPageLink
+	Apps    []SubPageApp
+
+	QRCodeScript template.JS
+	// Localizer translates the page into the language of the request.
+	Localizer *i18n.Localizer
+}
+
+type SubPageLink struct {
+	Remark string
+	Link   string
+	// Config is the wg-quick config of a wireguard peer.
+	Config string
+}
+
+// SubPageApp is a button importing the subscription into a client app.
+type SubPageApp struct {
+	Name string
+	URL  template.URL
+}
+
+// GetSubPage returns the page of a subscription. Unlike the other formats,
+// the page is also shown for subscriptions whose clients are all disabled,
+// telling why.
+func (s *SubService) GetSubPage(subId string, host string) (*SubPage, error) {
+	s = s.forHost(host)
+	inbounds, err := s.getInboundsBySubId(subId)
+	if err != nil {
+		return nil, err
+	}
+	if len(inbounds) == 0 {
+		return nil, common.NewError("No inbounds found with ", subId)
+	}
+
+	page := &SubPage{}
+	var clientTraffics []xray.ClientTraffic
+	enabled := false
+	for _, inbound := range inbounds {
+		clients, err := s.getSubClients(inbound)
+		if err != nil {
+			logger.Error("SubService - GetClients: Unable to get clients from inbound")
+		}
+		if clients == nil {
+			continue
+		}
+		if len(inbound.Listen) > 0 && inbound.Listen[0] == '@' {
+			listen, port, streamSettings, err := s.getFallbackMaster(inbound.Listen, inbound.StreamSettings)
+			if err == nil {
+				inbound.Listen = listen
+				inbound.Port = port
+				inbound.StreamSettings = streamSettings
+			}
+		}
+		for _, client := range clients {
+			if client.SubID != subId {
+				continue
+			}
+			if !isAccountProtocol(inbound.Protocol) {
+				clientTraffics = append(clientTraffics, s.getClientTraffics(inbound.ClientStats, client.Email))
+			}
+			if !client.Enable {
+				continue
+			}
+			enabled = true
+			for _, link := range strings.Split(s.getLink(inbound, client.Email), "\n") {
+				if link != "" {
+					page.Links = append(page.Links, SubPageLink{Remark: inbound.Remark, Link: link})
+				}
+			}
+			if inbound.Protocol == model.WireGuard {
+				if config := s.genWireguardConfig(inbound, client.Email); config != "" {
+					page.Links = append(page.Links, SubPageLink{Remark: inbound.Remark + " (WireGuard)", Config: config})
+				}
+			}
+		}
+	}
+	if len(clientTraffics) == 0 && len(page.Links) == 0 {
+		return nil, common.NewError("No clients found with ", subId)
+	}
+
+	page.Traffic = sumTraffic(clientTraffics)
+	switch {
+	case enabled:
+		page.Status = subStatusActive
+	case page.Traffic.Total > 0 && page.Traffic.Up+page.Traffic.Down >= page.Traffic.Total:
+		page.Status = subStatusDepleted
+	case page.Traffic.ExpiryTime > 0 && page.Traffic.ExpiryTime <= time.Now().UnixMilli():
+		page.Status = subStatusExpired
+	default:
+		page.Status = subStatusDisabled
+	}
+	return page, nil
+}
+
+// genSubPageApps returns the buttons importing a subscription into the
+// popular client apps, each in the format it is best served in.
+func genSubPageApps(subURL string, title string) []SubPageApp {
+	withFormat := func(format string) string {
+		return subURL + "?format=" + format
+	}
+	name := url.PathEscape(title)
+	return []SubPageApp{
+		{Name: "v2rayNG", URL: template.URL("v2rayng://install-config?url=" + url.QueryEscape(subURL))},
+		{Name: "Hiddify", URL: template.URL("hiddify://import/" + subURL + "#" + name)},
+		{Name: "Streisand", URL: template.URL("streisand://import/" + subURL + "#" + name)},
+		{Name: "Shadowrocket", URL: template.URL("sub://" + base64.StdEncoding.EncodeToString([]byte(subURL)) + "#" + name)},
+		{Name: "Clash / Mihomo", URL: template.URL("clash://install-config?url=" + url.QueryEscape(withFormat(formatClash)))},
+		{Name: "sing-box", URL: template.URL("sing-box://import-remote-profile?url=" + url.QueryEscape(withFormat(formatSingbox)) + "#" + name)},
+	}
+}
+
+// newPageTemplate parses the landing page, translated through the localizer
+// of the request the page is rendered for.
+func newPageTemplate() *template.Template {
+	funcMap := template.FuncMap{
+		"i18n":          locale.Localize,
+		"formatTraffic": common.FormatTraffic,
+		"add":           func(a int64, b int64) int64 { return a + b },
+		"sub":           func(a int64, b int64) int64 { return a - b },
+		"formatTime": func(millis int64) string {
+			return time.UnixMilli(millis).Format("2006-01-02 15:04")
+		},
+		"percent": func(used int64, total int64) int64 {
+			if total <= 0 {
+				return 0
+			}
+			return min(used*100/total, 100)
+		},
+	}
+	return template.Must(template.New("page").Funcs(funcMap).Parse(pageHtml))
+}
+
+// loadQRCodeScript returns the QR code script of the panel. The page is
+// served on its own, so the script goes inline.
+func loadQRCodeScript() template.JS {
+	script, err := web.EmbeddedAssets().ReadFile("assets/qrcode/qrious2.min.js")
+	if err != nil {
+		logger.Warning("SUBController - unable to read the QR code script:", err)
+	}
+	return template.JS(script)
+}
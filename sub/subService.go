@@ -10,6 +10,7 @@ import (
 	"x-ui/database"
 	"x-ui/database/model"
 	"x-ui/logger"
+	"x-ui/singbox"
 	"x-ui/util/common"
 	"x-ui/util/random"
 	"x-ui/xray"
@@ -18,13 +19,15 @@ import (
 	"github.com/goccy/go-json"
 )
 
+// SubService generates the links of subscriptions. It is shared by the
+// requests, each generating with a copy of it for the host it was made to.
 type SubService struct {
-	address        string
-	showInfo       bool
-	remarkModel    string
-	datepicker     string
-	inboundService service.InboundService
-	settingService service.SettingService
+	address         string
+	showInfo        bool
+	remarkModel     string
+	inboundService  service.InboundService
+	settingService  service.SettingService
+	subTokenService service.SubTokenService
 }
 
 func NewSubService(showInfo bool, remarkModel string) *SubService {
@@ -34,11 +37,18 @@ func NewSubService(showInfo bool, remarkModel string) *SubService {
 	}
 }
 
+// forHost returns a copy of the service generating links to host, for
+// concurrent requests to different hosts not to share the address.
+func (s *SubService) forHost(host string) *SubService {
+	request := *s
+	request.address = host
+	return &request
+}
+
 func (s *SubService) GetSubs(subId string, host string) ([]string, string, error) {
-	s.address = host
+	s = s.forHost(host)
 	var result []string
 	var header string
-	var traffic xray.ClientTraffic
 	var clientTraffics []xray.ClientTraffic
 	inbounds, err := s.getInboundsBySubId(subId)
 	if err != nil {
@@ -49,12 +59,8 @@ func (s *SubService) GetSubs(subId string, host string) ([]string, string, error
 		return nil, "", common.NewError("No inbounds found with ", subId)
 	}
 
-	s.datepicker, err = s.settingService.GetDatepicker()
-	if err != nil {
-		s.datepicker = "gregorian"
-	}
 	for _, inbound := range inbounds {
-		clients, err := s.inboundService.GetClients(inbound)
+		clients, err := s.getSubClients(inbound)
 		if err != nil {
 			logger.Error("SubService - GetClients: Unable to get clients from inbound")
 		}
@@ -73,12 +79,28 @@ func (s *SubService) GetSubs(subId string, host string) ([]string, string, error
 			if client.Enable && client.SubID == subId {
 				link := s.getLink(inbound, client.Email)
 				result = append(result, link)
-				clientTraffics = append(clientTraffics, s.getClientTraffics(inbound.ClientStats, client.Email))
+				if !isAccountProtocol(inbound.Protocol) {
+					clientTraffics = append(clientTraffics, s.getClientTraffics(inbound.ClientStats, client.Email))
+				}
 			}
 		}
 	}
 
-	// Prepare statistics
+	header = genSubHeader(clientTraffics)
+	return result, header, nil
+}
+
+// genSubHeader sums up the traffic of the clients of a subscription into a
+// Subscription-Userinfo header.
+func genSubHeader(clientTraffics []xray.ClientTraffic) string {
+	traffic := sumTraffic(clientTraffics)
+	return fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", traffic.Up, traffic.Down, traffic.Total, traffic.ExpiryTime/1000)
+}
+
+// sumTraffic sums up the traffic of the clients of a subscription. The total
+// is unlimited if any client is, and so is the expiry unless all share it.
+func sumTraffic(clientTraffics []xray.ClientTraffic) xray.ClientTraffic {
+	var traffic xray.ClientTraffic
 	for index, clientTraffic := range clientTraffics {
 		if index == 0 {
 			traffic.Up = clientTraffic.Up
@@ -100,8 +122,13 @@ func (s *SubService) GetSubs(subId string, host string) ([]string, string, error
 			}
 		}
 	}
-	header = fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", traffic.Up, traffic.Down, traffic.Total, traffic.ExpiryTime/1000)
-	return result, header, nil
+	return traffic
+}
+
+// ResolveSubId returns the subId a subscription link stands for, be it the
+// subId itself, one of its tokens or a signed link.
+func (s *SubService) ResolveSubId(token string) (string, error) {
+	return s.subTokenService.Resolve(token)
 }
 
 func (s *SubService) getInboundsBySubId(subId string) ([]*model.Inbound, error) {
@@ -112,15 +139,41 @@ func (s *SubService) getInboundsBySubId(subId string) ([]*model.Inbound, error)
 		FROM inbounds,
 			JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client 
 		WHERE
-			protocol in ('vmess','vless','trojan','shadowsocks')
+			protocol in ('vmess','vless','trojan','shadowsocks','hysteria2','tuic')
 			AND JSON_EXTRACT(client.value, '$.subId') = ? AND enable = ?
-	)`, subId, true).Find(&inbounds).Error
+		UNION
+		SELECT DISTINCT inbounds.id
+		FROM inbounds,
+			JSON_EACH(COALESCE(JSON_EXTRACT(inbounds.settings, '$.accounts'), JSON_EXTRACT(inbounds.settings, '$.peers'))) AS account
+		WHERE
+			protocol in ('socks','http','wireguard')
+			AND JSON_EXTRACT(account.value, '$.subId') = ? AND enable = ?
+	)`, subId, true, subId, true).Find(&inbounds).Error
 	if err != nil {
 		return nil, err
 	}
 	return inbounds, nil
 }
 
+// GetSubTraffics returns the traffics of the enabled clients of a
+// subscription, as they are now.
+func (s *SubService) GetSubTraffics(subId string) ([]xray.ClientTraffic, error) {
+	db := database.GetDB()
+	var clientTraffics []xray.ClientTraffic
+	err := db.Model(xray.ClientTraffic{}).Where(`email in (
+		SELECT JSON_EXTRACT(client.value, '$.email')
+		FROM inbounds,
+			JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
+		WHERE
+			protocol in ('vmess','vless','trojan','shadowsocks','hysteria2','tuic')
+			AND JSON_EXTRACT(client.value, '$.subId') = ? AND JSON_EXTRACT(client.value, '$.enable') = ? AND enable = ?
+	)`, subId, true, true).Find(&clientTraffics).Error
+	if err != nil {
+		return nil, err
+	}
+	return clientTraffics, nil
+}
+
 func (s *SubService) getClientTraffics(traffics []xray.ClientTraffic, email string) xray.ClientTraffic {
 	for _, traffic := range traffics {
 		if traffic.Email == email {
@@ -163,6 +216,12 @@ func (s *SubService) getLink(inbound *model.Inbound, email string) string {
 		return s.genTrojanLink(inbound, email)
 	case "shadowsocks":
 		return s.genShadowsocksLink(inbound, email)
+	case "hysteria2", "tuic":
+		return s.genSingboxLink(inbound, email)
+	case "socks", "http":
+		return s.genAccountLink(inbound, email)
+	case "wireguard":
+		return s.genWireguardLink(inbound, email)
 	}
 	return ""
 }
@@ -859,6 +918,65 @@ func (s *SubService) genShadowsocksLink(inbound *model.Inbound, email string) st
 	return url.String()
 }
 
+// genSingboxLink generates hysteria2:// and tuic:// links for the inbounds
+// served by sing-box.
+func (s *SubService) genSingboxLink(inbound *model.Inbound, email string) string {
+	config, err := singbox.NewInbound(string(inbound.Protocol), inbound.Tag, inbound.Listen, inbound.Port, inbound.Settings, inbound.StreamSettings)
+	if err != nil {
+		logger.Warning("SubService - genSingboxLink:", err)
+		return ""
+	}
+	clients, _ := s.inboundService.GetClients(inbound)
+	clientIndex := -1
+	for i, client := range clients {
+		if client.Email == email {
+			clientIndex = i
+			break
+		}
+	}
+	if clientIndex < 0 {
+		return ""
+	}
+	client := clients[clientIndex]
+
+	params := make(map[string]string)
+	tls, _ := config["tls"].(map[string]any)
+	if sni, ok := tls["server_name"].(string); ok && sni != "" {
+		params["sni"] = sni
+	}
+	if alpns, ok := tls["alpn"].([]any); ok && len(alpns) > 0 {
+		var alpn []string
+		for _, a := range alpns {
+			alpn = append(alpn, fmt.Sprint(a))
+		}
+		params["alpn"] = strings.Join(alpn, ",")
+	}
+
+	var link string
+	switch inbound.Protocol {
+	case model.Hysteria2:
+		if obfs, ok := config["obfs"].(map[string]any); ok {
+			params["obfs"], _ = obfs["type"].(string)
+			params["obfs-password"], _ = obfs["password"].(string)
+		}
+		link = fmt.Sprintf("hysteria2://%s@%s:%d", url.PathEscape(client.Password), s.address, inbound.Port)
+	case model.TUIC:
+		if congestion, ok := config["congestion_control"].(string); ok {
+			params["congestion_control"] = congestion
+		}
+		link = fmt.Sprintf("tuic://%s:%s@%s:%d", client.ID, url.PathEscape(client.Password), s.address, inbound.Port)
+	}
+
+	url, _ := url.Parse(link)
+	q := url.Query()
+	for k, v := range params {
+		q.Add(k, v)
+	}
+	url.RawQuery = q.Encode()
+	url.Fragment = s.genRemark(inbound, email, "")
+	return url.String()
+}
+
 func (s *SubService) genRemark(inbound *model.Inbound, email string, extra string) string {
 	separationChar := string(s.remarkModel[0])
 	orderChars := s.remarkModel[1:]
@@ -0,0 +1,479 @@
+package sub
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/singbox"
+	"x-ui/util/random"
+	"x-ui/xray"
+)
+
+//go:embed singbox.json
+var defaultSingbox string
+
+const (
+	singboxProxyTag = "proxy"
+	singboxAutoTag  = "auto"
+)
+
+// SubSingboxService renders subscriptions as sing-box profiles.
+type SubSingboxService struct {
+	configJson map[string]any
+
+	SubService *SubService
+}
+
+// NewSubSingboxService takes the DNS section of the profiles and the route
+// rules added to the default ones, both in sing-box format, or "" to keep
+// those of the default profile.
+func NewSubSingboxService(dns string, rules string, subService *SubService) *SubSingboxService {
+	var configJson map[string]any
+	json.Unmarshal([]byte(defaultSingbox), &configJson)
+
+	if dns != "" {
+		var newDns map[string]any
+		if err := json.Unmarshal([]byte(dns), &newDns); err != nil {
+			logger.Warning("SubSingboxService - invalid DNS settings:", err)
+		} else {
+			configJson["dns"] = newDns
+		}
+	}
+
+	if rules != "" {
+		var newRules []any
+		if err := json.Unmarshal([]byte(rules), &newRules); err != nil {
+			logger.Warning("SubSingboxService - invalid route rules:", err)
+		} else {
+			route, _ := configJson["route"].(map[string]any)
+			defaultRules, _ := route["rules"].([]any)
+			// The rules go after sniffing and DNS hijacking, for them to
+			// match domains and leave DNS alone
+			i := 0
+			for i < len(defaultRules) {
+				if rule, _ := defaultRules[i].(map[string]any); rule["action"] == nil {
+					break
+				}
+				i++
+			}
+			rules := append([]any{}, defaultRules[:i]...)
+			rules = append(rules, newRules...)
+			route["rules"] = append(rules, defaultRules[i:]...)
+		}
+	}
+
+	return &SubSingboxService{
+		configJson: configJson,
+		SubService: subService,
+	}
+}
+
+func (s *SubSingboxService) GetSingbox(subId string, host string) (string, string, error) {
+	inbounds, err := s.SubService.getInboundsBySubId(subId)
+	if err != nil || len(inbounds) == 0 {
+		return "", "", err
+	}
+
+	var clientTraffics []xray.ClientTraffic
+	var outbounds []map[string]any
+	for _, inbound := range inbounds {
+		clients, err := s.SubService.getSubClients(inbound)
+		if err != nil {
+			logger.Error("SubSingboxService - GetClients: Unable to get clients from inbound")
+		}
+		if clients == nil {
+			continue
+		}
+		if len(inbound.Listen) > 0 && inbound.Listen[0] == '@' {
+			listen, port, streamSettings, err := s.SubService.getFallbackMaster(inbound.Listen, inbound.StreamSettings)
+			if err == nil {
+				inbound.Listen = listen
+				inbound.Port = port
+				inbound.StreamSettings = streamSettings
+			}
+		}
+
+		for _, client := range clients {
+			if client.Enable && client.SubID == subId {
+				if !isAccountProtocol(inbound.Protocol) {
+					clientTraffics = append(clientTraffics, s.SubService.getClientTraffics(inbound.ClientStats, client.Email))
+				}
+				outbounds = append(outbounds, s.getOutbounds(inbound, client, host)...)
+			}
+		}
+	}
+
+	if len(outbounds) == 0 {
+		return "", "", nil
+	}
+
+	profile, err := s.genProfile(outbounds)
+	if err != nil {
+		return "", "", err
+	}
+	return profile, genSubHeader(clientTraffics), nil
+}
+
+// genProfile puts the outbounds and their selectors into the default
+// profile, ahead of its own outbounds.
+func (s *SubSingboxService) genProfile(outbounds []map[string]any) (string, error) {
+	// Outbound tags must be unique
+	tags := make([]string, 0, len(outbounds))
+	seen := make(map[string]int)
+	for _, outbound := range outbounds {
+		tag := outbound["tag"].(string)
+		seen[tag]++
+		if seen[tag] > 1 {
+			tag = fmt.Sprintf("%s %d", tag, seen[tag])
+			outbound["tag"] = tag
+		}
+		tags = append(tags, tag)
+	}
+
+	profileOutbounds := []any{
+		map[string]any{
+			"type":      "selector",
+			"tag":       singboxProxyTag,
+			"outbounds": append([]string{singboxAutoTag}, tags...),
+			"default":   singboxAutoTag,
+		},
+		map[string]any{
+			"type":      "urltest",
+			"tag":       singboxAutoTag,
+			"outbounds": tags,
+			"url":       "https://www.gstatic.com/generate_204",
+			"interval":  "5m",
+			"tolerance": 50,
+		},
+	}
+	// WireGuard is an endpoint rather than an outbound since sing-box 1.11
+	var endpoints []any
+	for _, outbound := range outbounds {
+		if outbound["type"] == "wireguard" {
+			endpoints = append(endpoints, outbound)
+		} else {
+			profileOutbounds = append(profileOutbounds, outbound)
+		}
+	}
+	defaultOutbounds, _ := s.configJson["outbounds"].([]any)
+	profileOutbounds = append(profileOutbounds, defaultOutbounds...)
+
+	// The default profile is shared, copy it before setting the outbounds
+	profile := make(map[string]any, len(s.configJson))
+	for key, value := range s.configJson {
+		profile[key] = value
+	}
+	profile["outbounds"] = profileOutbounds
+	if len(endpoints) > 0 {
+		profile["endpoints"] = endpoints
+	}
+
+	finalJson, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(finalJson), nil
+}
+
+// getOutbounds returns the outbounds of a client on an inbound, one per
+// external proxy. Transports sing-box does not support are left out.
+func (s *SubSingboxService) getOutbounds(inbound *model.Inbound, client model.Client, host string) []map[string]any {
+	if singbox.IsProtocol(string(inbound.Protocol)) {
+		if outbound := s.genSingboxOutbound(inbound, client, host); outbound != nil {
+			return []map[string]any{outbound}
+		}
+		return nil
+	}
+	if inbound.Protocol == model.WireGuard {
+		return s.genWireguardEndpoints(inbound, client, host)
+	}
+
+	var stream map[string]any
+	json.Unmarshal([]byte(inbound.StreamSettings), &stream)
+
+	externalProxies, ok := stream["externalProxy"].([]any)
+	if !ok || len(externalProxies) == 0 {
+		externalProxies = []any{
+			map[string]any{
+				"forceTls": "same",
+				"dest":     host,
+				"port":     float64(inbound.Port),
+				"remark":   "",
+			},
+		}
+	}
+
+	var outbounds []map[string]any
+	for _, ep := range externalProxies {
+		extPrxy, _ := ep.(map[string]any)
+		dest, _ := extPrxy["dest"].(string)
+		port, _ := extPrxy["port"].(float64)
+		remark, _ := extPrxy["remark"].(string)
+		security, _ := stream["security"].(string)
+		switch extPrxy["forceTls"] {
+		case "tls":
+			security = "tls"
+		case "none":
+			security = "none"
+		}
+
+		outbound := map[string]any{
+			"tag":         s.SubService.genRemark(inbound, client.Email, remark),
+			"server":      dest,
+			"server_port": int(port),
+		}
+		switch inbound.Protocol {
+		case model.VMESS:
+			cipher := client.Security
+			if cipher == "" {
+				cipher = "auto"
+			}
+			outbound["type"] = "vmess"
+			outbound["uuid"] = client.ID
+			outbound["security"] = cipher
+			outbound["alter_id"] = 0
+		case model.VLESS:
+			outbound["type"] = "vless"
+			outbound["uuid"] = client.ID
+		case model.Trojan:
+			outbound["type"] = "trojan"
+			outbound["password"] = client.Password
+		case model.Shadowsocks:
+			var settings map[string]any
+			json.Unmarshal([]byte(inbound.Settings), &settings)
+			method, _ := settings["method"].(string)
+			password := client.Password
+			if strings.HasPrefix(method, "2022") {
+				if serverPassword, ok := settings["password"].(string); ok {
+					password = fmt.Sprintf("%s:%s", serverPassword, client.Password)
+				}
+			}
+			outbound["type"] = "shadowsocks"
+			outbound["method"] = method
+			outbound["password"] = password
+		case model.Socks:
+			outbound["type"] = "socks"
+			outbound["version"] = "5"
+			outbound["username"] = client.ID
+			outbound["password"] = client.Password
+		case model.HTTP:
+			outbound["type"] = "http"
+			outbound["username"] = client.ID
+			outbound["password"] = client.Password
+		default:
+			continue
+		}
+
+		if !s.applyStream(outbound, stream, security, client) {
+			logger.Debug("SubSingboxService - unsupported stream settings of inbound", inbound.Tag)
+			continue
+		}
+		outbounds = append(outbounds, outbound)
+	}
+	return outbounds
+}
+
+// genWireguardEndpoints returns the endpoints of a peer of a wireguard
+// inbound, one per external proxy.
+func (s *SubSingboxService) genWireguardEndpoints(inbound *model.Inbound, client model.Client, host string) []map[string]any {
+	settings, err := parseWireguard(inbound)
+	if err != nil {
+		logger.Warning("SubSingboxService - genWireguardEndpoints:", err)
+		return nil
+	}
+	peer, ok := wireguardPeerOf(settings, client.Email)
+	if !ok {
+		return nil
+	}
+
+	var endpoints []map[string]any
+	for _, endpoint := range accountEndpoints(inbound, host) {
+		serverPeer := map[string]any{
+			"address":     endpoint.Dest,
+			"port":        endpoint.Port,
+			"public_key":  settings.PublicKey,
+			"allowed_ips": []string{"0.0.0.0/0", "::/0"},
+		}
+		if peer.PreSharedKey != "" {
+			serverPeer["pre_shared_key"] = peer.PreSharedKey
+		}
+		if peer.KeepAlive > 0 {
+			serverPeer["persistent_keepalive_interval"] = peer.KeepAlive
+		}
+		wireguard := map[string]any{
+			"type":        "wireguard",
+			"tag":         s.SubService.genRemark(inbound, client.Email, endpoint.Remark),
+			"address":     peer.AllowedIPs,
+			"private_key": peer.PrivateKey,
+			"peers":       []any{serverPeer},
+		}
+		if settings.MTU > 0 {
+			wireguard["mtu"] = settings.MTU
+		}
+		endpoints = append(endpoints, wireguard)
+	}
+	return endpoints
+}
+
+// applyStream sets the transport and TLS of an outbound, telling whether
+// sing-box supports them.
+func (s *SubSingboxService) applyStream(outbound map[string]any, stream map[string]any, security string, client model.Client) bool {
+	network, _ := stream["network"].(string)
+	var transport map[string]any
+	switch network {
+	case "tcp", "":
+		tcp, _ := stream["tcpSettings"].(map[string]any)
+		header, _ := tcp["header"].(map[string]any)
+		// The http header obfuscation of xray has no sing-box counterpart
+		if headerType, _ := header["type"].(string); headerType == "http" {
+			return false
+		}
+		if outbound["type"] == "vless" && len(client.Flow) > 0 && (security == "tls" || security == "reality") {
+			outbound["flow"] = client.Flow
+		}
+	case "ws":
+		ws, _ := stream["wsSettings"].(map[string]any)
+		transport = map[string]any{"type": "ws"}
+		if path, ok := ws["path"].(string); ok {
+			transport["path"] = path
+		}
+		host, _ := ws["host"].(string)
+		if host == "" {
+			headers, _ := ws["headers"].(map[string]any)
+			host = searchHost(headers)
+		}
+		if host != "" {
+			transport["headers"] = map[string]any{"Host": host}
+		}
+	case "httpupgrade":
+		httpupgrade, _ := stream["httpupgradeSettings"].(map[string]any)
+		transport = map[string]any{"type": "httpupgrade"}
+		if path, ok := httpupgrade["path"].(string); ok {
+			transport["path"] = path
+		}
+		if host, _ := httpupgrade["host"].(string); host != "" {
+			transport["host"] = host
+		}
+	case "grpc":
+		grpc, _ := stream["grpcSettings"].(map[string]any)
+		serviceName, _ := grpc["serviceName"].(string)
+		transport = map[string]any{
+			"type":         "grpc",
+			"service_name": serviceName,
+		}
+	default:
+		return false
+	}
+
+	// Shadowsocks has no transports in sing-box
+	if outbound["type"] == "shadowsocks" && (transport != nil || (security != "none" && security != "")) {
+		return false
+	}
+	// nor do socks and http, of which only http goes over TLS
+	if outbound["type"] == "socks" && (transport != nil || (security != "none" && security != "")) {
+		return false
+	}
+	if outbound["type"] == "http" && (transport != nil || security == "reality") {
+		return false
+	}
+	if transport != nil {
+		outbound["transport"] = transport
+	}
+
+	switch security {
+	case "tls":
+		tlsSetting, _ := stream["tlsSettings"].(map[string]any)
+		tlsSettings, _ := tlsSetting["settings"].(map[string]any)
+		tls := map[string]any{"enabled": true}
+		if serverName, _ := tlsSetting["serverName"].(string); serverName != "" {
+			tls["server_name"] = serverName
+		}
+		if alpns, ok := tlsSetting["alpn"].([]any); ok && len(alpns) > 0 {
+			tls["alpn"] = alpns
+		}
+		if insecure, _ := tlsSettings["allowInsecure"].(bool); insecure {
+			tls["insecure"] = true
+		}
+		if fingerprint, _ := tlsSettings["fingerprint"].(string); fingerprint != "" {
+			tls["utls"] = map[string]any{
+				"enabled":     true,
+				"fingerprint": fingerprint,
+			}
+		}
+		outbound["tls"] = tls
+	case "reality":
+		realitySetting, _ := stream["realitySettings"].(map[string]any)
+		realitySettings, _ := realitySetting["settings"].(map[string]any)
+		tls := map[string]any{"enabled": true}
+		if serverNames, ok := realitySetting["serverNames"].([]any); ok && len(serverNames) > 0 {
+			tls["server_name"], _ = serverNames[random.Num(len(serverNames))].(string)
+		}
+		publicKey, _ := realitySettings["publicKey"].(string)
+		shortId := ""
+		if shortIds, ok := realitySetting["shortIds"].([]any); ok && len(shortIds) > 0 {
+			shortId, _ = shortIds[random.Num(len(shortIds))].(string)
+		}
+		tls["reality"] = map[string]any{
+			"enabled":    true,
+			"public_key": publicKey,
+			"short_id":   shortId,
+		}
+		// Reality needs uTLS in sing-box
+		fingerprint, _ := realitySettings["fingerprint"].(string)
+		if fingerprint == "" {
+			fingerprint = "chrome"
+		}
+		tls["utls"] = map[string]any{
+			"enabled":     true,
+			"fingerprint": fingerprint,
+		}
+		outbound["tls"] = tls
+	}
+	return true
+}
+
+// genSingboxOutbound returns the outbound of a client on a hysteria2 or tuic
+// inbound served by sing-box.
+func (s *SubSingboxService) genSingboxOutbound(inbound *model.Inbound, client model.Client, host string) map[string]any {
+	config, err := singbox.NewInbound(string(inbound.Protocol), inbound.Tag, inbound.Listen, inbound.Port, inbound.Settings, inbound.StreamSettings)
+	if err != nil {
+		logger.Warning("SubSingboxService - genSingboxOutbound:", err)
+		return nil
+	}
+
+	inboundTls, _ := config["tls"].(map[string]any)
+	tls := map[string]any{"enabled": true}
+	if serverName, _ := inboundTls["server_name"].(string); serverName != "" {
+		tls["server_name"] = serverName
+	}
+	if alpns, ok := inboundTls["alpn"].([]any); ok && len(alpns) > 0 {
+		tls["alpn"] = alpns
+	}
+
+	outbound := map[string]any{
+		"type":        string(inbound.Protocol),
+		"tag":         s.SubService.genRemark(inbound, client.Email, ""),
+		"server":      host,
+		"server_port": inbound.Port,
+		"password":    client.Password,
+		"tls":         tls,
+	}
+	switch inbound.Protocol {
+	case model.Hysteria2:
+		if obfs, ok := config["obfs"].(map[string]any); ok {
+			outbound["obfs"] = obfs
+		}
+	case model.TUIC:
+		outbound["uuid"] = client.ID
+		if congestionControl, ok := config["congestion_control"].(string); ok {
+			outbound["congestion_control"] = congestionControl
+		}
+	default:
+		return nil
+	}
+	return outbound
+}
@@ -0,0 +1,93 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/xtls/xray-core/app/router"
+	"google.golang.org/protobuf/proto"
+)
+
+type ipv4Range struct {
+	start, end uint32
+	country    uint16
+}
+
+type ipv6Range struct {
+	start, end [16]byte
+	country    uint16
+}
+
+// Dat looks up countries in an xray geoip.dat file. Only the entries named
+// after a country are used.
+type Dat struct {
+	countries []string
+	ipv4      []ipv4Range
+	ipv6      []ipv6Range
+}
+
+func OpenDat(data []byte) (*Dat, error) {
+	list := &router.GeoIPList{}
+	if err := proto.Unmarshal(data, list); err != nil {
+		return nil, err
+	}
+
+	dat := &Dat{}
+	for _, entry := range list.Entry {
+		if len(entry.CountryCode) != 2 || entry.ReverseMatch {
+			continue
+		}
+		country := uint16(len(dat.countries))
+		dat.countries = append(dat.countries, strings.ToUpper(entry.CountryCode))
+		for _, cidr := range entry.Cidr {
+			switch len(cidr.Ip) {
+			case net.IPv4len:
+				if cidr.Prefix > 32 {
+					continue
+				}
+				start := binary.BigEndian.Uint32(cidr.Ip) &^ (uint32(1<<(32-cidr.Prefix)) - 1)
+				end := start | (uint32(1<<(32-cidr.Prefix)) - 1)
+				dat.ipv4 = append(dat.ipv4, ipv4Range{start, end, country})
+			case net.IPv6len:
+				if cidr.Prefix > 128 {
+					continue
+				}
+				var r ipv6Range
+				mask := net.CIDRMask(int(cidr.Prefix), 128)
+				for i := 0; i < net.IPv6len; i++ {
+					r.start[i] = cidr.Ip[i] & mask[i]
+					r.end[i] = cidr.Ip[i] | ^mask[i]
+				}
+				r.country = country
+				dat.ipv6 = append(dat.ipv6, r)
+			}
+		}
+	}
+	sort.Slice(dat.ipv4, func(i, j int) bool { return dat.ipv4[i].start < dat.ipv4[j].start })
+	sort.Slice(dat.ipv6, func(i, j int) bool { return bytes.Compare(dat.ipv6[i].start[:], dat.ipv6[j].start[:]) < 0 })
+	return dat, nil
+}
+
+// Country returns the country code of an IP, or "" when it is unknown.
+func (dat *Dat) Country(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		v := binary.BigEndian.Uint32(ip4)
+		i := sort.Search(len(dat.ipv4), func(i int) bool { return dat.ipv4[i].start > v }) - 1
+		if i >= 0 && v <= dat.ipv4[i].end {
+			return dat.countries[dat.ipv4[i].country]
+		}
+		return ""
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return ""
+	}
+	i := sort.Search(len(dat.ipv6), func(i int) bool { return bytes.Compare(dat.ipv6[i].start[:], ip16) > 0 }) - 1
+	if i >= 0 && bytes.Compare(ip16, dat.ipv6[i].end[:]) <= 0 {
+		return dat.countries[dat.ipv6[i].country]
+	}
+	return ""
+}
@@ -0,0 +1,132 @@
+package geoip
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// reloadInterval is how often the files are checked for changes.
+const reloadInterval = time.Minute
+
+// Info is what is known about where an IP is.
+type Info struct {
+	Country string `json:"country"`
+	ASN     uint   `json:"asn"`
+	ASOrg   string `json:"asOrg"`
+}
+
+type mmdbFile struct {
+	path    string
+	modTime time.Time
+	db      *MMDB
+}
+
+// Reader looks IPs up in MaxMind DB files, falling back to a geoip.dat for
+// countries. Missing files are skipped and changed files are reloaded.
+type Reader struct {
+	lock      sync.Mutex
+	lastCheck time.Time
+
+	datPath    string
+	datModTime time.Time
+	dat        *Dat
+
+	mmdbs []*mmdbFile
+}
+
+func NewReader(datPath string, mmdbPaths ...string) *Reader {
+	r := &Reader{datPath: datPath}
+	for _, path := range mmdbPaths {
+		r.mmdbs = append(r.mmdbs, &mmdbFile{path: path})
+	}
+	return r
+}
+
+func (r *Reader) reload() {
+	if time.Since(r.lastCheck) < reloadInterval {
+		return
+	}
+	r.lastCheck = time.Now()
+
+	for _, file := range r.mmdbs {
+		stat, err := os.Stat(file.path)
+		if err != nil {
+			file.db = nil
+			continue
+		}
+		if stat.ModTime().Equal(file.modTime) {
+			continue
+		}
+		file.modTime = stat.ModTime()
+		data, err := os.ReadFile(file.path)
+		if err == nil {
+			file.db, err = OpenMMDB(data)
+		}
+		if err != nil {
+			file.db = nil
+		}
+	}
+
+	stat, err := os.Stat(r.datPath)
+	if err != nil {
+		r.dat = nil
+		return
+	}
+	if stat.ModTime().Equal(r.datModTime) {
+		return
+	}
+	r.datModTime = stat.ModTime()
+	data, err := os.ReadFile(r.datPath)
+	if err == nil {
+		r.dat, err = OpenDat(data)
+	}
+	if err != nil {
+		r.dat = nil
+	}
+}
+
+func (r *Reader) Lookup(address string) Info {
+	var info Info
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return info
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.reload()
+
+	for _, file := range r.mmdbs {
+		if file.db == nil {
+			continue
+		}
+		record, err := file.db.Lookup(ip)
+		if err != nil || record == nil {
+			continue
+		}
+		if info.Country == "" {
+			info.Country = recordCountry(record)
+		}
+		if info.ASN == 0 {
+			info.ASN = uint(toUint(record["autonomous_system_number"]))
+			info.ASOrg, _ = record["autonomous_system_organization"].(string)
+		}
+	}
+	if info.Country == "" && r.dat != nil {
+		info.Country = r.dat.Country(ip)
+	}
+	return info
+}
+
+func recordCountry(record map[string]any) string {
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := record[key].(map[string]any); ok {
+			if code, ok := country["iso_code"].(string); ok && code != "" {
+				return code
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,303 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+const (
+	// mmdbMaxDepth bounds the nesting of maps and arrays, which pointers
+	// could otherwise make endless.
+	mmdbMaxDepth = 512
+	// mmdbMaxValues bounds the values decoded at once, which pointers could
+	// otherwise multiply.
+	mmdbMaxValues = 1 << 20
+)
+
+// MMDB reads a MaxMind DB file, such as GeoLite2-Country or GeoLite2-ASN.
+type MMDB struct {
+	data         []byte
+	dataSection  []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	ipv4Start    uint
+	DatabaseType string
+}
+
+// OpenMMDB parses the metadata of a MaxMind DB held in memory.
+func OpenMMDB(data []byte) (*MMDB, error) {
+	index := bytes.LastIndex(data, mmdbMetadataMarker)
+	if index < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	d := &mmdbDecoder{buffer: data[index+len(mmdbMetadataMarker):]}
+	value, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MaxMind DB metadata: %w", err)
+	}
+	metadata, ok := value.(map[string]any)
+	if !ok {
+		return nil, errors.New("invalid MaxMind DB metadata")
+	}
+
+	db := &MMDB{data: data}
+	db.nodeCount = uint(toUint(metadata["node_count"]))
+	db.recordSize = uint(toUint(metadata["record_size"]))
+	db.ipVersion = uint(toUint(metadata["ip_version"]))
+	db.DatabaseType, _ = metadata["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported MaxMind DB record size %d", db.recordSize)
+	}
+
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(index) {
+		return nil, errors.New("invalid MaxMind DB search tree")
+	}
+	db.dataSection = data[treeSize+16 : index]
+
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.readRecord(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+func (db *MMDB) readRecord(node uint, bit uint) uint {
+	nodeBytes := db.recordSize / 4
+	b := db.data[node*nodeBytes : (node+1)*nodeBytes]
+	switch db.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b[0:4]))
+		}
+		return uint(binary.BigEndian.Uint32(b[4:8]))
+	}
+}
+
+// Lookup returns the record of an IP, or nil when the IP is not in the
+// database.
+func (db *MMDB) Lookup(ip net.IP) (map[string]any, error) {
+	bits := ip.To4()
+	node := uint(0)
+	if bits != nil && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if bits == nil {
+		if db.ipVersion == 4 {
+			return nil, nil
+		}
+		bits = ip.To16()
+	}
+	if bits == nil {
+		return nil, nil
+	}
+
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		bit := uint(bits[i/8]>>(7-uint(i%8))) & 1
+		node = db.readRecord(node, bit)
+	}
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+	offset := node - db.nodeCount - 16
+	if offset >= uint(len(db.dataSection)) {
+		return nil, errors.New("invalid MaxMind DB data pointer")
+	}
+	d := &mmdbDecoder{buffer: db.dataSection}
+	value, _, err := d.decode(offset)
+	if err != nil {
+		return nil, err
+	}
+	record, _ := value.(map[string]any)
+	return record, nil
+}
+
+type mmdbDecoder struct {
+	buffer []byte
+	values int
+}
+
+func (d *mmdbDecoder) byteAt(offset uint) (byte, error) {
+	if offset >= uint(len(d.buffer)) {
+		return 0, errors.New("unexpected end of MaxMind DB data")
+	}
+	return d.buffer[offset], nil
+}
+
+func (d *mmdbDecoder) bytes(offset uint, size uint) ([]byte, error) {
+	if offset+size > uint(len(d.buffer)) {
+		return nil, errors.New("unexpected end of MaxMind DB data")
+	}
+	return d.buffer[offset : offset+size], nil
+}
+
+// decode returns the value at offset and the offset following it.
+func (d *mmdbDecoder) decode(offset uint) (any, uint, error) {
+	d.values = 0
+	return d.decodeValue(offset, 0, true)
+}
+
+// decodeValue decodes a value nested depth maps and arrays deep. A pointer
+// may only point to a value that is not a pointer itself.
+func (d *mmdbDecoder) decodeValue(offset uint, depth int, followPointer bool) (any, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("MaxMind DB data is nested too deep")
+	}
+	d.values++
+	if d.values > mmdbMaxValues {
+		return nil, 0, errors.New("MaxMind DB data holds too many values")
+	}
+	ctrl, err := d.byteAt(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	dataType := uint(ctrl >> 5)
+
+	if dataType == 1 {
+		if !followPointer {
+			return nil, 0, errors.New("invalid MaxMind DB pointer to a pointer")
+		}
+		pointerSize := uint((ctrl >> 3) & 0x3)
+		b, err := d.bytes(offset, pointerSize+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var pointer uint
+		switch pointerSize {
+		case 0:
+			pointer = uint(ctrl&0x7)<<8 | uint(b[0])
+		case 1:
+			pointer = (uint(ctrl&0x7)<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			pointer = (uint(ctrl&0x7)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			pointer = uint(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := d.decodeValue(pointer, depth, false)
+		return value, offset + pointerSize + 1, err
+	}
+
+	if dataType == 0 {
+		extended, err := d.byteAt(offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		dataType = 7 + uint(extended)
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		default:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+
+	switch dataType {
+	case 2, 4:
+		b, err := d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if dataType == 2 {
+			return string(b), offset + size, nil
+		}
+		return append([]byte(nil), b...), offset + size, nil
+	case 3:
+		b, err := d.bytes(offset, 8)
+		if err != nil {
+			return nil, 0, err
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset + 8, nil
+	case 15:
+		b, err := d.bytes(offset, 4)
+		if err != nil {
+			return nil, 0, err
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset + 4, nil
+	case 5, 6, 8, 9, 10:
+		b, err := d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		var value uint64
+		for _, c := range b {
+			value = value<<8 | uint64(c)
+		}
+		if dataType == 8 {
+			return int32(value), offset + size, nil
+		}
+		return value, offset + size, nil
+	case 7:
+		m := make(map[string]any, min(size, uint(len(d.buffer))))
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decodeValue(offset, depth+1, true)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, next, err := d.decodeValue(next, depth+1, true)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyString, _ := key.(string)
+			m[keyString] = value
+			offset = next
+		}
+		return m, offset, nil
+	case 11:
+		a := make([]any, 0, min(size, uint(len(d.buffer))))
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decodeValue(offset, depth+1, true)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case 14:
+		return size != 0, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported MaxMind DB data type %d", dataType)
+}
+
+func toUint(value any) uint64 {
+	switch v := value.(type) {
+	case uint64:
+		return v
+	case int32:
+		return uint64(v)
+	}
+	return 0
+}
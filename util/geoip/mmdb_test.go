@@ -0,0 +1,130 @@
+package geoip
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+// mmdbString encodes a short UTF-8 string.
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+// mmdbMap encodes the header of a map of size pairs.
+func mmdbMap(size int) []byte {
+	return []byte{7<<5 | byte(size)}
+}
+
+// mmdbPointer encodes a pointer to an offset below 2048.
+func mmdbPointer(offset int) []byte {
+	return []byte{1<<5 | byte(offset>>8), byte(offset)}
+}
+
+// buildMMDB returns an IPv4 database of a single node, whose left record
+// points at the start of data and whose right one is empty.
+func buildMMDB(data []byte) []byte {
+	var db bytes.Buffer
+	db.Write([]byte{0, 0, 17, 0, 0, 1})
+	db.Write(make([]byte, 16))
+	db.Write(data)
+	db.Write(mmdbMetadataMarker)
+	db.Write(mmdbMap(4))
+	db.Write(mmdbString("node_count"))
+	db.Write([]byte{6<<5 | 1, 1})
+	db.Write(mmdbString("record_size"))
+	db.Write([]byte{5<<5 | 1, 24})
+	db.Write(mmdbString("ip_version"))
+	db.Write([]byte{5<<5 | 1, 4})
+	db.Write(mmdbString("database_type"))
+	db.Write(mmdbString("Test"))
+	return db.Bytes()
+}
+
+// buildPointerChain returns levels maps, each pointing twice at the next
+// one, so that decoding the first one would decode 2^levels values.
+func buildPointerChain(levels int) []byte {
+	const mapSize = 9
+	var data []byte
+	for level := 1; level <= levels; level++ {
+		data = append(data, mmdbMap(2)...)
+		data = append(data, mmdbString("a")...)
+		data = append(data, mmdbPointer(level*mapSize)...)
+		data = append(data, mmdbString("b")...)
+		data = append(data, mmdbPointer(level*mapSize)...)
+	}
+	return append(data, mmdbString("end")...)
+}
+
+func TestMMDBLookup(t *testing.T) {
+	var data []byte
+	data = append(data, mmdbMap(1)...)
+	data = append(data, mmdbString("country")...)
+	data = append(data, mmdbMap(1)...)
+	data = append(data, mmdbString("iso_code")...)
+	data = append(data, mmdbString("DE")...)
+
+	db, err := OpenMMDB(buildMMDB(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.DatabaseType != "Test" {
+		t.Errorf("database type = %q, want Test", db.DatabaseType)
+	}
+
+	record, err := db.Lookup(net.ParseIP("1.2.3.4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	country, _ := record["country"].(map[string]any)
+	if country["iso_code"] != "DE" {
+		t.Errorf("record = %v, want country DE", record)
+	}
+
+	record, err = db.Lookup(net.ParseIP("200.1.1.1"))
+	if err != nil || record != nil {
+		t.Errorf("Lookup of a missing IP = %v, %v, want nothing", record, err)
+	}
+}
+
+func TestMMDBMalformedData(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{
+			name: "map pointing back at itself",
+			data: append(append(mmdbMap(1), mmdbString("a")...), mmdbPointer(0)...),
+			want: "nested too deep",
+		},
+		{
+			name: "maps pointing twice at the next one",
+			data: buildPointerChain(30),
+			want: "too many values",
+		},
+		{
+			name: "pointer to a pointer",
+			data: append(mmdbPointer(2), mmdbPointer(0)...),
+			want: "pointer to a pointer",
+		},
+		{
+			name: "truncated string",
+			data: []byte{2<<5 | 10, 'a'},
+			want: "unexpected end",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			db, err := OpenMMDB(buildMMDB(test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = db.Lookup(net.ParseIP("1.2.3.4"))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("Lookup error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
@@ -7,6 +7,8 @@ const Protocols = {
     SOCKS: 'socks',
     HTTP: 'http',
     WIREGUARD: 'wireguard',
+    HYSTERIA2: 'hysteria2',
+    TUIC: 'tuic',
 };
 
 const SSMethods = {
@@ -111,6 +113,12 @@ const USERS_SECURITY = {
     ZERO: "zero",
 };
 
+const TUIC_CONGESTION_OPTION = {
+    CUBIC: "cubic",
+    NEW_RENO: "new_reno",
+    BBR: "bbr",
+};
+
 const MODE_OPTION = {
     AUTO: "auto",
     PACKET_UP: "packet-up",
@@ -1081,6 +1089,8 @@ class Inbound extends XrayCommonClass {
             case Protocols.VLESS: return this.settings.vlesses;
             case Protocols.TROJAN: return this.settings.trojans;
             case Protocols.SHADOWSOCKS: return this.isSSMultiUser ? this.settings.shadowsockses : null;
+            case Protocols.HYSTERIA2: return this.settings.hysterias;
+            case Protocols.TUIC: return this.settings.tuics;
             default: return null;
         }
     }
@@ -1095,6 +1105,14 @@ class Inbound extends XrayCommonClass {
         if (protocol === Protocols.TROJAN) {
             this.tls = false;
         }
+        if (this.isSingbox) {
+            this.stream.security = 'tls';
+        }
+    }
+
+    // hysteria2 and tuic are served by sing-box, over QUIC, which needs TLS
+    get isSingbox() {
+        return [Protocols.HYSTERIA2, Protocols.TUIC].includes(this.protocol);
     }
 
     get network() {
@@ -1204,6 +1222,7 @@ class Inbound extends XrayCommonClass {
     }
 
     canEnableTls() {
+        if (this.isSingbox) return true;
         if (![Protocols.VMESS, Protocols.VLESS, Protocols.TROJAN, Protocols.SHADOWSOCKS].includes(this.protocol)) return false;
         return ["tcp", "ws", "http", "grpc", "httpupgrade", "xhttp"].includes(this.network);
     }
@@ -1217,6 +1236,7 @@ class Inbound extends XrayCommonClass {
     }
 
     canEnableReality() {
+        if (this.isSingbox) return false;
         if (![Protocols.VLESS, Protocols.TROJAN].includes(this.protocol)) return false;
         return ["tcp", "http", "grpc", "xhttp"].includes(this.network);
     }
@@ -1574,6 +1594,40 @@ class Inbound extends XrayCommonClass {
         return url.toString();
     }
 
+    genSingboxLink(address = '', port = this.port, remark = '', client) {
+        const params = new Map();
+        if (this.stream.isTls) {
+            if (!ObjectUtil.isEmpty(this.stream.tls.sni)) {
+                params.set("sni", this.stream.tls.sni);
+            }
+            if (this.stream.tls.alpn.length > 0) {
+                params.set("alpn", this.stream.tls.alpn);
+            }
+        }
+
+        let link;
+        switch (this.protocol) {
+            case Protocols.HYSTERIA2:
+                if (!ObjectUtil.isEmpty(this.settings.obfsPassword)) {
+                    params.set("obfs", "salamander");
+                    params.set("obfs-password", this.settings.obfsPassword);
+                }
+                link = `hysteria2://${encodeURIComponent(client.password)}@${address}:${port}`;
+                break;
+            case Protocols.TUIC:
+                params.set("congestion_control", this.settings.congestionControl);
+                link = `tuic://${client.id}:${encodeURIComponent(client.password)}@${address}:${port}`;
+                break;
+            default: return '';
+        }
+        const url = new URL(link);
+        for (const [key, value] of params) {
+            url.searchParams.set(key, value)
+        }
+        url.hash = encodeURIComponent(remark);
+        return url.toString();
+    }
+
     getWireguardLink(address, port, remark, peerId) {
         let txt = `[Interface]\n`
         txt += `PrivateKey = ${this.settings.peers[peerId].privateKey}\n`
@@ -1606,6 +1660,9 @@ class Inbound extends XrayCommonClass {
                 return this.genSSLink(address, port, forceTls, remark, this.isSSMultiUser ? client.password : '');
             case Protocols.TROJAN:
                 return this.genTrojanLink(address, port, forceTls, remark, client.password);
+            case Protocols.HYSTERIA2:
+            case Protocols.TUIC:
+                return this.genSingboxLink(address, port, remark, client);
             default: return '';
         }
     }
@@ -1680,7 +1737,7 @@ class Inbound extends XrayCommonClass {
 
     toJson() {
         let streamSettings;
-        if (this.canEnableStream()) {
+        if (this.canEnableStream() || this.isSingbox) {
             streamSettings = this.stream.toJson();
         }
         return {
@@ -1713,6 +1770,8 @@ Inbound.Settings = class extends XrayCommonClass {
             case Protocols.SOCKS: return new Inbound.SocksSettings(protocol);
             case Protocols.HTTP: return new Inbound.HttpSettings(protocol);
             case Protocols.WIREGUARD: return new Inbound.WireguardSettings(protocol);
+            case Protocols.HYSTERIA2: return new Inbound.Hysteria2Settings(protocol);
+            case Protocols.TUIC: return new Inbound.TuicSettings(protocol);
             default: return null;
         }
     }
@@ -1727,6 +1786,8 @@ Inbound.Settings = class extends XrayCommonClass {
             case Protocols.SOCKS: return Inbound.SocksSettings.fromJson(json);
             case Protocols.HTTP: return Inbound.HttpSettings.fromJson(json);
             case Protocols.WIREGUARD: return Inbound.WireguardSettings.fromJson(json);
+            case Protocols.HYSTERIA2: return Inbound.Hysteria2Settings.fromJson(json);
+            case Protocols.TUIC: return Inbound.TuicSettings.fromJson(json);
             default: return null;
         }
     }
@@ -2349,14 +2410,23 @@ Inbound.SocksSettings = class extends Inbound.Settings {
     }
 };
 Inbound.SocksSettings.SocksAccount = class extends XrayCommonClass {
-    constructor(user = RandomUtil.randomSeq(10), pass = RandomUtil.randomSeq(10)) {
+    constructor(user = RandomUtil.randomSeq(10), pass = RandomUtil.randomSeq(10), subId = '') {
         super();
         this.user = user;
         this.pass = pass;
+        this.subId = subId;
     }
 
     static fromJson(json = {}) {
-        return new Inbound.SocksSettings.SocksAccount(json.user, json.pass);
+        return new Inbound.SocksSettings.SocksAccount(json.user, json.pass, json.subId);
+    }
+
+    toJson() {
+        return {
+            user: this.user,
+            pass: this.pass,
+            subId: this.subId ? this.subId : undefined,
+        };
     }
 };
 
@@ -2396,14 +2466,23 @@ Inbound.HttpSettings = class extends Inbound.Settings {
 };
 
 Inbound.HttpSettings.HttpAccount = class extends XrayCommonClass {
-    constructor(user = RandomUtil.randomSeq(10), pass = RandomUtil.randomSeq(10)) {
+    constructor(user = RandomUtil.randomSeq(10), pass = RandomUtil.randomSeq(10), subId = '') {
         super();
         this.user = user;
         this.pass = pass;
+        this.subId = subId;
     }
 
     static fromJson(json = {}) {
-        return new Inbound.HttpSettings.HttpAccount(json.user, json.pass);
+        return new Inbound.HttpSettings.HttpAccount(json.user, json.pass, json.subId);
+    }
+
+    toJson() {
+        return {
+            user: this.user,
+            pass: this.pass,
+            subId: this.subId ? this.subId : undefined,
+        };
     }
 };
 
@@ -2452,7 +2531,7 @@ Inbound.WireguardSettings = class extends XrayCommonClass {
 };
 
 Inbound.WireguardSettings.Peer = class extends XrayCommonClass {
-    constructor(privateKey, publicKey, psk = '', allowedIPs = ['10.0.0.2/32'], keepAlive = 0) {
+    constructor(privateKey, publicKey, psk = '', allowedIPs = ['10.0.0.2/32'], keepAlive = 0, subId = '') {
         super();
         this.privateKey = privateKey
         this.publicKey = publicKey;
@@ -2465,6 +2544,7 @@ Inbound.WireguardSettings.Peer = class extends XrayCommonClass {
         })
         this.allowedIPs = allowedIPs;
         this.keepAlive = keepAlive;
+        this.subId = subId;
     }
 
     static fromJson(json = {}) {
@@ -2473,7 +2553,8 @@ Inbound.WireguardSettings.Peer = class extends XrayCommonClass {
             json.publicKey,
             json.preSharedKey,
             json.allowedIPs,
-            json.keepAlive
+            json.keepAlive,
+            json.subId,
         );
     }
 
@@ -2487,6 +2568,184 @@ Inbound.WireguardSettings.Peer = class extends XrayCommonClass {
             preSharedKey: this.psk.length > 0 ? this.psk : undefined,
             allowedIPs: this.allowedIPs,
             keepAlive: this.keepAlive ?? undefined,
+            subId: this.subId ? this.subId : undefined,
+        };
+    }
+};
+
+Inbound.Hysteria2Settings = class extends Inbound.Settings {
+    constructor(protocol,
+        hysterias = [new Inbound.Hysteria2Settings.Hysteria2()],
+        upMbps = 0,
+        downMbps = 0,
+        ignoreClientBandwidth = false,
+        obfsPassword = '',
+        masquerade = '') {
+        super(protocol);
+        this.hysterias = hysterias;
+        this.upMbps = upMbps;
+        this.downMbps = downMbps;
+        this.ignoreClientBandwidth = ignoreClientBandwidth;
+        this.obfsPassword = obfsPassword;
+        this.masquerade = masquerade;
+    }
+
+    static fromJson(json = {}) {
+        return new Inbound.Hysteria2Settings(
+            Protocols.HYSTERIA2,
+            json.clients.map(client => Inbound.Hysteria2Settings.Hysteria2.fromJson(client)),
+            json.up_mbps,
+            json.down_mbps,
+            json.ignore_client_bandwidth,
+            json.obfs?.password,
+            json.masquerade,
+        );
+    }
+
+    toJson() {
+        return {
+            clients: Inbound.Hysteria2Settings.toJsonArray(this.hysterias),
+            up_mbps: this.upMbps > 0 ? this.upMbps : undefined,
+            down_mbps: this.downMbps > 0 ? this.downMbps : undefined,
+            ignore_client_bandwidth: this.ignoreClientBandwidth || undefined,
+            obfs: ObjectUtil.isEmpty(this.obfsPassword) ? undefined : {
+                type: 'salamander',
+                password: this.obfsPassword,
+            },
+            masquerade: ObjectUtil.isEmpty(this.masquerade) ? undefined : this.masquerade,
+        };
+    }
+};
+
+Inbound.Hysteria2Settings.Hysteria2 = class extends XrayCommonClass {
+    constructor(
+        id = RandomUtil.randomUUID(),
+        password = RandomUtil.randomSeq(16),
+        email = RandomUtil.randomLowerAndNum(8),
+        limitIp = 0,
+        totalGB = 0,
+        expiryTime = 0,
+        enable = true,
+        tgId = '',
+        subId = RandomUtil.randomLowerAndNum(16),
+        comment = '',
+        reset = 0
+    ) {
+        super();
+        this.id = id;
+        this.password = password;
+        this.email = email;
+        this.limitIp = limitIp;
+        this.totalGB = totalGB;
+        this.expiryTime = expiryTime;
+        this.enable = enable;
+        this.tgId = tgId;
+        this.subId = subId;
+        this.comment = comment;
+        this.reset = reset;
+    }
+
+    toJson() {
+        return {
+            id: this.id,
+            password: this.password,
+            email: this.email,
+            limitIp: this.limitIp,
+            totalGB: this.totalGB,
+            expiryTime: this.expiryTime,
+            enable: this.enable,
+            tgId: this.tgId,
+            subId: this.subId,
+            comment: this.comment,
+            reset: this.reset,
         };
     }
+
+    static fromJson(json = {}) {
+        return new Inbound.Hysteria2Settings.Hysteria2(
+            json.id,
+            json.password,
+            json.email,
+            json.limitIp,
+            json.totalGB,
+            json.expiryTime,
+            json.enable,
+            json.tgId,
+            json.subId,
+            json.comment,
+            json.reset,
+        );
+    }
+
+    get _expiryTime() {
+        if (this.expiryTime === 0 || this.expiryTime === "") {
+            return null;
+        }
+        if (this.expiryTime < 0) {
+            return this.expiryTime / -86400000;
+        }
+        return moment(this.expiryTime);
+    }
+
+    set _expiryTime(t) {
+        if (t == null || t === "") {
+            this.expiryTime = 0;
+        } else {
+            this.expiryTime = t.valueOf();
+        }
+    }
+    get _totalGB() {
+        return NumberFormatter.toFixed(this.totalGB / SizeFormatter.ONE_GB, 2);
+    }
+
+    set _totalGB(gb) {
+        this.totalGB = NumberFormatter.toFixed(gb * SizeFormatter.ONE_GB, 0);
+    }
+};
+
+Inbound.TuicSettings = class extends Inbound.Settings {
+    constructor(protocol,
+        tuics = [new Inbound.TuicSettings.Tuic()],
+        congestionControl = 'cubic',
+        zeroRttHandshake = false) {
+        super(protocol);
+        this.tuics = tuics;
+        this.congestionControl = congestionControl;
+        this.zeroRttHandshake = zeroRttHandshake;
+    }
+
+    static fromJson(json = {}) {
+        return new Inbound.TuicSettings(
+            Protocols.TUIC,
+            json.clients.map(client => Inbound.TuicSettings.Tuic.fromJson(client)),
+            json.congestion_control,
+            json.zero_rtt_handshake,
+        );
+    }
+
+    toJson() {
+        return {
+            clients: Inbound.TuicSettings.toJsonArray(this.tuics),
+            congestion_control: this.congestionControl,
+            zero_rtt_handshake: this.zeroRttHandshake,
+        };
+    }
+};
+
+Inbound.TuicSettings.Tuic = class extends Inbound.Hysteria2Settings.Hysteria2 {
+    static fromJson(json = {}) {
+        return new Inbound.TuicSettings.Tuic(
+            json.id,
+            json.password,
+            json.email,
+            json.limitIp,
+            json.totalGB,
+            json.expiryTime,
+            json.enable,
+            json.tgId,
+            json.subId,
+            json.comment,
+            json.reset,
+        );
+    }
 };
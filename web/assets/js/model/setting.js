@@ -33,6 +33,7 @@ class AllSetting {
         this.subPath = "/sub/";
         this.subJsonPath = "/json/";
         this.subDomain = "";
+        this.subTrustedProxies = "";
         this.externalTrafficInformEnable = false;
         this.externalTrafficInformURI = "";
         this.subCertFile = "";
@@ -46,6 +47,35 @@ class AllSetting {
         this.subJsonNoises = "";
         this.subJsonMux = "";
         this.subJsonRules = "";
+        this.subClashPath = "/clash/";
+        this.subClashURI = "";
+        this.subClashRules = "";
+        this.subSingboxPath = "/singbox/";
+        this.subSingboxURI = "";
+        this.subSingboxDns = "";
+        this.subSingboxRules = "";
+        this.subFormatRules = "";
+        this.analyticsEnable = false;
+        this.analyticsRetentionDays = 30;
+        this.analyticsAnonymize = false;
+        this.ipLimitMode = "fail2ban";
+        this.ipLimitBanMinutes = 30;
+        this.ipLimitWindowMinutes = 1;
+        this.abuseDetectEnable = false;
+        this.abuseBittorrent = true;
+        this.abuseBittorrentBlock = false;
+        this.abuseSmtp = true;
+        this.abuseScanThreshold = 300;
+        this.abuseUploadThreshold = 0;
+        this.abuseSuspend = false;
+        this.subAccessLog = true;
+        this.subAccessRetentionDays = 30;
+        this.subShareIpThreshold = 10;
+        this.subDeviceLimit = 0;
+        this.subDeviceRequireHwid = false;
+        this.subNodes = "";
+        this.subNodeSecret = "";
+        this.subNodeCacheMinutes = 5;
 
         this.timeLocation = "Local";
 
@@ -35,6 +35,8 @@ func (a *APIController) initRouter(g *gin.RouterGroup) {
 		{"POST", "/update/:id", a.inboundController.updateInbound},
 		{"POST", "/clientIps/:email", a.inboundController.getClientIps},
 		{"POST", "/clearClientIps/:email", a.inboundController.clearClientIps},
+		{"POST", "/clientSessions/:email", a.inboundController.getClientSessions},
+		{"POST", "/inactiveClients/:days", a.inboundController.getInactiveClients},
 		{"POST", "/addClient", a.inboundController.addInboundClient},
 		{"POST", "/:id/delClient/:clientId", a.inboundController.delInboundClient},
 		{"POST", "/updateClient/:clientId", a.inboundController.updateInboundClient},
@@ -42,6 +44,7 @@ func (a *APIController) initRouter(g *gin.RouterGroup) {
 		{"POST", "/resetAllTraffics", a.inboundController.resetAllTraffics},
 		{"POST", "/resetAllClientTraffics/:id", a.inboundController.resetAllClientTraffics},
 		{"POST", "/delDepletedClients/:id", a.inboundController.delDepletedClients},
+		{"POST", "/delInactiveClients/:id", a.inboundController.delInactiveClients},
 		{"POST", "/onlines", a.inboundController.onlines},
 	}
 
@@ -7,9 +7,11 @@ import (
 	"github.com/gin-gonic/gin"
 	"x-ui/database/model"
 	"x-ui/database"
+	"x-ui/web/service"
 )
 
 type BlockedDomainController struct {
+	service service.BlockedDomainService
 }
 
 func NewBlockedDomainController(g *gin.RouterGroup) *BlockedDomainController {
@@ -38,7 +40,11 @@ func (ctrl *BlockedDomainController) Create(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"success": false, "msg": err.Error()})
 		return
 	}
-	err := database.GetDB().Create(&domain).Error
+	if err := ctrl.service.Validate(&domain); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "msg": err.Error()})
+		return
+	}
+	err := ctrl.service.Create(&domain)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "msg": err.Error()})
 		return
@@ -58,7 +64,11 @@ func (ctrl *BlockedDomainController) Update(c *gin.Context) {
 		return
 	}
 	domain.Id = id
-	err = database.GetDB().Save(&domain).Error
+	if err := ctrl.service.Validate(&domain); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"success": false, "msg": err.Error()})
+		return
+	}
+	err = ctrl.service.Update(&domain)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "msg": err.Error()})
 		return
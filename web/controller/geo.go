@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"strconv"
+
+	"x-ui/database/model"
+	"x-ui/web/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type GeoController struct {
+	geoService service.GeoService
+}
+
+func NewGeoController(g *gin.RouterGroup) *GeoController {
+	a := &GeoController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *GeoController) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/geo")
+
+	g.POST("/list", a.getSources)
+	g.POST("/files", a.getGeofiles)
+	g.POST("/add", a.addSource)
+	g.POST("/update/:id", a.updateSource)
+	g.POST("/del/:id", a.delSource)
+	g.POST("/refresh/:id", a.refreshSource)
+}
+
+func (a *GeoController) getSources(c *gin.Context) {
+	sources, err := a.geoService.GetSources()
+	jsonObj(c, sources, err)
+}
+
+func (a *GeoController) getGeofiles(c *gin.Context) {
+	files, err := a.geoService.GetGeofiles()
+	jsonObj(c, files, err)
+}
+
+func (a *GeoController) addSource(c *gin.Context) {
+	source := &model.GeoSource{}
+	err := c.ShouldBind(source)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+		return
+	}
+	err = a.geoService.AddSource(source)
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), source, err)
+}
+
+func (a *GeoController) updateSource(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+		return
+	}
+	source := &model.GeoSource{}
+	err = c.ShouldBind(source)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+		return
+	}
+	source.Id = id
+	err = a.geoService.UpdateSource(source)
+	jsonMsgObj(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), source, err)
+}
+
+func (a *GeoController) delSource(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+		return
+	}
+	err = a.geoService.DelSource(id)
+	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+}
+
+func (a *GeoController) refreshSource(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.index.geofileUpdatePopover"), err)
+		return
+	}
+	err = a.geoService.RefreshSource(id)
+	jsonMsg(c, I18nWeb(c, "pages.index.geofileUpdatePopover"), err)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"x-ui/database/model"
 	"x-ui/web/session"
@@ -13,8 +14,15 @@ import (
 )
 
 type InboundController struct {
-	inboundService service.InboundService
-	xrayService    service.XrayService
+	inboundService   service.InboundService
+	xrayService      service.XrayService
+	analyticsService service.AnalyticsService
+	ipLimitService   service.IpLimitService
+	countryService   service.CountryPolicyService
+	abuseService     service.AbuseService
+	subAccessService service.SubAccessService
+	subTokenService  service.SubTokenService
+	subDeviceService service.SubDeviceService
 }
 
 func NewInboundController(g *gin.RouterGroup) *InboundController {
@@ -32,6 +40,27 @@ func (a *InboundController) initRouter(g *gin.RouterGroup) {
 	g.POST("/update/:id", a.updateInbound)
 	g.POST("/clientIps/:email", a.getClientIps)
 	g.POST("/clearClientIps/:email", a.clearClientIps)
+	g.POST("/clientIpHistory/:email", a.getClientIpHistory)
+	g.POST("/ipLimitBans", a.getIpLimitBans)
+	g.POST("/ipLimitUnban/:id", a.ipLimitUnban)
+	g.POST("/countryPolicies", a.getCountryPolicies)
+	g.POST("/addCountryPolicy", a.addCountryPolicy)
+	g.POST("/updateCountryPolicy/:id", a.updateCountryPolicy)
+	g.POST("/delCountryPolicy/:id", a.delCountryPolicy)
+	g.POST("/abuseEvents", a.getAbuseEvents)
+	g.POST("/delAbuseEvent/:id", a.delAbuseEvent)
+	g.POST("/abuseRelease/:email", a.abuseRelease)
+	g.POST("/subAccess/:subId", a.getSubAccess)
+	g.POST("/subTokens/:subId", a.getSubTokens)
+	g.POST("/currentSubTokens", a.getCurrentSubTokens)
+	g.POST("/rotateSubToken/:subId", a.rotateSubToken)
+	g.POST("/revokeSubToken/:subId", a.revokeSubToken)
+	g.POST("/signSubLink/:subId", a.signSubLink)
+	g.POST("/subDevices/:subId", a.getSubDevices)
+	g.POST("/unbindSubDevice/:subId", a.unbindSubDevice)
+	g.POST("/clientSessions/:email", a.getClientSessions)
+	g.POST("/clientAnalytics/:email", a.getClientAnalytics)
+	g.POST("/inactiveClients/:days", a.getInactiveClients)
 	g.POST("/addClient", a.addInboundClient)
 	g.POST("/:id/delClient/:clientId", a.delInboundClient)
 	g.POST("/updateClient/:clientId", a.updateInboundClient)
@@ -39,6 +68,7 @@ func (a *InboundController) initRouter(g *gin.RouterGroup) {
 	g.POST("/resetAllTraffics", a.resetAllTraffics)
 	g.POST("/resetAllClientTraffics/:id", a.resetAllClientTraffics)
 	g.POST("/delDepletedClients/:id", a.delDepletedClients)
+	g.POST("/delInactiveClients/:id", a.delInactiveClients)
 	g.POST("/import", a.importInbound)
 	g.POST("/onlines", a.onlines)
 }
@@ -170,6 +200,17 @@ func (a *InboundController) getClientIps(c *gin.Context) {
 	jsonObj(c, ips, nil)
 }
 
+func (a *InboundController) getClientIpHistory(c *gin.Context) {
+	email := c.Param("email")
+
+	histories, err := a.inboundService.GetClientIpHistory(email)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, histories, nil)
+}
+
 func (a *InboundController) clearClientIps(c *gin.Context) {
 	email := c.Param("email")
 
@@ -181,6 +222,201 @@ func (a *InboundController) clearClientIps(c *gin.Context) {
 	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.logCleanSuccess"), nil)
 }
 
+func (a *InboundController) getIpLimitBans(c *gin.Context) {
+	bans, err := a.ipLimitService.GetBans()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, bans, nil)
+}
+
+func (a *InboundController) ipLimitUnban(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	err = a.ipLimitService.Unban(id)
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+}
+
+func (a *InboundController) getCountryPolicies(c *gin.Context) {
+	policies, err := a.countryService.GetPolicies()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, policies, nil)
+}
+
+func (a *InboundController) addCountryPolicy(c *gin.Context) {
+	policy := &model.CountryPolicy{}
+	err := c.ShouldBind(policy)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	err = a.countryService.AddPolicy(policy)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), policy, err)
+}
+
+func (a *InboundController) updateCountryPolicy(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	policy := &model.CountryPolicy{}
+	err = c.ShouldBind(policy)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	policy.Id = id
+	err = a.countryService.UpdatePolicy(policy)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), policy, err)
+}
+
+func (a *InboundController) delCountryPolicy(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	err = a.countryService.DelPolicy(id)
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+}
+
+func (a *InboundController) getAbuseEvents(c *gin.Context) {
+	events, err := a.abuseService.GetEvents()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, events, nil)
+}
+
+func (a *InboundController) delAbuseEvent(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+		return
+	}
+	err = a.abuseService.DelEvent(id)
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+}
+
+func (a *InboundController) abuseRelease(c *gin.Context) {
+	email := c.Param("email")
+	err := a.abuseService.Release(email)
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+}
+
+func (a *InboundController) getClientSessions(c *gin.Context) {
+	email := c.Param("email")
+	limit, _ := strconv.Atoi(c.PostForm("limit"))
+
+	sessions, err := a.inboundService.GetClientSessions(email, limit)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, sessions, nil)
+}
+
+func (a *InboundController) getSubAccess(c *gin.Context) {
+	stats, err := a.subAccessService.GetStats(c.Param("subId"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, stats, nil)
+}
+
+func (a *InboundController) getSubTokens(c *gin.Context) {
+	tokens, err := a.subTokenService.GetTokens(c.Param("subId"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, tokens, nil)
+}
+
+// getCurrentSubTokens takes the subIds joined by commas.
+func (a *InboundController) getCurrentSubTokens(c *gin.Context) {
+	tokens, err := a.subTokenService.GetCurrentTokens(strings.Split(c.PostForm("subIds"), ","))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, tokens, nil)
+}
+
+func (a *InboundController) rotateSubToken(c *gin.Context) {
+	graceHours, _ := strconv.Atoi(c.PostForm("graceHours"))
+	token, err := a.subTokenService.Rotate(c.Param("subId"), graceHours)
+	jsonMsgObj(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), token, err)
+}
+
+func (a *InboundController) revokeSubToken(c *gin.Context) {
+	err := a.subTokenService.Revoke(c.Param("subId"), c.PostForm("token"))
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+}
+
+func (a *InboundController) signSubLink(c *gin.Context) {
+	days, _ := strconv.Atoi(c.PostForm("days"))
+	link, err := a.subTokenService.Sign(c.Param("subId"), days)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, link, nil)
+}
+
+func (a *InboundController) getSubDevices(c *gin.Context) {
+	devices, err := a.subDeviceService.GetDevices(c.Param("subId"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, devices, nil)
+}
+
+func (a *InboundController) unbindSubDevice(c *gin.Context) {
+	id, _ := strconv.Atoi(c.PostForm("id"))
+	err := a.subDeviceService.Unbind(c.Param("subId"), id)
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.updateSuccess"), err)
+}
+
+func (a *InboundController) getClientAnalytics(c *gin.Context) {
+	email := c.Param("email")
+	days, _ := strconv.Atoi(c.PostForm("days"))
+	count, _ := strconv.Atoi(c.PostForm("count"))
+
+	analytics, err := a.analyticsService.GetClientAnalytics(email, days, count)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, analytics, nil)
+}
+
+func (a *InboundController) getInactiveClients(c *gin.Context) {
+	days, err := strconv.Atoi(c.Param("days"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+
+	traffics, err := a.inboundService.GetInactiveClients(days)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.obtain"), err)
+		return
+	}
+	jsonObj(c, traffics, nil)
+}
+
 func (a *InboundController) addInboundClient(c *gin.Context) {
 	data := &model.Inbound{}
 	err := c.ShouldBind(data)
@@ -336,6 +572,28 @@ func (a *InboundController) delDepletedClients(c *gin.Context) {
 	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.delDepletedClientsSuccess"), nil)
 }
 
+func (a *InboundController) delInactiveClients(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.inboundUpdateSuccess"), err)
+		return
+	}
+	days, err := strconv.Atoi(c.PostForm("days"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	needRestart, err := a.inboundService.DelInactiveClients(id, days)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "somethingWentWrong"), err)
+		return
+	}
+	jsonMsg(c, I18nWeb(c, "pages.inbounds.toasts.delInactiveClientsSuccess"), nil)
+	if needRestart {
+		a.xrayService.SetToNeedRestart()
+	}
+}
+
 func (a *InboundController) onlines(c *gin.Context) {
 	jsonObj(c, a.inboundService.GetOnlineClients(), nil)
 }
@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"strconv"
+
+	"x-ui/web/job"
+
+	"github.com/gin-gonic/gin"
+)
+
+type JobController struct{}
+
+func NewJobController(g *gin.RouterGroup) *JobController {
+	a := &JobController{}
+	a.initRouter(g)
+	return a
+}
+
+func (a *JobController) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/job")
+
+	g.POST("/list", a.getJobs)
+	g.POST("/update/:name", a.updateJob)
+	g.POST("/run/:name", a.runJob)
+}
+
+func (a *JobController) getJobs(c *gin.Context) {
+	jsonObj(c, job.GetRegistry().List(), nil)
+}
+
+func (a *JobController) updateJob(c *gin.Context) {
+	name := c.Param("name")
+	enable, err := strconv.ParseBool(c.PostForm("enable"))
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+		return
+	}
+	spec := c.PostForm("spec")
+	err = job.GetRegistry().Update(name, enable, spec)
+	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.modifySettings"), err)
+}
+
+func (a *JobController) runJob(c *gin.Context) {
+	name := c.Param("name")
+	err := job.GetRegistry().RunNow(name)
+	jsonMsg(c, I18nWeb(c, "pages.settings.toasts.runJob"), err)
+}
@@ -17,7 +17,8 @@ var filenameRegex = regexp.MustCompile(`^[a-zA-Z0-9_\-.]+$`)
 type ServerController struct {
 	BaseController
 
-	serverService service.ServerService
+	serverService    service.ServerService
+	accessLogService service.AccessLogService
 
 	lastStatus        *service.Status
 	lastGetStatusTime time.Time
@@ -44,8 +45,11 @@ func (a *ServerController) initRouter(g *gin.RouterGroup) {
 	g.POST("/stopXrayService", a.stopXrayService)
 	g.POST("/restartXrayService", a.restartXrayService)
 	g.POST("/installXray/:version", a.installXray)
+	g.POST("/installedXrayVersions", a.getInstalledXrayVersions)
+	g.POST("/rollbackXray", a.rollbackXray)
 	g.POST("/updateGeofile/:fileName", a.updateGeofile)
 	g.POST("/logs/:count", a.getLogs)
+	g.POST("/accessLog", a.searchAccessLog)
 	g.POST("/getConfigJson", a.getConfigJson)
 	g.GET("/getDb", a.getDb)
 	g.POST("/importDB", a.importDB)
@@ -99,6 +103,20 @@ func (a *ServerController) installXray(c *gin.Context) {
 	jsonMsg(c, I18nWeb(c, "pages.index.xraySwitchVersionPopover"), err)
 }
 
+func (a *ServerController) getInstalledXrayVersions(c *gin.Context) {
+	versions, err := a.serverService.GetInstalledXrayVersions()
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "getVersion"), err)
+		return
+	}
+	jsonObj(c, versions, nil)
+}
+
+func (a *ServerController) rollbackXray(c *gin.Context) {
+	err := a.serverService.RollbackXray()
+	jsonMsg(c, I18nWeb(c, "pages.index.xraySwitchVersionPopover"), err)
+}
+
 func (a *ServerController) updateGeofile(c *gin.Context) {
 	fileName := c.Param("fileName")
 	err := a.serverService.UpdateGeofile(fileName)
@@ -132,6 +150,16 @@ func (a *ServerController) getLogs(c *gin.Context) {
 	jsonObj(c, logs, nil)
 }
 
+func (a *ServerController) searchAccessLog(c *gin.Context) {
+	query := &service.AccessLogQuery{}
+	err := c.ShouldBind(query)
+	if err != nil {
+		jsonMsg(c, I18nWeb(c, "get"), err)
+		return
+	}
+	jsonObj(c, a.accessLogService.Search(query), nil)
+}
+
 func (a *ServerController) getConfigJson(c *gin.Context) {
 	configJson, err := a.serverService.GetConfigJson()
 	if err != nil {
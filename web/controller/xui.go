@@ -10,6 +10,8 @@ type XUIController struct {
 	inboundController     *InboundController
 	settingController     *SettingController
 	xraySettingController *XraySettingController
+	jobController         *JobController
+	geoController         *GeoController
 }
 
 func NewXUIController(g *gin.RouterGroup) *XUIController {
@@ -31,6 +33,8 @@ func (a *XUIController) initRouter(g *gin.RouterGroup) {
 	a.inboundController = NewInboundController(g)
 	a.settingController = NewSettingController(g)
 	a.xraySettingController = NewXraySettingController(g)
+	a.jobController = NewJobController(g)
+	a.geoController = NewGeoController(g)
 }
 
 func (a *XUIController) index(c *gin.Context) {
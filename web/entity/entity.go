@@ -2,7 +2,9 @@ package entity
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"net"
+	"regexp"
 	"strings"
 	"time"
 	"math"
@@ -47,6 +49,7 @@ type AllSetting struct {
 	SubPort                     int    `json:"subPort" form:"subPort"`
 	SubPath                     string `json:"subPath" form:"subPath"`
 	SubDomain                   string `json:"subDomain" form:"subDomain"`
+	SubTrustedProxies           string `json:"subTrustedProxies" form:"subTrustedProxies"`
 	SubCertFile                 string `json:"subCertFile" form:"subCertFile"`
 	SubKeyFile                  string `json:"subKeyFile" form:"subKeyFile"`
 	SubUpdates                  int    `json:"subUpdates" form:"subUpdates"`
@@ -61,7 +64,36 @@ type AllSetting struct {
 	SubJsonNoises               string `json:"subJsonNoises" form:"subJsonNoises"`
 	SubJsonMux                  string `json:"subJsonMux" form:"subJsonMux"`
 	SubJsonRules                string `json:"subJsonRules" form:"subJsonRules"`
+	SubClashPath                string `json:"subClashPath" form:"subClashPath"`
+	SubClashURI                 string `json:"subClashURI" form:"subClashURI"`
+	SubClashRules               string `json:"subClashRules" form:"subClashRules"`
+	SubSingboxPath              string `json:"subSingboxPath" form:"subSingboxPath"`
+	SubSingboxURI               string `json:"subSingboxURI" form:"subSingboxURI"`
+	SubSingboxDns               string `json:"subSingboxDns" form:"subSingboxDns"`
+	SubSingboxRules             string `json:"subSingboxRules" form:"subSingboxRules"`
+	SubFormatRules              string `json:"subFormatRules" form:"subFormatRules"`
 	Datepicker                  string `json:"datepicker" form:"datepicker"`
+	AnalyticsEnable             bool   `json:"analyticsEnable" form:"analyticsEnable"`
+	AnalyticsRetentionDays      int    `json:"analyticsRetentionDays" form:"analyticsRetentionDays"`
+	AnalyticsAnonymize          bool   `json:"analyticsAnonymize" form:"analyticsAnonymize"`
+	IpLimitMode                 string `json:"ipLimitMode" form:"ipLimitMode"`
+	IpLimitBanMinutes           int    `json:"ipLimitBanMinutes" form:"ipLimitBanMinutes"`
+	IpLimitWindowMinutes        int    `json:"ipLimitWindowMinutes" form:"ipLimitWindowMinutes"`
+	AbuseDetectEnable           bool   `json:"abuseDetectEnable" form:"abuseDetectEnable"`
+	AbuseBittorrent             bool   `json:"abuseBittorrent" form:"abuseBittorrent"`
+	AbuseBittorrentBlock        bool   `json:"abuseBittorrentBlock" form:"abuseBittorrentBlock"`
+	AbuseSmtp                   bool   `json:"abuseSmtp" form:"abuseSmtp"`
+	AbuseScanThreshold          int    `json:"abuseScanThreshold" form:"abuseScanThreshold"`
+	AbuseUploadThreshold        int    `json:"abuseUploadThreshold" form:"abuseUploadThreshold"`
+	AbuseSuspend                bool   `json:"abuseSuspend" form:"abuseSuspend"`
+	SubAccessLog                bool   `json:"subAccessLog" form:"subAccessLog"`
+	SubAccessRetentionDays      int    `json:"subAccessRetentionDays" form:"subAccessRetentionDays"`
+	SubShareIpThreshold         int    `json:"subShareIpThreshold" form:"subShareIpThreshold"`
+	SubDeviceLimit              int    `json:"subDeviceLimit" form:"subDeviceLimit"`
+	SubDeviceRequireHwid        bool   `json:"subDeviceRequireHwid" form:"subDeviceRequireHwid"`
+	SubNodes                    string `json:"subNodes" form:"subNodes"`
+	SubNodeSecret               string `json:"subNodeSecret" form:"subNodeSecret"`
+	SubNodeCacheMinutes         int    `json:"subNodeCacheMinutes" form:"subNodeCacheMinutes"`
 }
 
 func (s *AllSetting) CheckValid() error {
@@ -83,6 +115,16 @@ func (s *AllSetting) CheckValid() error {
 		return common.NewError("web port is not a valid port:", s.WebPort)
 	}
 
+	for _, proxy := range strings.Split(s.SubTrustedProxies, ",") {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" || net.ParseIP(proxy) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(proxy); err != nil {
+			return common.NewError("Sub trusted proxy is not valid ip or cidr:", proxy)
+		}
+	}
+
 	if s.SubPort <= 0 || s.SubPort > math.MaxUint16 {
 		return common.NewError("Sub port is not a valid port:", s.SubPort)
 	}
@@ -125,6 +167,115 @@ func (s *AllSetting) CheckValid() error {
 		s.SubJsonPath += "/"
 	}
 
+	if !strings.HasPrefix(s.SubClashPath, "/") {
+		s.SubClashPath = "/" + s.SubClashPath
+	}
+	if !strings.HasSuffix(s.SubClashPath, "/") {
+		s.SubClashPath += "/"
+	}
+	if s.SubClashPath == s.SubPath || s.SubClashPath == s.SubJsonPath {
+		return common.NewError("Clash subscription path could not be the same as the other subscription paths:", s.SubClashPath)
+	}
+
+	if !strings.HasPrefix(s.SubSingboxPath, "/") {
+		s.SubSingboxPath = "/" + s.SubSingboxPath
+	}
+	if !strings.HasSuffix(s.SubSingboxPath, "/") {
+		s.SubSingboxPath += "/"
+	}
+	if s.SubSingboxPath == s.SubPath || s.SubSingboxPath == s.SubJsonPath || s.SubSingboxPath == s.SubClashPath {
+		return common.NewError("sing-box subscription path could not be the same as the other subscription paths:", s.SubSingboxPath)
+	}
+	if s.SubSingboxDns != "" && !json.Valid([]byte(s.SubSingboxDns)) {
+		return common.NewError("sing-box DNS settings are not valid JSON")
+	}
+	if s.SubSingboxRules != "" && !json.Valid([]byte(s.SubSingboxRules)) {
+		return common.NewError("sing-box route rules are not valid JSON")
+	}
+	if s.SubFormatRules != "" {
+		var formatRules []struct {
+			UserAgent string `json:"userAgent"`
+			Format    string `json:"format"`
+		}
+		if err := json.Unmarshal([]byte(s.SubFormatRules), &formatRules); err != nil {
+			return common.NewError("subscription format rules are not valid:", err)
+		}
+		for _, rule := range formatRules {
+			if _, err := regexp.Compile(rule.UserAgent); err != nil {
+				return common.NewError("subscription format rule is not valid:", err)
+			}
+			switch rule.Format {
+			case "links", "json", "clash", "singbox", "page":
+			default:
+				return common.NewError("subscription format is not valid:", rule.Format)
+			}
+		}
+	}
+
+	if s.AnalyticsRetentionDays <= 0 {
+		return common.NewError("analytics retention days is not valid:", s.AnalyticsRetentionDays)
+	}
+
+	switch s.IpLimitMode {
+	case "fail2ban", "removeUser", "routing", "nftables":
+	default:
+		return common.NewError("ip limit mode is not valid:", s.IpLimitMode)
+	}
+
+	if s.IpLimitBanMinutes <= 0 {
+		return common.NewError("ip limit ban minutes is not valid:", s.IpLimitBanMinutes)
+	}
+
+	if s.IpLimitWindowMinutes <= 0 {
+		return common.NewError("ip limit window minutes is not valid:", s.IpLimitWindowMinutes)
+	}
+
+	if s.AbuseScanThreshold < 0 {
+		return common.NewError("abuse scan threshold is not valid:", s.AbuseScanThreshold)
+	}
+
+	if s.AbuseUploadThreshold < 0 {
+		return common.NewError("abuse upload threshold is not valid:", s.AbuseUploadThreshold)
+	}
+
+	if s.SubAccessRetentionDays <= 0 {
+		return common.NewError("subscription access retention days is not valid:", s.SubAccessRetentionDays)
+	}
+
+	if s.SubShareIpThreshold < 0 {
+		return common.NewError("subscription sharing IP threshold is not valid:", s.SubShareIpThreshold)
+	}
+
+	if s.SubDeviceLimit < 0 {
+		return common.NewError("subscription device limit is not valid:", s.SubDeviceLimit)
+	}
+	if s.SubNodes != "" {
+		var nodes []struct {
+			Name    string `json:"name"`
+			URL     string `json:"url"`
+			Timeout int    `json:"timeout"`
+		}
+		if err := json.Unmarshal([]byte(s.SubNodes), &nodes); err != nil {
+			return common.NewError("subscription nodes are not valid:", err)
+		}
+		for _, node := range nodes {
+			if !strings.HasPrefix(node.URL, "http://") && !strings.HasPrefix(node.URL, "https://") {
+				return common.NewError("subscription node URL is not valid:", node.URL)
+			}
+			if node.Timeout < 0 {
+				return common.NewError("subscription node timeout is not valid:", node.Timeout)
+			}
+		}
+		// Without the secret the nodes would take each other for apps and
+		// merge in turn, fetching one another over and over
+		if len(nodes) > 0 && s.SubNodeSecret == "" {
+			return common.NewError("subscription node secret is required with nodes")
+		}
+	}
+	if s.SubNodeCacheMinutes < 0 {
+		return common.NewError("subscription node cache is not valid:", s.SubNodeCacheMinutes)
+	}
+
 	_, err := time.LoadLocation(s.TimeLocation)
 	if err != nil {
 		return common.NewError("time location not exist:", s.TimeLocation)
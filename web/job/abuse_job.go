@@ -0,0 +1,29 @@
+package job
+
+import (
+	"x-ui/web/service"
+)
+
+type AbuseJob struct {
+	abuseService service.AbuseService
+	accessLog    *service.RegisteredAccessLogConsumer
+}
+
+func NewAbuseJob() *AbuseJob {
+	j := new(AbuseJob)
+	j.accessLog = service.RegisterAccessLogConsumer("abuse", j.abuseService.Collect)
+	return j
+}
+
+// Run checks what the clients did since the last run against the abuse rules.
+func (j *AbuseJob) Run() {
+	j.RunWithError()
+}
+
+func (j *AbuseJob) PauseAccessLog(pause bool) {
+	j.accessLog.Pause(pause)
+}
+
+func (j *AbuseJob) RunWithError() error {
+	return j.abuseService.Check()
+}
@@ -0,0 +1,26 @@
+package job
+
+import (
+	"x-ui/util/common"
+	"x-ui/web/service"
+)
+
+type AccessLogJob struct {
+	accessLogService service.AccessLogService
+}
+
+func NewAccessLogJob() *AccessLogJob {
+	return new(AccessLogJob)
+}
+
+// Run hands the new access log lines to the access log consumers.
+func (j *AccessLogJob) Run() {
+	j.RunWithError()
+}
+
+func (j *AccessLogJob) RunWithError() error {
+	if err := j.accessLogService.Ingest(); err != nil {
+		return common.NewErrorf("ingest access log failed: %v", err)
+	}
+	return nil
+}
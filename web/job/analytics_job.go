@@ -0,0 +1,37 @@
+package job
+
+import (
+	"x-ui/util/common"
+	"x-ui/web/service"
+)
+
+type AnalyticsJob struct {
+	analyticsService service.AnalyticsService
+	accessLog        *service.RegisteredAccessLogConsumer
+}
+
+func NewAnalyticsJob() *AnalyticsJob {
+	j := new(AnalyticsJob)
+	j.accessLog = service.RegisterAccessLogConsumer("clientAnalytics", j.analyticsService.Collect)
+	return j
+}
+
+// Run writes the collected destination counts and drops the expired ones.
+func (j *AnalyticsJob) Run() {
+	j.RunWithError()
+}
+
+func (j *AnalyticsJob) PauseAccessLog(pause bool) {
+	j.accessLog.Pause(pause)
+}
+
+func (j *AnalyticsJob) RunWithError() error {
+	var flushErr, pruneErr error
+	if err := j.analyticsService.Flush(); err != nil {
+		flushErr = common.NewErrorf("save client analytics failed: %v", err)
+	}
+	if err := j.analyticsService.Prune(); err != nil {
+		pruneErr = common.NewErrorf("prune client analytics failed: %v", err)
+	}
+	return common.Combine(flushErr, pruneErr)
+}
@@ -1,79 +1,197 @@
 package job
 
 import (
-	"bufio"
 	"encoding/json"
-	"io"
 	"log"
 	"os"
 	"os/exec"
-	"regexp"
 	"sort"
+	"sync"
 	"time"
 
 	"slices"
 	"x-ui/database"
 	"x-ui/database/model"
 	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/service"
 	"x-ui/xray"
 )
 
+// clientIpHistoryRetention is how long IPs not seen anymore are remembered.
+const clientIpHistoryRetention = 30 * 24 * time.Hour
+
 type CheckClientIpJob struct {
-	lastClear     int64
-	disAllowedIps []string
+	disAllowedIps  []string
+	lastPrune      time.Time
+	inboundService service.InboundService
+	settingService service.SettingService
+	ipLimitService service.IpLimitService
+	countryService service.CountryPolicyService
+	tgbotService   service.Tgbot
+
+	clientIpsLock sync.Mutex
+	clientIps     map[string]map[string]int64
+	accessLog     *service.RegisteredAccessLogConsumer
 }
 
 var job *CheckClientIpJob
 
 func NewCheckClientIpJob() *CheckClientIpJob {
 	job = new(CheckClientIpJob)
+	job.clientIps = make(map[string]map[string]int64, 100)
+	job.accessLog = service.RegisterAccessLogConsumer("checkClientIp", job.collectClientIps)
 	return job
 }
 
 func (j *CheckClientIpJob) Run() {
-	if j.lastClear == 0 {
-		j.lastClear = time.Now().Unix()
+	j.RunWithError()
+}
+
+func (j *CheckClientIpJob) PauseAccessLog(pause bool) {
+	j.accessLog.Pause(pause)
+}
+
+func (j *CheckClientIpJob) RunWithError() error {
+	var errs []error
+	if err := j.ipLimitService.UnbanExpired(); err != nil {
+		errs = append(errs, common.NewErrorf("lift expired bans failed: %v", err))
+	}
+
+	clientIps := j.takeClientIps()
+	onlineClientIps := j.inboundService.GetOnlineClientIps()
+	j.addOnlineClientIps(clientIps, onlineClientIps)
+	j.checkCountryPolicies(clientIps)
+	if err := j.inboundService.UpdateClientIpHistory(clientIps); err != nil {
+		errs = append(errs, common.NewErrorf("save client IP history failed: %v", err))
+	}
+	if time.Since(j.lastPrune) > time.Hour {
+		j.lastPrune = time.Now()
+		if err := j.inboundService.DelOldClientIpHistory(time.Now().Add(-clientIpHistoryRetention).UnixMilli()); err != nil {
+			errs = append(errs, common.NewErrorf("prune client IP history failed: %v", err))
+		}
 	}
 
-	shouldClearAccessLog := false
 	iplimitActive := j.hasLimitIp()
-	f2bInstalled := j.checkFail2BanInstalled()
-	isAccessLogAvailable := j.checkAccessLogAvailable(iplimitActive)
+	// xray's online stats tell the IPs without the access log
+	isIpSourceAvailable := onlineClientIps != nil || j.checkAccessLogAvailable(iplimitActive)
 
-	if iplimitActive {
-		if f2bInstalled && isAccessLogAvailable {
-			shouldClearAccessLog = j.processLogFile()
+	if iplimitActive && isIpSourceAvailable {
+		if j.ipLimitService.GetMode() != service.IpLimitModeFail2ban || j.checkFail2BanInstalled() {
+			j.processClientIps(clientIps)
 		} else {
-			if !f2bInstalled {
-				logger.Warning("[LimitIP] Fail2Ban is not installed, Please install Fail2Ban from the x-ui bash menu.")
-			}
+			errs = append(errs, common.NewErrorf("Fail2Ban is not installed, Please install Fail2Ban from the x-ui bash menu or choose another IP limit mode."))
 		}
 	}
+	return common.Combine(errs...)
+}
+
+// collectClientIps keeps when each client was last seen from each IP since
+// the last run.
+func (j *CheckClientIpJob) collectClientIps(records []*xray.AccessRecord) {
+	j.clientIpsLock.Lock()
+	defer j.clientIpsLock.Unlock()
 
-	if shouldClearAccessLog || (isAccessLogAvailable && time.Now().Unix()-j.lastClear > 3600) {
-		j.clearAccessLog()
+	for _, record := range records {
+		if !record.Accepted || record.Email == "" {
+			continue
+		}
+		if record.SourceIP == "127.0.0.1" || record.SourceIP == "::1" {
+			continue
+		}
+		if _, exists := j.clientIps[record.Email]; !exists {
+			j.clientIps[record.Email] = make(map[string]int64)
+		}
+		seen := record.Time.UnixMilli()
+		if seen > j.clientIps[record.Email][record.SourceIP] {
+			j.clientIps[record.Email][record.SourceIP] = seen
+		}
 	}
 }
 
-func (j *CheckClientIpJob) clearAccessLog() {
-	logAccessP, err := os.OpenFile(xray.GetAccessPersistentLogPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
-	j.checkError(err)
+// checkCountryPolicies tells the admins about clients showing up from new
+// countries and bans the IPs from countries their policy does not allow. It
+// runs before the IPs are added to the history, which tells the countries
+// each client was seen from until now. The countries a client is first seen
+// from are its baseline, which is not alerted about.
+func (j *CheckClientIpJob) checkCountryPolicies(clientIps map[string]map[string]int64) {
+	for email, ips := range clientIps {
+		policy, err := j.countryService.GetClientPolicy(email)
+		if err != nil {
+			j.checkError(err)
+			continue
+		}
+		if policy == nil {
+			continue
+		}
 
-	accessLogPath, err := xray.GetAccessLogPath()
-	j.checkError(err)
+		var knownCountries []string
+		if policy.AlertNewCountry {
+			knownCountries, err = j.inboundService.GetClientCountries(email)
+			if err != nil {
+				j.checkError(err)
+				continue
+			}
+		}
+		baseline := len(knownCountries) == 0
+
+		var disallowedIps []string
+		for ip := range ips {
+			country := service.LookupIP(ip).Country
+			if !service.IsCountryAllowed(policy, country) {
+				if !j.ipLimitService.IsBanned(email, ip) {
+					disallowedIps = append(disallowedIps, ip)
+				}
+				continue
+			}
+			if policy.AlertNewCountry && country != "" && !j.contains(knownCountries, country) {
+				knownCountries = append(knownCountries, country)
+				if !baseline {
+					j.alertNewCountry(email, country, ip)
+				}
+			}
+		}
 
-	file, err := os.Open(accessLogPath)
-	j.checkError(err)
+		if len(disallowedIps) > 0 {
+			sort.Strings(disallowedIps)
+			logger.Debug("[CountryPolicy] disallowed IPs of", email, ":", disallowedIps)
+			j.banIps(email, disallowedIps)
+		}
+	}
+}
 
-	_, err = io.Copy(logAccessP, file)
-	j.checkError(err)
+func (j *CheckClientIpJob) alertNewCountry(email string, country string, ip string) {
+	if !j.tgbotService.IsRunning() {
+		return
+	}
+	msg := j.tgbotService.I18nBot("tgbot.messages.newCountry",
+		"Email=="+email,
+		"Country=="+country,
+		"IP=="+ip)
+	j.tgbotService.SendMsgToTgbotAdmins(msg)
+}
 
-	logAccessP.Close()
-	file.Close()
+// addOnlineClientIps adds the IPs xray reports the clients as connected from,
+// which also covers long-lived connections not logged lately.
+func (j *CheckClientIpJob) addOnlineClientIps(clientIps map[string]map[string]int64, onlineClientIps map[string][]string) {
+	now := time.Now().UnixMilli()
+	for email, ips := range onlineClientIps {
+		if _, exists := clientIps[email]; !exists {
+			clientIps[email] = make(map[string]int64)
+		}
+		for _, ip := range ips {
+			clientIps[email][ip] = now
+		}
+	}
+}
 
-	err = os.Truncate(accessLogPath, 0)
-	j.checkError(err)
-	j.lastClear = time.Now().Unix()
+func (j *CheckClientIpJob) takeClientIps() map[string]map[string]int64 {
+	j.clientIpsLock.Lock()
+	defer j.clientIpsLock.Unlock()
+
+	clientIps := j.clientIps
+	j.clientIps = make(map[string]map[string]int64, 100)
+	return clientIps
 }
 
 func (j *CheckClientIpJob) hasLimitIp() bool {
@@ -105,52 +223,33 @@ func (j *CheckClientIpJob) hasLimitIp() bool {
 	return false
 }
 
-func (j *CheckClientIpJob) processLogFile() bool {
-
-	ipRegex := regexp.MustCompile(`from (?:tcp:|udp:)?\[?([0-9a-fA-F\.:]+)\]?:\d+ accepted`)
-	emailRegex := regexp.MustCompile(`email: (.+)$`)
-
-	accessLogPath, _ := xray.GetAccessLogPath()
-	file, _ := os.Open(accessLogPath)
-	defer file.Close()
-
-	inboundClientIps := make(map[string]map[string]struct{}, 100)
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
+// processClientIps checks the clients seen since the last run against their
+// limit, counting the IPs they were seen from within the IP limit window.
+func (j *CheckClientIpJob) processClientIps(inboundClientIps map[string]map[string]int64) {
+	windowMinutes, err := j.settingService.GetIpLimitWindowMinutes()
+	if err != nil || windowMinutes <= 0 {
+		windowMinutes = 1
+	}
+	since := time.Now().Add(-time.Duration(windowMinutes) * time.Minute).UnixMilli()
 
-		ipMatches := ipRegex.FindStringSubmatch(line)
-		if len(ipMatches) < 2 {
+	for email := range inboundClientIps {
+		activeIps, err := j.inboundService.GetActiveClientIps(email, since)
+		if err != nil {
+			j.checkError(err)
 			continue
 		}
 
-		ip := ipMatches[1]
-
-		if ip == "127.0.0.1" || ip == "::1" {
-			continue
+		ips := make([]string, 0, len(activeIps))
+		for _, ip := range activeIps {
+			// Connections that are already banned do not count
+			if j.ipLimitService.IsBanned(email, ip) {
+				continue
+			}
+			ips = append(ips, ip)
 		}
-
-		emailMatches := emailRegex.FindStringSubmatch(line)
-		if len(emailMatches) < 2 {
+		if len(ips) == 0 {
 			continue
 		}
-		email := emailMatches[1]
-
-		if _, exists := inboundClientIps[email]; !exists {
-			inboundClientIps[email] = make(map[string]struct{})
-		}
-		inboundClientIps[email][ip] = struct{}{}
-	}
-
-	shouldCleanLog := false
-	for email, uniqueIps := range inboundClientIps {
-
-		ips := make([]string, 0, len(uniqueIps))
-		for ip := range uniqueIps {
-			ips = append(ips, ip)
-		}
-		sort.Strings(ips)
 
 		clientIpsRecord, err := j.getInboundClientIps(email)
 		if err != nil {
@@ -158,10 +257,8 @@ func (j *CheckClientIpJob) processLogFile() bool {
 			continue
 		}
 
-		shouldCleanLog = j.updateInboundClientIps(clientIpsRecord, email, ips) || shouldCleanLog
+		j.updateInboundClientIps(clientIpsRecord, email, ips)
 	}
-
-	return shouldCleanLog
 }
 
 func (j *CheckClientIpJob) checkFail2BanInstalled() bool {
@@ -233,11 +330,11 @@ func (j *CheckClientIpJob) addInboundClientIps(clientEmail string, ips []string)
 	return nil
 }
 
-func (j *CheckClientIpJob) updateInboundClientIps(inboundClientIps *model.InboundClientIps, clientEmail string, ips []string) bool {
+func (j *CheckClientIpJob) updateInboundClientIps(inboundClientIps *model.InboundClientIps, clientEmail string, ips []string) {
 	jsonIps, err := json.Marshal(ips)
 	if err != nil {
 		logger.Error("failed to marshal IPs to JSON:", err)
-		return false
+		return
 	}
 
 	inboundClientIps.ClientEmail = clientEmail
@@ -246,41 +343,26 @@ func (j *CheckClientIpJob) updateInboundClientIps(inboundClientIps *model.Inboun
 	inbound, err := j.getInboundByEmail(clientEmail)
 	if err != nil {
 		logger.Errorf("failed to fetch inbound settings for email %s: %s", clientEmail, err)
-		return false
+		return
 	}
 
 	if inbound.Settings == "" {
 		logger.Debug("wrong data:", inbound)
-		return false
+		return
 	}
 
 	settings := map[string][]model.Client{}
 	json.Unmarshal([]byte(inbound.Settings), &settings)
 	clients := settings["clients"]
-	shouldCleanLog := false
 	j.disAllowedIps = []string{}
 
-	logIpFile, err := os.OpenFile(xray.GetIPLimitLogPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		logger.Errorf("failed to open IP limit log file: %s", err)
-		return false
-	}
-	defer logIpFile.Close()
-	log.SetOutput(logIpFile)
-	log.SetFlags(log.LstdFlags)
-
 	for _, client := range clients {
 		if client.Email == clientEmail {
 			limitIp := client.LimitIP
 
 			if limitIp > 0 && inbound.Enable {
-				shouldCleanLog = true
-
 				if limitIp < len(ips) {
 					j.disAllowedIps = append(j.disAllowedIps, ips[limitIp:]...)
-					for i := limitIp; i < len(ips); i++ {
-						log.Printf("[LIMIT_IP] Email = %s || SRC = %s", clientEmail, ips[i])
-					}
 				}
 			}
 		}
@@ -290,16 +372,41 @@ func (j *CheckClientIpJob) updateInboundClientIps(inboundClientIps *model.Inboun
 
 	if len(j.disAllowedIps) > 0 {
 		logger.Debug("disAllowedIps:", j.disAllowedIps)
+		j.banIps(clientEmail, j.disAllowedIps)
 	}
 
 	db := database.GetDB()
 	err = db.Save(inboundClientIps).Error
 	if err != nil {
 		logger.Error("failed to save inboundClientIps:", err)
-		return false
+		return
 	}
+}
 
-	return shouldCleanLog
+// banIps keeps a client from connecting from the IPs, the way the IP limit
+// mode says.
+func (j *CheckClientIpJob) banIps(clientEmail string, ips []string) {
+	if j.ipLimitService.GetMode() == service.IpLimitModeFail2ban {
+		j.logDisAllowedIps(clientEmail, ips)
+	} else if err := j.ipLimitService.Ban(clientEmail, ips); err != nil {
+		logger.Warning("[LimitIP] Failed to ban", clientEmail, ":", err)
+	}
+}
+
+// logDisAllowedIps writes the IPs to ban to the log fail2ban watches.
+func (j *CheckClientIpJob) logDisAllowedIps(clientEmail string, ips []string) {
+	logIpFile, err := os.OpenFile(xray.GetIPLimitLogPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Errorf("failed to open IP limit log file: %s", err)
+		return
+	}
+	defer logIpFile.Close()
+	log.SetOutput(logIpFile)
+	log.SetFlags(log.LstdFlags)
+
+	for _, ip := range ips {
+		log.Printf("[LIMIT_IP] Email = %s || SRC = %s", clientEmail, ip)
+	}
 }
 
 func (j *CheckClientIpJob) getInboundByEmail(clientEmail string) (*model.Inbound, error) {
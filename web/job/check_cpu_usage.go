@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/shirou/gopsutil/v4/cpu"
+	"x-ui/util/common"
 	"x-ui/web/service"
 )
 
@@ -19,15 +20,26 @@ func NewCheckCpuJob() *CheckCpuJob {
 
 // Here run is a interface method of Job interface
 func (j *CheckCpuJob) Run() {
-	threshold, _ := j.settingService.GetTgCpu()
+	j.RunWithError()
+}
+
+func (j *CheckCpuJob) RunWithError() error {
+	threshold, err := j.settingService.GetTgCpu()
+	if err != nil {
+		return err
+	}
 
 	// get latest status of server
 	percent, err := cpu.Percent(1*time.Minute, false)
-	if err == nil && percent[0] > float64(threshold) {
+	if err != nil {
+		return common.NewErrorf("get cpu usage failed: %v", err)
+	}
+	if len(percent) > 0 && percent[0] > float64(threshold) {
 		msg := j.tgbotService.I18nBot("tgbot.messages.cpuThreshold",
 			"Percent=="+strconv.FormatFloat(percent[0], 'f', 2, 64),
 			"Threshold=="+strconv.Itoa(threshold))
 
 		j.tgbotService.SendMsgToTgbotAdmins(msg)
 	}
+	return nil
 }
@@ -1,12 +1,15 @@
 package job
 
 import (
+	"html"
+
 	"x-ui/logger"
 	"x-ui/web/service"
 )
 
 type CheckXrayRunningJob struct {
-	xrayService service.XrayService
+	xrayService  service.XrayService
+	tgbotService service.Tgbot
 
 	checkTime int
 }
@@ -16,17 +19,39 @@ func NewCheckXrayRunningJob() *CheckXrayRunningJob {
 }
 
 func (j *CheckXrayRunningJob) Run() {
+	j.RunWithError()
+}
+
+func (j *CheckXrayRunningJob) RunWithError() error {
 	if j.xrayService.IsXrayRunning() {
 		j.checkTime = 0
+		if err := j.xrayService.MarkXrayConfigGood(); err != nil {
+			logger.Warning("Failed to save the last good xray config:", err)
+		}
 	} else {
 		j.checkTime++
 		// only restart if it's down 2 times in a row
 		if j.checkTime > 1 {
-			err := j.xrayService.RestartXray(false)
+			rollback, err := j.xrayService.RecoverXray()
 			j.checkTime = 0
+			if rollback != nil {
+				j.notifyRollback(rollback)
+			}
 			if err != nil {
 				logger.Error("Restart xray failed:", err)
+				return err
 			}
 		}
 	}
+	return nil
+}
+
+func (j *CheckXrayRunningJob) notifyRollback(rollback *service.XrayRollback) {
+	if !j.tgbotService.IsRunning() {
+		return
+	}
+	msg := j.tgbotService.I18nBot("tgbot.messages.xrayRollback",
+		"Diff=="+html.EscapeString(rollback.Diff),
+		"CrashReport=="+html.EscapeString(rollback.CrashReport))
+	j.tgbotService.SendMsgToTgbotAdmins(msg)
 }
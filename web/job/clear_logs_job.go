@@ -5,11 +5,14 @@ import (
 	"os"
 	"path/filepath"
 
-	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/service"
 	"x-ui/xray"
 )
 
-type ClearLogsJob struct{}
+type ClearLogsJob struct {
+	accessLogService service.AccessLogService
+}
 
 func NewClearLogsJob() *ClearLogsJob {
 	return new(ClearLogsJob)
@@ -32,13 +35,23 @@ func ensureFileExists(path string) error {
 
 // Here Run is an interface method of the Job interface
 func (j *ClearLogsJob) Run() {
+	j.RunWithError()
+}
+
+func (j *ClearLogsJob) RunWithError() error {
+	var errs []error
+	// Move what is left of the access log into the persistent access log first
+	if err := j.accessLogService.Ingest(); err != nil {
+		errs = append(errs, common.NewErrorf("ingest access log failed: %v", err))
+	}
+
 	logFiles := []string{xray.GetIPLimitLogPath(), xray.GetIPLimitBannedLogPath(), xray.GetAccessPersistentLogPath()}
 	logFilesPrev := []string{xray.GetIPLimitBannedPrevLogPath(), xray.GetAccessPersistentPrevLogPath()}
 
 	// Ensure all log files and their paths exist
 	for _, path := range append(logFiles, logFilesPrev...) {
 		if err := ensureFileExists(path); err != nil {
-			logger.Warning("Failed to ensure log file exists:", path, "-", err)
+			errs = append(errs, common.NewErrorf("ensure log file %s exists failed: %v", path, err))
 		}
 	}
 
@@ -46,31 +59,36 @@ func (j *ClearLogsJob) Run() {
 	for i := 0; i < len(logFiles); i++ {
 		if i > 0 {
 			// Copy to previous logs
-			logFilePrev, err := os.OpenFile(logFilesPrev[i-1], os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
-			if err != nil {
-				logger.Warning("Failed to open previous log file for writing:", logFilesPrev[i-1], "-", err)
+			if err := copyLogFile(logFiles[i], logFilesPrev[i-1]); err != nil {
+				errs = append(errs, err)
 				continue
 			}
-
-			logFile, err := os.OpenFile(logFiles[i], os.O_RDONLY, 0644)
-			if err != nil {
-				logger.Warning("Failed to open current log file for reading:", logFiles[i], "-", err)
-				logFilePrev.Close()
-				continue
-			}
-
-			_, err = io.Copy(logFilePrev, logFile)
-			if err != nil {
-				logger.Warning("Failed to copy log file:", logFiles[i], "to", logFilesPrev[i-1], "-", err)
-			}
-
-			logFile.Close()
-			logFilePrev.Close()
 		}
 
 		err := os.Truncate(logFiles[i], 0)
 		if err != nil {
-			logger.Warning("Failed to truncate log file:", logFiles[i], "-", err)
+			errs = append(errs, common.NewErrorf("truncate log file %s failed: %v", logFiles[i], err))
 		}
 	}
+	return common.Combine(errs...)
+}
+
+// copyLogFile replaces the previous log file with the current one.
+func copyLogFile(path string, prevPath string) error {
+	logFilePrev, err := os.OpenFile(prevPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return common.NewErrorf("open previous log file %s for writing failed: %v", prevPath, err)
+	}
+	defer logFilePrev.Close()
+
+	logFile, err := os.OpenFile(path, os.O_RDONLY, 0644)
+	if err != nil {
+		return common.NewErrorf("open current log file %s for reading failed: %v", path, err)
+	}
+	defer logFile.Close()
+
+	if _, err := io.Copy(logFilePrev, logFile); err != nil {
+		return common.NewErrorf("copy log file %s to %s failed: %v", path, prevPath, err)
+	}
+	return nil
 }
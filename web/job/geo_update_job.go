@@ -0,0 +1,26 @@
+package job
+
+import (
+	"x-ui/util/common"
+	"x-ui/web/service"
+)
+
+type GeoUpdateJob struct {
+	geoService service.GeoService
+}
+
+func NewGeoUpdateJob() *GeoUpdateJob {
+	return new(GeoUpdateJob)
+}
+
+// Run updates the custom geo files whose schedule is due.
+func (j *GeoUpdateJob) Run() {
+	j.RunWithError()
+}
+
+func (j *GeoUpdateJob) RunWithError() error {
+	if err := j.geoService.RefreshDueSources(); err != nil {
+		return common.NewErrorf("update geo files failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package job
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/web/service"
+
+	"github.com/robfig/cron/v3"
+)
+
+// specParser accepts the same schedules as the panel cron (with seconds and descriptors).
+var specParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+var registry *Registry
+
+// errorJob is implemented by jobs that can report why their last run failed.
+type errorJob interface {
+	RunWithError() error
+}
+
+// specJob is implemented by jobs whose schedule is kept in a setting of its
+// own. The registry leaves the schedule to that setting, only keeping whether
+// the job is enabled.
+type specJob interface {
+	SaveSpec(spec string) error
+}
+
+// accessLogJob is implemented by jobs draining a consumer of the access log,
+// which is paused while the job is disabled.
+type accessLogJob interface {
+	PauseAccessLog(pause bool)
+}
+
+// JobSetting is the persisted, user editable part of a job.
+type JobSetting struct {
+	Enable bool   `json:"enable"`
+	Spec   string `json:"spec"`
+}
+
+// JobInfo describes a registered job and the outcome of its last run.
+type JobInfo struct {
+	Name         string `json:"name"`
+	Spec         string `json:"spec"`
+	DefaultSpec  string `json:"defaultSpec"`
+	Enable       bool   `json:"enable"`
+	Running      bool   `json:"running"`
+	LastRun      int64  `json:"lastRun"`
+	LastDuration int64  `json:"lastDuration"`
+	LastError    string `json:"lastError"`
+	NextRun      int64  `json:"nextRun"`
+}
+
+type registryEntry struct {
+	info    JobInfo
+	job     cron.Job
+	entryId cron.EntryID
+}
+
+// Registry keeps track of the background jobs of the panel and lets them be
+// enabled, rescheduled and triggered at runtime.
+type Registry struct {
+	mu      sync.Mutex
+	cron    *cron.Cron
+	entries map[string]*registryEntry
+	names   []string
+
+	settingService service.SettingService
+}
+
+// InitRegistry creates the job registry on top of the given cron and makes it
+// available through GetRegistry.
+func InitRegistry(c *cron.Cron) *Registry {
+	registry = &Registry{
+		cron:    c,
+		entries: make(map[string]*registryEntry),
+	}
+	return registry
+}
+
+func GetRegistry() *Registry {
+	return registry
+}
+
+// Register adds a job under a unique name. The persisted setting of the job,
+// if any, overrides the given default schedule, unless the job keeps its
+// schedule itself.
+func (r *Registry) Register(name string, spec string, job cron.Job) error {
+	if _, err := specParser.Parse(spec); err != nil {
+		return common.NewErrorf("invalid schedule <%v> for job %v: %v", spec, name, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.entries[name]; ok {
+		return common.NewErrorf("job %v is already registered", name)
+	}
+
+	entry := &registryEntry{
+		info: JobInfo{
+			Name:        name,
+			Spec:        spec,
+			DefaultSpec: spec,
+			Enable:      true,
+		},
+		job: job,
+	}
+	if setting, ok := r.getSettings()[name]; ok {
+		entry.info.Enable = setting.Enable
+		if _, ok := job.(specJob); !ok && setting.Spec != "" {
+			if _, err := specParser.Parse(setting.Spec); err == nil {
+				entry.info.Spec = setting.Spec
+			} else {
+				logger.Warningf("Ignoring invalid schedule <%v> of job %v: %v", setting.Spec, name, err)
+			}
+		}
+	}
+
+	r.entries[name] = entry
+	r.names = append(r.names, name)
+	return r.schedule(entry)
+}
+
+// List returns the state of all registered jobs in registration order.
+func (r *Registry) List() []JobInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	infos := make([]JobInfo, 0, len(r.names))
+	for _, name := range r.names {
+		entry := r.entries[name]
+		info := entry.info
+		if entry.entryId != 0 {
+			info.NextRun = r.cron.Entry(entry.entryId).Next.UnixMilli()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Update changes the schedule of a job and persists it. An empty spec
+// restores the default schedule.
+func (r *Registry) Update(name string, enable bool, spec string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.entries[name]
+	if !ok {
+		return common.NewErrorf("job %v not found", name)
+	}
+	if spec == "" {
+		spec = entry.info.DefaultSpec
+	}
+	if _, err := specParser.Parse(spec); err != nil {
+		return common.NewErrorf("invalid schedule <%v>: %v", spec, err)
+	}
+
+	setting := JobSetting{Enable: enable, Spec: spec}
+	if j, ok := entry.job.(specJob); ok {
+		if err := j.SaveSpec(spec); err != nil {
+			return err
+		}
+		setting.Spec = ""
+	}
+	settings := r.getSettings()
+	settings[name] = setting
+	if err := r.saveSettings(settings); err != nil {
+		return err
+	}
+
+	if entry.entryId != 0 {
+		r.cron.Remove(entry.entryId)
+		entry.entryId = 0
+	}
+	entry.info.Enable = enable
+	entry.info.Spec = spec
+	return r.schedule(entry)
+}
+
+// RunNow triggers a job immediately, regardless of whether it is enabled.
+func (r *Registry) RunNow(name string) error {
+	r.mu.Lock()
+	entry, ok := r.entries[name]
+	running := ok && entry.info.Running
+	r.mu.Unlock()
+
+	if !ok {
+		return common.NewErrorf("job %v not found", name)
+	}
+	if running {
+		return common.NewErrorf("job %v is already running", name)
+	}
+	go r.run(entry)
+	return nil
+}
+
+func (r *Registry) schedule(entry *registryEntry) error {
+	if j, ok := entry.job.(accessLogJob); ok {
+		j.PauseAccessLog(!entry.info.Enable)
+	}
+	if !entry.info.Enable {
+		return nil
+	}
+	id, err := r.cron.AddFunc(entry.info.Spec, func() {
+		r.run(entry)
+	})
+	if err != nil {
+		return err
+	}
+	entry.entryId = id
+	return nil
+}
+
+func (r *Registry) run(entry *registryEntry) {
+	r.mu.Lock()
+	if entry.info.Running {
+		// do not let a slow job pile up
+		r.mu.Unlock()
+		return
+	}
+	entry.info.Running = true
+	r.mu.Unlock()
+
+	start := time.Now()
+	err := runJob(entry.job)
+	duration := time.Since(start)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry.info.Running = false
+	entry.info.LastRun = start.UnixMilli()
+	entry.info.LastDuration = duration.Milliseconds()
+	entry.info.LastError = ""
+	if err != nil {
+		entry.info.LastError = err.Error()
+		logger.Warningf("Job %v failed: %v", entry.info.Name, err)
+	}
+}
+
+func runJob(job cron.Job) (err error) {
+	defer func() {
+		if panicErr := recover(); panicErr != nil {
+			err = fmt.Errorf("panic: %v", panicErr)
+		}
+	}()
+	if j, ok := job.(errorJob); ok {
+		return j.RunWithError()
+	}
+	job.Run()
+	return nil
+}
+
+func (r *Registry) getSettings() map[string]JobSetting {
+	settings := make(map[string]JobSetting)
+	data, err := r.settingService.GetJobSettings()
+	if err != nil {
+		logger.Warning("Failed to get job settings:", err)
+		return settings
+	}
+	if data == "" {
+		return settings
+	}
+	if err := json.Unmarshal([]byte(data), &settings); err != nil {
+		logger.Warning("Failed to parse job settings:", err)
+	}
+	return settings
+}
+
+func (r *Registry) saveSettings(settings map[string]JobSetting) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return r.settingService.SetJobSettings(string(data))
+}
@@ -1,6 +1,7 @@
 package job
 
 import (
+	"x-ui/util/common"
 	"x-ui/web/service"
 )
 
@@ -12,8 +13,9 @@ const (
 )
 
 type StatsNotifyJob struct {
-	xrayService  service.XrayService
-	tgbotService service.Tgbot
+	xrayService    service.XrayService
+	tgbotService   service.Tgbot
+	settingService service.SettingService
 }
 
 func NewStatsNotifyJob() *StatsNotifyJob {
@@ -22,8 +24,22 @@ func NewStatsNotifyJob() *StatsNotifyJob {
 
 // Here run is a interface method of Job interface
 func (j *StatsNotifyJob) Run() {
+	j.RunWithError()
+}
+
+func (j *StatsNotifyJob) RunWithError() error {
 	if !j.xrayService.IsXrayRunning() {
-		return
+		return nil
+	}
+	if !j.tgbotService.IsRunning() {
+		return common.NewErrorf("telegram bot is not running")
 	}
 	j.tgbotService.SendReport()
+	return nil
+}
+
+// SaveSpec keeps the schedule of the report in the tgRunTime setting, the one
+// the bot settings edit, rather than with the other jobs.
+func (j *StatsNotifyJob) SaveSpec(spec string) error {
+	return j.settingService.SetTgbotRuntime(spec)
 }
@@ -0,0 +1,35 @@
+package job
+
+import (
+	"x-ui/util/common"
+	"x-ui/web/service"
+)
+
+type SubAccessJob struct {
+	subAccessService service.SubAccessService
+	subTokenService  service.SubTokenService
+}
+
+func NewSubAccessJob() *SubAccessJob {
+	return new(SubAccessJob)
+}
+
+// Run reports the shared subscriptions and drops the expired requests and
+// subscription tokens.
+func (j *SubAccessJob) Run() {
+	j.RunWithError()
+}
+
+func (j *SubAccessJob) RunWithError() error {
+	var checkErr, pruneErr, tokenErr error
+	if err := j.subAccessService.CheckSharing(); err != nil {
+		checkErr = common.NewErrorf("check shared subscriptions failed: %v", err)
+	}
+	if err := j.subAccessService.Prune(); err != nil {
+		pruneErr = common.NewErrorf("prune subscription requests failed: %v", err)
+	}
+	if err := j.subTokenService.Prune(); err != nil {
+		tokenErr = common.NewErrorf("prune subscription tokens failed: %v", err)
+	}
+	return common.Combine(checkErr, pruneErr, tokenErr)
+}
@@ -2,7 +2,10 @@ package job
 
 import (
 	"encoding/json"
+	"errors"
+
 	"x-ui/logger"
+	"x-ui/util/common"
 	"x-ui/web/service"
 	"x-ui/xray"
 
@@ -12,8 +15,10 @@ import (
 type XrayTrafficJob struct {
 	settingService  service.SettingService
 	xrayService     service.XrayService
+	coreService     service.CoreService
 	inboundService  service.InboundService
 	outboundService service.OutboundService
+	abuseService    service.AbuseService
 }
 
 func NewXrayTrafficJob() *XrayTrafficJob {
@@ -21,20 +26,28 @@ func NewXrayTrafficJob() *XrayTrafficJob {
 }
 
 func (j *XrayTrafficJob) Run() {
-	if !j.xrayService.IsXrayRunning() {
-		return
+	j.RunWithError()
+}
+
+func (j *XrayTrafficJob) RunWithError() error {
+	if len(j.coreService.GetRunningBackends()) == 0 {
+		return nil
 	}
-	traffics, clientTraffics, err := j.xrayService.GetXrayTraffic()
+	traffics, clientTraffics, err := j.coreService.GetTraffic()
 	if err != nil {
-		return
+		return err
 	}
-	err, needRestart0 := j.inboundService.AddTraffic(traffics, clientTraffics)
-	if err != nil {
-		logger.Warning("add inbound traffic failed:", err)
+	j.abuseService.CollectTraffic(clientTraffics)
+	err0, needRestart0 := j.inboundService.AddTraffic(traffics, clientTraffics)
+	if err0 != nil {
+		logger.Warning("add inbound traffic failed:", err0)
 	}
-	err, needRestart1 := j.outboundService.AddTraffic(traffics, clientTraffics)
-	if err != nil {
-		logger.Warning("add outbound traffic failed:", err)
+	err1, needRestart1 := j.outboundService.AddTraffic(traffics, clientTraffics)
+	if err1 != nil {
+		logger.Warning("add outbound traffic failed:", err1)
+	}
+	if j.xrayService.IsXrayRunning() {
+		j.updateOnlineClientIps()
 	}
 	if ExternalTrafficInformEnable, err := j.settingService.GetExternalTrafficInformEnable(); ExternalTrafficInformEnable {
 		j.informTrafficToExternalAPI(traffics, clientTraffics)
@@ -44,6 +57,28 @@ func (j *XrayTrafficJob) Run() {
 	if needRestart0 || needRestart1 {
 		j.xrayService.SetToNeedRestart()
 	}
+	return common.Combine(err0, err1)
+}
+
+// updateOnlineClientIps asks xray who is online. Cores without the online
+// stats API leave the clients found online by their traffic and the IPs
+// found in the access log.
+func (j *XrayTrafficJob) updateOnlineClientIps() {
+	emails, err := j.inboundService.GetEnabledClientEmails()
+	if err != nil {
+		logger.Warning("get enabled clients failed:", err)
+		return
+	}
+	onlineIps, err := j.xrayService.GetXrayOnlineIPs(emails)
+	if err != nil {
+		if !errors.Is(err, xray.ErrOnlineStatsUnavailable) {
+			logger.Debug("get xray online IPs failed:", err)
+		}
+		onlineIps = nil
+	}
+	if err := j.inboundService.SetOnlineClientIps(onlineIps); err != nil {
+		logger.Warning("set online clients failed:", err)
+	}
 }
 
 func (j *XrayTrafficJob) informTrafficToExternalAPI(inboundTraffics []*xray.Traffic, clientTraffics []*xray.ClientTraffic) {
@@ -76,6 +76,12 @@ func I18n(i18nType I18nType, key string, params ...string) string {
 		return ""
 	}
 
+	return Localize(localizer, key, params...)
+}
+
+// Localize translates a message through the given localizer, such as the one
+// LocalizerMiddleware puts in the context of a request.
+func Localize(localizer *i18n.Localizer, key string, params ...string) string {
 	templateData := createTemplateData(params)
 
 	msg, err := localizer.Localize(&i18n.LocalizeConfig{
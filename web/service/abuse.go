@@ -0,0 +1,320 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+// The abuse rules. bittorrent catches the connections xray sniffs as
+// BitTorrent, scan the clients connecting to many distinct destination IPs,
+// smtp the connections to mail servers and upload the clients uploading a
+// lot.
+const (
+	AbuseRuleBittorrent = "bittorrent"
+	AbuseRuleScan       = "scan"
+	AbuseRuleSmtp       = "smtp"
+	AbuseRuleUpload     = "upload"
+)
+
+const (
+	// abuseBittorrentTag is the outbound BitTorrent is routed to, telling
+	// BitTorrent connections apart in the access log. It only blocks them
+	// when set to, or when the template already did.
+	abuseBittorrentTag = "abuse-bittorrent"
+	// abuseReportInterval is how long a client is not reported again for
+	// breaking the same rule.
+	abuseReportInterval = time.Hour
+	// abuseEvidenceSamples is how many connections are quoted as evidence.
+	abuseEvidenceSamples = 5
+)
+
+// abuseActivity is what a client did since the rules were last checked.
+type abuseActivity struct {
+	destinationIPs map[string]bool
+	sourceIPs      map[string]bool
+	bittorrent     []string
+	smtp           []string
+	upload         int64
+}
+
+var (
+	pendingAbuseLock sync.Mutex
+	pendingAbuse     = make(map[string]*abuseActivity)
+	// pendingAbuseSince is when the activity pending a check began
+	pendingAbuseSince = time.Now()
+)
+
+func getAbuseActivity(email string) *abuseActivity {
+	activity, ok := pendingAbuse[email]
+	if !ok {
+		activity = &abuseActivity{
+			destinationIPs: make(map[string]bool),
+			sourceIPs:      make(map[string]bool),
+		}
+		pendingAbuse[email] = activity
+	}
+	return activity
+}
+
+// AbuseService checks the access log and traffic of the clients against the
+// abuse rules, reports the clients breaking them to the admins and, if set
+// to, suspends them until they are released.
+type AbuseService struct {
+	xrayService    XrayService
+	settingService SettingService
+	tgbotService   Tgbot
+	xrayApi        xray.XrayAPI
+}
+
+func (s *AbuseService) isEnabled() bool {
+	enable, err := s.settingService.GetAbuseDetectEnable()
+	return err == nil && enable
+}
+
+// Collect is the access log consumer of the abuse detection.
+func (s *AbuseService) Collect(records []*xray.AccessRecord) {
+	if !s.isEnabled() {
+		return
+	}
+
+	pendingAbuseLock.Lock()
+	defer pendingAbuseLock.Unlock()
+	for _, record := range records {
+		if !record.Accepted || record.Email == "" || record.Destination == "" {
+			continue
+		}
+		activity := getAbuseActivity(record.Email)
+		host, _, err := net.SplitHostPort(record.Destination)
+		if err != nil {
+			host = strings.Trim(record.Destination, "[]")
+		}
+		if net.ParseIP(host) != nil {
+			activity.destinationIPs[host] = true
+		}
+		activity.sourceIPs[record.SourceIP] = true
+
+		connection := fmt.Sprintf("%s %s:%s", record.Time.Format("15:04:05"), record.Network, record.Destination)
+		if record.OutboundTag == abuseBittorrentTag && len(activity.bittorrent) < abuseEvidenceSamples {
+			activity.bittorrent = append(activity.bittorrent, connection)
+		}
+		if _, port, err := net.SplitHostPort(record.Destination); err == nil && port == "25" && len(activity.smtp) < abuseEvidenceSamples {
+			activity.smtp = append(activity.smtp, connection)
+		}
+	}
+}
+
+// CollectTraffic adds up the traffic of the clients for the upload rule.
+func (s *AbuseService) CollectTraffic(traffics []*xray.ClientTraffic) {
+	if len(traffics) == 0 || !s.isEnabled() {
+		return
+	}
+
+	pendingAbuseLock.Lock()
+	defer pendingAbuseLock.Unlock()
+	for _, traffic := range traffics {
+		if traffic.Up > 0 {
+			getAbuseActivity(traffic.Email).upload += traffic.Up
+		}
+	}
+}
+
+// Check evaluates the rules over what the clients did since the last check.
+// The thresholds, which are per minute, are scaled to the time since then,
+// though never below a minute's worth.
+func (s *AbuseService) Check() error {
+	pendingAbuseLock.Lock()
+	pending := pendingAbuse
+	pendingAbuse = make(map[string]*abuseActivity)
+	elapsed := time.Since(pendingAbuseSince)
+	pendingAbuseSince = time.Now()
+	pendingAbuseLock.Unlock()
+	if len(pending) == 0 || !s.isEnabled() {
+		return nil
+	}
+
+	bittorrent, _ := s.settingService.GetAbuseBittorrent()
+	smtp, _ := s.settingService.GetAbuseSmtp()
+	scanThreshold, _ := s.settingService.GetAbuseScanThreshold()
+	uploadThreshold, _ := s.settingService.GetAbuseUploadThreshold()
+	minutes := max(elapsed.Minutes(), 1)
+	scanLimit := int(float64(scanThreshold) * minutes)
+	uploadLimit := int64(float64(int64(uploadThreshold)<<20) * minutes)
+	period := elapsed.Round(time.Second).String()
+
+	var errs []error
+	for email, activity := range pending {
+		sources := strings.Join(sortedKeys(activity.sourceIPs), ", ")
+		if bittorrent && len(activity.bittorrent) > 0 {
+			errs = append(errs, s.report(email, AbuseRuleBittorrent, fmt.Sprintf("BitTorrent from %s: %s",
+				sources, strings.Join(activity.bittorrent, ", "))))
+		}
+		if smtp && len(activity.smtp) > 0 {
+			errs = append(errs, s.report(email, AbuseRuleSmtp, fmt.Sprintf("SMTP from %s: %s",
+				sources, strings.Join(activity.smtp, ", "))))
+		}
+		if scanThreshold > 0 && len(activity.destinationIPs) > scanLimit {
+			samples := sortedKeys(activity.destinationIPs)
+			if len(samples) > abuseEvidenceSamples {
+				samples = samples[:abuseEvidenceSamples]
+			}
+			errs = append(errs, s.report(email, AbuseRuleScan, fmt.Sprintf("%d destination IPs in %s from %s, such as %s",
+				len(activity.destinationIPs), period, sources, strings.Join(samples, ", "))))
+		}
+		if uploadThreshold > 0 && activity.upload > uploadLimit {
+			errs = append(errs, s.report(email, AbuseRuleUpload, fmt.Sprintf("%.1f MB uploaded in %s",
+				float64(activity.upload)/(1<<20), period)))
+		}
+	}
+	return common.Combine(errs...)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// report records that a client broke a rule, suspends it if set to and tells
+// the admins. A client is reported once per rule per abuseReportInterval.
+func (s *AbuseService) report(email string, rule string, evidence string) error {
+	db := database.GetDB()
+	var count int64
+	err := db.Model(model.AbuseEvent{}).
+		Where("email = ? AND rule = ? AND time > ?", email, rule, time.Now().Add(-abuseReportInterval).UnixMilli()).
+		Count(&count).Error
+	if err != nil {
+		return common.NewErrorf("look up the abuse events of %s failed: %v", email, err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	suspend, _ := s.settingService.GetAbuseSuspend()
+	event := &model.AbuseEvent{
+		Email:     email,
+		Rule:      rule,
+		Evidence:  evidence,
+		Time:      time.Now().UnixMilli(),
+		Suspended: suspend,
+	}
+	if err := db.Create(event).Error; err != nil {
+		return common.NewErrorf("save the abuse event of %s failed: %v", email, err)
+	}
+	logger.Warningf("[Abuse] %s broke the %s rule: %s", email, rule, evidence)
+
+	s.notify(event)
+	if suspend {
+		if err := s.suspend(email); err != nil {
+			return common.NewErrorf("suspend %s failed: %v", email, err)
+		}
+	}
+	return nil
+}
+
+// suspend takes a client out of the running xray. genXrayConfig keeps it
+// out from then on.
+func (s *AbuseService) suspend(email string) error {
+	if !s.xrayService.IsXrayRunning() {
+		return nil
+	}
+	db := database.GetDB()
+	var tags []string
+	err := db.Table("inbounds").
+		Joins("JOIN client_traffics ON inbounds.id = client_traffics.inbound_id").
+		Where("client_traffics.email = ?", email).
+		Pluck("inbounds.tag", &tags).Error
+	if err != nil {
+		return err
+	}
+
+	s.xrayApi.Init(p.GetAPIPort())
+	defer s.xrayApi.Close()
+	for _, tag := range tags {
+		err := s.xrayApi.RemoveUser(tag, email)
+		if err != nil && !strings.Contains(err.Error(), fmt.Sprintf("User %s not found.", email)) {
+			return err
+		}
+	}
+	logger.Infof("[Abuse] Suspended %s", email)
+	return nil
+}
+
+func (s *AbuseService) notify(event *model.AbuseEvent) {
+	if !s.tgbotService.IsRunning() {
+		return
+	}
+	msg := s.tgbotService.I18nBot("tgbot.messages.abuseDetected",
+		"Email=="+event.Email,
+		"Rule=="+event.Rule,
+		"Evidence=="+event.Evidence)
+	if event.Suspended {
+		msg += s.tgbotService.I18nBot("tgbot.messages.abuseSuspended")
+	}
+	s.tgbotService.SendMsgToTgbotAdmins(msg)
+}
+
+func (s *AbuseService) GetEvents() ([]model.AbuseEvent, error) {
+	db := database.GetDB()
+	var events []model.AbuseEvent
+	err := db.Order("id desc").Find(&events).Error
+	return events, err
+}
+
+func (s *AbuseService) DelEvent(id int) error {
+	db := database.GetDB()
+	event := &model.AbuseEvent{}
+	if err := db.First(event, id).Error; err != nil {
+		return err
+	}
+	if err := db.Delete(event).Error; err != nil {
+		return err
+	}
+	if event.Suspended {
+		return s.reloadXray()
+	}
+	return nil
+}
+
+// Release lifts the suspension of a client, keeping its events.
+func (s *AbuseService) Release(email string) error {
+	db := database.GetDB()
+	err := db.Model(model.AbuseEvent{}).
+		Where("email = ? AND suspended = ?", email, true).
+		Update("suspended", false).Error
+	if err != nil {
+		return err
+	}
+	logger.Infof("[Abuse] Released %s", email)
+	return s.reloadXray()
+}
+
+func (s *AbuseService) reloadXray() error {
+	if !s.xrayService.IsXrayRunning() {
+		return nil
+	}
+	return s.xrayService.RestartXray(false)
+}
+
+// getSuspendedEmails returns the clients suspended for abuse.
+func getSuspendedEmails() ([]string, error) {
+	db := database.GetDB()
+	var emails []string
+	err := db.Model(model.AbuseEvent{}).
+		Where("suspended = ?", true).
+		Distinct("email").
+		Pluck("email", &emails).Error
+	return emails, err
+}
@@ -0,0 +1,160 @@
+package service
+
+import (
+	"os"
+	"strings"
+	"sync"
+
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+const (
+	// accessLogRecentSize is how many of the latest records are kept for search.
+	accessLogRecentSize = 5000
+	// accessLogMaxSize is the size past which the access log is emptied once
+	// it has been read.
+	accessLogMaxSize = 32 << 20
+	// accessPersistentLogMaxSize is the size past which the persistent access
+	// log is moved to the previous one.
+	accessPersistentLogMaxSize = 64 << 20
+)
+
+// AccessLogConsumer is handed every batch of records parsed from the access
+// log.
+type AccessLogConsumer func(records []*xray.AccessRecord)
+
+// RegisteredAccessLogConsumer is a consumer added to the access log.
+type RegisteredAccessLogConsumer struct {
+	name    string
+	consume AccessLogConsumer
+	paused  bool
+}
+
+var (
+	accessLogLock       sync.Mutex
+	accessLogTailer     = xray.NewAccessLogTailer()
+	accessLogConsumers  = make(map[string]*RegisteredAccessLogConsumer)
+	recentAccessRecords []*xray.AccessRecord
+)
+
+// RegisterAccessLogConsumer adds a consumer of the access log, replacing
+// the one registered before under the same name.
+func RegisterAccessLogConsumer(name string, consumer AccessLogConsumer) *RegisteredAccessLogConsumer {
+	accessLogLock.Lock()
+	defer accessLogLock.Unlock()
+	registered := &RegisteredAccessLogConsumer{name: name, consume: consumer}
+	accessLogConsumers[name] = registered
+	return registered
+}
+
+// Pause stops or resumes handing records to the consumer, for the records
+// not to pile up in a consumer that nothing drains, such as the one of a
+// disabled job.
+func (c *RegisteredAccessLogConsumer) Pause(pause bool) {
+	accessLogLock.Lock()
+	defer accessLogLock.Unlock()
+	c.paused = pause
+}
+
+type AccessLogQuery struct {
+	Email       string `json:"email" form:"email"`
+	IP          string `json:"ip" form:"ip"`
+	Destination string `json:"destination" form:"destination"`
+	Count       int    `json:"count" form:"count"`
+}
+
+// AccessLogService is the single reader of the xray access log. It parses
+// new lines into records and hands them to the registered consumers.
+type AccessLogService struct{}
+
+// Ingest hands the records appended to the access log to the consumers.
+func (s *AccessLogService) Ingest() error {
+	accessLogLock.Lock()
+	defer accessLogLock.Unlock()
+	return s.ingest()
+}
+
+// ingest reads the new lines of the access log, appending them to the
+// persistent access log. Both are kept in size: the access log is emptied
+// once read past accessLogMaxSize and the persistent access log replaces the
+// previous one past accessPersistentLogMaxSize.
+func (s *AccessLogService) ingest() error {
+	accessLogPath, err := xray.GetAccessLogPath()
+	if err != nil || accessLogPath == "" || accessLogPath == "none" {
+		return nil
+	}
+	persistentLogPath := xray.GetAccessPersistentLogPath()
+	if info, err := os.Stat(persistentLogPath); err == nil && info.Size() > accessPersistentLogMaxSize {
+		if err := os.Rename(persistentLogPath, xray.GetAccessPersistentPrevLogPath()); err != nil {
+			logger.Warning("rotate persistent access log failed:", err)
+		}
+	}
+	persistentLog, err := os.OpenFile(persistentLogPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer persistentLog.Close()
+
+	records, err := accessLogTailer.Read(accessLogPath, persistentLog)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if len(records) == 0 {
+			return err
+		}
+		err = common.NewErrorf("copy access log failed: %v", err)
+	} else if truncateErr := accessLogTailer.Truncate(accessLogMaxSize); truncateErr != nil {
+		err = common.NewErrorf("truncate access log failed: %v", truncateErr)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	recentAccessRecords = append(recentAccessRecords, records...)
+	if len(recentAccessRecords) > accessLogRecentSize {
+		recentAccessRecords = append([]*xray.AccessRecord(nil), recentAccessRecords[len(recentAccessRecords)-accessLogRecentSize:]...)
+	}
+	for _, consumer := range accessLogConsumers {
+		if consumer.paused {
+			continue
+		}
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					logger.Errorf("access log consumer %v panic: %v", consumer.name, err)
+				}
+			}()
+			consumer.consume(records)
+		}()
+	}
+	return err
+}
+
+// Search returns the latest records matching the query, newest first.
+func (s *AccessLogService) Search(query *AccessLogQuery) []*xray.AccessRecord {
+	accessLogLock.Lock()
+	defer accessLogLock.Unlock()
+
+	count := query.Count
+	if count <= 0 || count > accessLogRecentSize {
+		count = 100
+	}
+	records := make([]*xray.AccessRecord, 0, count)
+	for i := len(recentAccessRecords) - 1; i >= 0 && len(records) < count; i-- {
+		record := recentAccessRecords[i]
+		if query.Email != "" && record.Email != query.Email {
+			continue
+		}
+		if query.IP != "" && record.SourceIP != query.IP {
+			continue
+		}
+		if query.Destination != "" && !strings.Contains(record.Destination, query.Destination) {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records
+}
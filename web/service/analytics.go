@@ -0,0 +1,222 @@
+package service
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/xray"
+
+	"golang.org/x/net/publicsuffix"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type clientAccessKey struct {
+	email       string
+	hour        int64
+	destination string
+	outboundTag string
+}
+
+// pendingAccessStats holds the counts collected from the access log that
+// have not been written to the database yet.
+var (
+	pendingAccessStatsLock sync.Mutex
+	pendingAccessStats     = make(map[clientAccessKey]int64)
+)
+
+type DestinationStat struct {
+	Destination string `json:"destination"`
+	Count       int64  `json:"count"`
+}
+
+type OutboundStat struct {
+	OutboundTag string `json:"outboundTag"`
+	Count       int64  `json:"count"`
+}
+
+type ClientAnalytics struct {
+	Email        string            `json:"email"`
+	Since        int64             `json:"since"`
+	Destinations []DestinationStat `json:"destinations"`
+	Outbounds    []OutboundStat    `json:"outbounds"`
+	Hours        [24]int64         `json:"hours"`
+}
+
+// AnalyticsService aggregates the access log into per client connection
+// counts by destination, outbound and hour.
+type AnalyticsService struct {
+	settingService SettingService
+}
+
+// Collect is the access log consumer of the analytics.
+func (s *AnalyticsService) Collect(records []*xray.AccessRecord) {
+	enable, err := s.settingService.GetAnalyticsEnable()
+	if err != nil || !enable {
+		return
+	}
+	anonymize, _ := s.settingService.GetAnalyticsAnonymize()
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		loc = time.Local
+	}
+
+	pendingAccessStatsLock.Lock()
+	defer pendingAccessStatsLock.Unlock()
+	for _, record := range records {
+		if !record.Accepted || record.Email == "" || record.Destination == "" {
+			continue
+		}
+		key := clientAccessKey{
+			email:       record.Email,
+			hour:        truncateHour(record.Time, loc).UnixMilli(),
+			destination: normalizeDestination(record.Destination, anonymize),
+			outboundTag: record.OutboundTag,
+		}
+		pendingAccessStats[key]++
+	}
+}
+
+// truncateHour returns the start of the hour of t in loc. Truncating the
+// time itself would be off in zones whose offset is not whole hours.
+func truncateHour(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+}
+
+// normalizeDestination drops the port of a destination. Anonymized, only the
+// registered domain or the network of an IP is kept.
+func normalizeDestination(destination string, anonymize bool) string {
+	host, _, err := net.SplitHostPort(destination)
+	if err != nil {
+		host = strings.Trim(destination, "[]")
+	}
+	host = strings.ToLower(host)
+	if !anonymize {
+		return host
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+		}
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+	}
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
+	}
+	return host
+}
+
+// Flush writes the collected counts to the database.
+func (s *AnalyticsService) Flush() error {
+	pendingAccessStatsLock.Lock()
+	pending := pendingAccessStats
+	pendingAccessStats = make(map[clientAccessKey]int64)
+	pendingAccessStatsLock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	stats := make([]*model.ClientAccessStat, 0, len(pending))
+	for key, count := range pending {
+		stats = append(stats, &model.ClientAccessStat{
+			Email:       key.email,
+			Hour:        key.hour,
+			Destination: key.destination,
+			OutboundTag: key.outboundTag,
+			Count:       count,
+		})
+	}
+	db := database.GetDB()
+	return db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "email"}, {Name: "hour"}, {Name: "destination"}, {Name: "outbound_tag"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"count": gorm.Expr("client_access_stats.count + excluded.count"),
+		}),
+	}).CreateInBatches(stats, 100).Error
+}
+
+// Prune removes the counts older than the retention.
+func (s *AnalyticsService) Prune() error {
+	days, err := s.settingService.GetAnalyticsRetentionDays()
+	if err != nil || days <= 0 {
+		return err
+	}
+	since := time.Now().AddDate(0, 0, -days).UnixMilli()
+	db := database.GetDB()
+	return db.Where("hour < ?", since).Delete(model.ClientAccessStat{}).Error
+}
+
+// GetClientAnalytics sums the counts of a client over the last days. A
+// non-positive count or days falls back to 10 destinations and the whole
+// retention.
+func (s *AnalyticsService) GetClientAnalytics(email string, days int, count int) (*ClientAnalytics, error) {
+	if days <= 0 {
+		days, _ = s.settingService.GetAnalyticsRetentionDays()
+	}
+	if count <= 0 {
+		count = 10
+	}
+	loc, err := s.settingService.GetTimeLocation()
+	if err != nil {
+		loc = time.Local
+	}
+	analytics := &ClientAnalytics{
+		Email: email,
+		Since: truncateHour(time.Now().AddDate(0, 0, -days), loc).UnixMilli(),
+	}
+
+	db := database.GetDB()
+	query := db.Model(model.ClientAccessStat{}).Where("email = ? AND hour >= ?", email, analytics.Since)
+	err = query.Session(&gorm.Session{}).
+		Select("destination, sum(count) AS count").
+		Group("destination").
+		Order("count DESC").
+		Limit(count).
+		Scan(&analytics.Destinations).Error
+	if err != nil {
+		return nil, err
+	}
+	err = query.Session(&gorm.Session{}).
+		Select("outbound_tag, sum(count) AS count").
+		Group("outbound_tag").
+		Order("count DESC").
+		Scan(&analytics.Outbounds).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var hours []struct {
+		Hour  int64
+		Count int64
+	}
+	err = query.Session(&gorm.Session{}).
+		Select("hour, sum(count) AS count").
+		Group("hour").
+		Scan(&hours).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, hour := range hours {
+		analytics.Hours[time.UnixMilli(hour.Hour).In(loc).Hour()] += hour.Count
+	}
+	return analytics, nil
+}
+
+// GetTopDestinations returns the names of the most used destinations of a
+// client, most used first.
+func (s *AnalyticsService) GetTopDestinations(email string, count int) ([]string, error) {
+	analytics, err := s.GetClientAnalytics(email, 0, count)
+	if err != nil {
+		return nil, err
+	}
+	destinations := make([]string, 0, len(analytics.Destinations))
+	for _, destination := range analytics.Destinations {
+		destinations = append(destinations, destination.Destination)
+	}
+	return destinations, nil
+}
@@ -1,8 +1,12 @@
 package service
 
 import (
+	"encoding/json"
+
 	"x-ui/database"
 	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/xray"
 )
 
 type BlockedDomainService struct{}
@@ -24,6 +28,26 @@ func (s *BlockedDomainService) GetByID(id int) (*model.BlockedDomain, error) {
 	return &domain, nil
 }
 
+// Validate checks that the domain can be used in the routing rule that
+// blocks it, so a bad entry never reaches the xray config.
+func (s *BlockedDomainService) Validate(domain *model.BlockedDomain) error {
+	if domain.Domain == "" {
+		return common.NewError("domain is empty")
+	}
+	rule, err := json.Marshal(map[string]any{
+		"type":        "field",
+		"outboundTag": "blocked",
+		"domain":      []string{domain.Domain},
+	})
+	if err != nil {
+		return err
+	}
+	if err := xray.ValidateRoutingRule(rule); err != nil {
+		return common.NewErrorf("invalid domain %v: %v", domain.Domain, err)
+	}
+	return nil
+}
+
 func (s *BlockedDomainService) Create(domain *model.BlockedDomain) error {
 	db := database.GetDB()
 	return db.Create(domain).Error
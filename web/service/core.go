@@ -0,0 +1,58 @@
+package service
+
+import (
+	"errors"
+	"sync"
+
+	"x-ui/core"
+	"x-ui/logger"
+	"x-ui/singbox"
+	"x-ui/xray"
+)
+
+// singboxStatsWarning tells once that sing-box counts no traffic, rather than
+// every time the traffic is collected.
+var singboxStatsWarning sync.Once
+
+// CoreService reaches the running cores through core.Backend, whichever of
+// them serves an inbound.
+type CoreService struct{}
+
+// GetRunningBackends returns the cores that are running.
+func (s *CoreService) GetRunningBackends() []core.Backend {
+	var backends []core.Backend
+	if p != nil && p.IsRunning() {
+		backends = append(backends, p)
+	}
+	if sb != nil && sb.IsRunning() {
+		backends = append(backends, sb)
+	}
+	return backends
+}
+
+// GetTraffic collects and resets the traffic counted by the running cores.
+// A core failing to report is skipped, unless it is xray, which counts the
+// traffic of most of the inbounds.
+func (s *CoreService) GetTraffic() ([]*xray.Traffic, []*xray.ClientTraffic, error) {
+	var traffics []*xray.Traffic
+	var clientTraffics []*xray.ClientTraffic
+	for _, backend := range s.GetRunningBackends() {
+		backendTraffics, backendClientTraffics, err := backend.GetTraffic(true)
+		if err != nil {
+			if backend.Name() == core.Xray {
+				return nil, nil, err
+			}
+			if errors.Is(err, singbox.ErrStatsUnavailable) {
+				singboxStatsWarning.Do(func() {
+					logger.Warning("sing-box counts no traffic, as it was built without the with_v2ray_api tag")
+				})
+				continue
+			}
+			logger.Warningf("get %v traffic failed: %v", backend.Name(), err)
+			continue
+		}
+		traffics = append(traffics, backendTraffics...)
+		clientTraffics = append(clientTraffics, backendClientTraffics...)
+	}
+	return traffics, clientTraffics, nil
+}
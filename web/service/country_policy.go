@@ -0,0 +1,118 @@
+package service
+
+import (
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"x-ui/config"
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/util/geoip"
+	"x-ui/xray"
+)
+
+var countryCodeRegex = regexp.MustCompile(`^[A-Z]{2}$`)
+
+var (
+	geoipReaderOnce sync.Once
+	geoipReader     *geoip.Reader
+)
+
+// LookupIP tells the country and network of an IP, from the MaxMind DB files
+// in the bin folder when present and from geoip.dat otherwise.
+func LookupIP(ip string) geoip.Info {
+	geoipReaderOnce.Do(func() {
+		binFolder := config.GetBinFolderPath()
+		geoipReader = geoip.NewReader(xray.GetGeoipPath(),
+			filepath.Join(binFolder, "GeoLite2-Country.mmdb"),
+			filepath.Join(binFolder, "GeoLite2-City.mmdb"),
+			filepath.Join(binFolder, "GeoLite2-ASN.mmdb"),
+		)
+	})
+	return geoipReader.Lookup(ip)
+}
+
+type CountryPolicyService struct{}
+
+func (s *CountryPolicyService) GetPolicies() ([]model.CountryPolicy, error) {
+	db := database.GetDB()
+	var policies []model.CountryPolicy
+	err := db.Order("id").Find(&policies).Error
+	return policies, err
+}
+
+func (s *CountryPolicyService) AddPolicy(policy *model.CountryPolicy) error {
+	if err := s.checkPolicy(policy); err != nil {
+		return err
+	}
+	policy.Id = 0
+	return database.GetDB().Create(policy).Error
+}
+
+func (s *CountryPolicyService) UpdatePolicy(policy *model.CountryPolicy) error {
+	if err := s.checkPolicy(policy); err != nil {
+		return err
+	}
+	return database.GetDB().Save(policy).Error
+}
+
+func (s *CountryPolicyService) DelPolicy(id int) error {
+	return database.GetDB().Delete(&model.CountryPolicy{}, id).Error
+}
+
+func (s *CountryPolicyService) checkPolicy(policy *model.CountryPolicy) error {
+	if policy.InboundId <= 0 && policy.Email == "" {
+		return common.NewError("a country policy needs an inbound or a client")
+	}
+	var countries []string
+	for _, country := range strings.Split(policy.AllowedCountries, ",") {
+		country = strings.ToUpper(strings.TrimSpace(country))
+		if country == "" {
+			continue
+		}
+		if !countryCodeRegex.MatchString(country) {
+			return common.NewError("invalid country code:", country)
+		}
+		countries = append(countries, country)
+	}
+	policy.AllowedCountries = strings.Join(countries, ",")
+	return nil
+}
+
+// GetClientPolicy returns the policy of a client, or of its inbound, or nil
+// when there is none.
+func (s *CountryPolicyService) GetClientPolicy(email string) (*model.CountryPolicy, error) {
+	db := database.GetDB()
+	var policies []model.CountryPolicy
+	err := db.Where("email = ?", email).Limit(1).Find(&policies).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(policies) > 0 {
+		return &policies[0], nil
+	}
+
+	var traffics []xray.ClientTraffic
+	err = db.Model(xray.ClientTraffic{}).Where("email = ?", email).Limit(1).Find(&traffics).Error
+	if err != nil || len(traffics) == 0 {
+		return nil, err
+	}
+	err = db.Where("inbound_id = ? AND email = ''", traffics[0].InboundId).Limit(1).Find(&policies).Error
+	if err != nil || len(policies) == 0 {
+		return nil, err
+	}
+	return &policies[0], nil
+}
+
+// IsCountryAllowed tells whether the policy lets clients connect from the
+// country. IPs of unknown country are let through.
+func IsCountryAllowed(policy *model.CountryPolicy, country string) bool {
+	if policy == nil || policy.AllowedCountries == "" || country == "" {
+		return true
+	}
+	return slices.Contains(strings.Split(policy.AllowedCountries, ","), country)
+}
@@ -0,0 +1,439 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/config"
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/util/geoip"
+
+	"github.com/robfig/cron/v3"
+	"github.com/xtls/xray-core/app/router"
+	"google.golang.org/protobuf/proto"
+)
+
+// builtinGeofiles are the geo files the panel can always update. Each is
+// verified against the .sha256sum published next to it.
+var builtinGeofiles = []struct {
+	URL      string
+	FileName string
+}{
+	{"https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geoip.dat", "geoip.dat"},
+	{"https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geosite.dat", "geosite.dat"},
+	{"https://github.com/chocolate4u/Iran-v2ray-rules/releases/latest/download/geoip.dat", "geoip_IR.dat"},
+	{"https://github.com/chocolate4u/Iran-v2ray-rules/releases/latest/download/geosite.dat", "geosite_IR.dat"},
+	{"https://github.com/runetfreedom/russia-v2ray-rules-dat/releases/latest/download/geoip.dat", "geoip_RU.dat"},
+	{"https://github.com/runetfreedom/russia-v2ray-rules-dat/releases/latest/download/geosite.dat", "geosite_RU.dat"},
+}
+
+var (
+	geofileNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_\-.]+\.(dat|mmdb)$`)
+	sha256Regex      = regexp.MustCompile(`(?i)\b[0-9a-f]{64}\b`)
+	geoSpecParser    = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+)
+
+// geofileCategories caches the categories found in a geo file, so listing
+// does not parse unchanged files again.
+var (
+	geofileCategoriesLock sync.Mutex
+	geofileCategories     = make(map[string]geofileCategoriesEntry)
+)
+
+type geofileCategoriesEntry struct {
+	modTime    int64
+	size       int64
+	categories []string
+}
+
+type GeofileInfo struct {
+	FileName   string   `json:"fileName"`
+	Type       string   `json:"type"`
+	Size       int64    `json:"size"`
+	ModTime    int64    `json:"modTime"`
+	Builtin    bool     `json:"builtin"`
+	SourceId   int      `json:"sourceId"`
+	Categories []string `json:"categories"`
+	Error      string   `json:"error,omitempty"`
+}
+
+type GeoService struct {
+	xrayService XrayService
+}
+
+func (s *GeoService) GetSources() ([]model.GeoSource, error) {
+	db := database.GetDB()
+	var sources []model.GeoSource
+	err := db.Order("id").Find(&sources).Error
+	return sources, err
+}
+
+func (s *GeoService) GetSource(id int) (*model.GeoSource, error) {
+	db := database.GetDB()
+	source := &model.GeoSource{}
+	err := db.First(source, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return source, nil
+}
+
+func (s *GeoService) AddSource(source *model.GeoSource) error {
+	if err := s.checkSource(source); err != nil {
+		return err
+	}
+	source.Id = 0
+	source.LastUpdate = 0
+	source.LastError = ""
+	return database.GetDB().Create(source).Error
+}
+
+func (s *GeoService) UpdateSource(source *model.GeoSource) error {
+	if err := s.checkSource(source); err != nil {
+		return err
+	}
+	oldSource, err := s.GetSource(source.Id)
+	if err != nil {
+		return err
+	}
+	source.LastUpdate = oldSource.LastUpdate
+	source.LastError = oldSource.LastError
+	return database.GetDB().Save(source).Error
+}
+
+// DelSource forgets the source. The file is kept, as routing rules may still
+// refer to it.
+func (s *GeoService) DelSource(id int) error {
+	return database.GetDB().Delete(&model.GeoSource{}, id).Error
+}
+
+func (s *GeoService) checkSource(source *model.GeoSource) error {
+	if !geofileNameRegex.MatchString(source.FileName) {
+		return common.NewError("invalid file name:", source.FileName)
+	}
+	for _, file := range builtinGeofiles {
+		if file.FileName == source.FileName {
+			return common.NewErrorf("%v is a built-in geo file", source.FileName)
+		}
+	}
+	if !strings.HasPrefix(source.URL, "https://") && !strings.HasPrefix(source.URL, "http://") {
+		return common.NewError("invalid url:", source.URL)
+	}
+	if source.ChecksumURL != "" && !strings.HasPrefix(source.ChecksumURL, "https://") && !strings.HasPrefix(source.ChecksumURL, "http://") {
+		return common.NewError("invalid checksum url:", source.ChecksumURL)
+	}
+	source.Sha256 = strings.ToLower(strings.TrimSpace(source.Sha256))
+	if source.Sha256 != "" && !sha256Regex.MatchString(source.Sha256) {
+		return common.NewError("invalid sha256:", source.Sha256)
+	}
+	if source.Spec != "" {
+		if _, err := geoSpecParser.Parse(source.Spec); err != nil {
+			return common.NewErrorf("invalid schedule <%v>: %v", source.Spec, err)
+		}
+	}
+	return nil
+}
+
+// RefreshSource downloads the file of a source and reloads xray.
+func (s *GeoService) RefreshSource(id int) error {
+	source, err := s.GetSource(id)
+	if err != nil {
+		return err
+	}
+	err = s.refreshSource(source)
+	if err != nil {
+		return err
+	}
+	return s.restartXray()
+}
+
+// RefreshDueSources updates the enabled sources whose schedule is due, and
+// reloads xray once if any file has changed.
+func (s *GeoService) RefreshDueSources() error {
+	sources, err := s.GetSources()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	updated := false
+	var errs []error
+	for i := range sources {
+		source := &sources[i]
+		if !source.Enable || source.Spec == "" {
+			continue
+		}
+		schedule, err := geoSpecParser.Parse(source.Spec)
+		if err != nil {
+			continue
+		}
+		if source.LastUpdate > 0 && schedule.Next(time.UnixMilli(source.LastUpdate)).After(now) {
+			continue
+		}
+		if err := s.refreshSource(source); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		updated = true
+	}
+	if updated {
+		errs = append(errs, s.restartXray())
+	}
+	return common.Combine(errs...)
+}
+
+// refreshSource downloads the file of a source. Only a successful download
+// counts as an update, so that a failed one is retried on the next run.
+func (s *GeoService) refreshSource(source *model.GeoSource) error {
+	err := downloadGeofile(source.URL, source.FileName, source.Sha256, source.ChecksumURL)
+	source.LastError = ""
+	if err != nil {
+		source.LastError = err.Error()
+		logger.Warningf("Failed to update geo file %v: %v", source.FileName, err)
+	} else {
+		source.LastUpdate = time.Now().UnixMilli()
+	}
+	dbErr := database.GetDB().Model(source).Updates(map[string]any{
+		"last_update": source.LastUpdate,
+		"last_error":  source.LastError,
+	}).Error
+	return common.Combine(err, dbErr)
+}
+
+// UpdateGeofile updates a built-in or custom geo file by name.
+func (s *GeoService) UpdateGeofile(fileName string) error {
+	for _, file := range builtinGeofiles {
+		if file.FileName == fileName {
+			if err := downloadGeofile(file.URL, file.FileName, "", file.URL+".sha256sum"); err != nil {
+				return common.NewErrorf("Error downloading Geofile '%s': %v", fileName, err)
+			}
+			return s.restartXray()
+		}
+	}
+
+	source := &model.GeoSource{}
+	err := database.GetDB().Where("file_name = ?", fileName).First(source).Error
+	if err != nil {
+		return common.NewErrorf("File '%s' not found in the list of Geofiles", fileName)
+	}
+	if err := s.refreshSource(source); err != nil {
+		return common.NewErrorf("Error downloading Geofile '%s': %v", fileName, err)
+	}
+	return s.restartXray()
+}
+
+func (s *GeoService) restartXray() error {
+	s.xrayService.StopXray()
+	err := s.xrayService.RestartXray(true)
+	if err != nil {
+		return common.NewErrorf("Updated Geofile but Failed to start Xray: %v", err)
+	}
+	return nil
+}
+
+// GetGeofiles lists the geo files installed in the bin folder.
+func (s *GeoService) GetGeofiles() ([]GeofileInfo, error) {
+	entries, err := os.ReadDir(config.GetBinFolderPath())
+	if err != nil {
+		return nil, err
+	}
+	sources, err := s.GetSources()
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]GeofileInfo, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !geofileNameRegex.MatchString(entry.Name()) {
+			continue
+		}
+		stat, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		info := GeofileInfo{
+			FileName: entry.Name(),
+			Type:     geofileType(entry.Name()),
+			Size:     stat.Size(),
+			ModTime:  stat.ModTime().UnixMilli(),
+		}
+		for _, file := range builtinGeofiles {
+			if file.FileName == info.FileName {
+				info.Builtin = true
+			}
+		}
+		for _, source := range sources {
+			if source.FileName == info.FileName {
+				info.SourceId = source.Id
+			}
+		}
+		info.Categories, err = getGeofileCategories(filepath.Join(config.GetBinFolderPath(), entry.Name()), stat)
+		if err != nil {
+			info.Error = err.Error()
+		}
+		files = append(files, info)
+	}
+	return files, nil
+}
+
+func geofileType(fileName string) string {
+	switch {
+	case strings.HasSuffix(fileName, ".mmdb"):
+		return "mmdb"
+	case strings.Contains(fileName, "geoip"):
+		return "geoip"
+	case strings.Contains(fileName, "geosite"):
+		return "geosite"
+	}
+	return "unknown"
+}
+
+func getGeofileCategories(path string, stat os.FileInfo) ([]string, error) {
+	geofileCategoriesLock.Lock()
+	entry, ok := geofileCategories[path]
+	geofileCategoriesLock.Unlock()
+	if ok && entry.modTime == stat.ModTime().UnixMilli() && entry.size == stat.Size() {
+		return entry.categories, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	categories, err := parseGeofile(filepath.Base(path), data)
+	if err != nil {
+		return nil, err
+	}
+
+	geofileCategoriesLock.Lock()
+	geofileCategories[path] = geofileCategoriesEntry{
+		modTime:    stat.ModTime().UnixMilli(),
+		size:       stat.Size(),
+		categories: categories,
+	}
+	geofileCategoriesLock.Unlock()
+	return categories, nil
+}
+
+// parseGeofile decodes a geo file and returns its categories. A file that
+// does not decode, or holds nothing, is not a usable geo file.
+func parseGeofile(fileName string, data []byte) ([]string, error) {
+	var categories []string
+	switch geofileType(fileName) {
+	case "mmdb":
+		db, err := geoip.OpenMMDB(data)
+		if err != nil {
+			return nil, common.NewErrorf("invalid MaxMind DB file: %v", err)
+		}
+		categories = append(categories, db.DatabaseType)
+	case "geoip":
+		list := &router.GeoIPList{}
+		if err := proto.Unmarshal(data, list); err != nil {
+			return nil, common.NewErrorf("invalid geoip file: %v", err)
+		}
+		for _, entry := range list.Entry {
+			categories = append(categories, strings.ToLower(entry.CountryCode))
+		}
+	default:
+		list := &router.GeoSiteList{}
+		if err := proto.Unmarshal(data, list); err != nil {
+			return nil, common.NewErrorf("invalid geosite file: %v", err)
+		}
+		for _, entry := range list.Entry {
+			categories = append(categories, strings.ToLower(entry.CountryCode))
+		}
+	}
+	if len(categories) == 0 {
+		return nil, common.NewError("geo file has no categories")
+	}
+	sort.Strings(categories)
+	return categories, nil
+}
+
+// downloadGeofile fetches a geo file next to its destination, verifies it
+// and then atomically replaces the installed file.
+func downloadGeofile(url string, fileName string, expectedSha256 string, checksumURL string) error {
+	if !geofileNameRegex.MatchString(fileName) {
+		return common.NewError("invalid file name:", fileName)
+	}
+	destPath := filepath.Join(config.GetBinFolderPath(), fileName)
+	tmpPath := destPath + ".tmp"
+	defer os.Remove(tmpPath)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return common.NewErrorf("Failed to download Geofile from %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return common.NewErrorf("Failed to download Geofile from %s: %v", url, resp.Status)
+	}
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return common.NewErrorf("Failed to create Geofile %s: %v", tmpPath, err)
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), resp.Body)
+	err = common.Combine(err, file.Close())
+	if err != nil {
+		return common.NewErrorf("Failed to save Geofile %s: %v", tmpPath, err)
+	}
+
+	if checksumURL != "" && expectedSha256 == "" {
+		expectedSha256, err = fetchSha256(checksumURL)
+		if err != nil {
+			return err
+		}
+	}
+	if expectedSha256 != "" {
+		actual := hex.EncodeToString(hash.Sum(nil))
+		if actual != strings.ToLower(expectedSha256) {
+			return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", fileName, expectedSha256, actual)
+		}
+	}
+
+	data, err := os.ReadFile(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := parseGeofile(fileName, data); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, destPath)
+}
+
+// fetchSha256 reads a checksum file, such as a .sha256sum, and returns the
+// first SHA256 it contains.
+func fetchSha256(url string) (string, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", common.NewErrorf("Failed to download checksum from %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", common.NewErrorf("Failed to download checksum from %s: %v", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return "", err
+	}
+	sum := sha256Regex.FindString(string(data))
+	if sum == "" {
+		return "", common.NewError("no sha256 found at", url)
+	}
+	return strings.ToLower(sum), nil
+}
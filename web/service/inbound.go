@@ -3,20 +3,28 @@ package service
 import (
 	"encoding/json"
 	"fmt"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"x-ui/core"
 	"x-ui/database"
 	"x-ui/database/model"
 	"x-ui/logger"
+	"x-ui/singbox"
 	"x-ui/util/common"
 	"x-ui/xray"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// clientSessionTimeout is how long (in milliseconds) a client may stay idle
+// before its current session is considered finished.
+const clientSessionTimeout = 60 * 1000
+
 type InboundService struct {
 	xrayApi xray.XrayAPI
 }
@@ -192,6 +200,11 @@ func (s *InboundService) AddInbound(inbound *model.Inbound) (*model.Inbound, boo
 		}
 	}
 
+	err = s.validateInbound(inbound)
+	if err != nil {
+		return inbound, false, err
+	}
+
 	db := database.GetDB()
 	tx := db.Begin()
 	defer func() {
@@ -254,11 +267,15 @@ func (s *InboundService) DelInbound(id int) (bool, error) {
 		logger.Debug("No enabled inbound founded to removing by api", tag)
 	}
 
-	// Delete client traffics of inbounds
+	// Delete client traffics and sessions of inbounds
 	err := db.Where("inbound_id = ?", id).Delete(xray.ClientTraffic{}).Error
 	if err != nil {
 		return false, err
 	}
+	err = db.Where("inbound_id = ?", id).Delete(model.ClientSession{}).Error
+	if err != nil {
+		return false, err
+	}
 	inbound, err := s.GetInbound(id)
 	if err != nil {
 		return false, err
@@ -272,11 +289,24 @@ func (s *InboundService) DelInbound(id int) (bool, error) {
 		if err != nil {
 			return false, err
 		}
+		err = db.Where("email = ?", client.Email).Delete(model.ClientAccessStat{}).Error
+		if err != nil {
+			return false, err
+		}
 	}
 
 	return needRestart, db.Delete(model.Inbound{}, id).Error
 }
 
+// validateInbound checks the inbound with the core that is going to serve it.
+func (s *InboundService) validateInbound(inbound *model.Inbound) error {
+	if core.BackendOf(string(inbound.Protocol)) == core.Singbox {
+		_, err := singbox.NewInbound(string(inbound.Protocol), inbound.Tag, inbound.Listen, inbound.Port, inbound.Settings, inbound.StreamSettings)
+		return err
+	}
+	return xray.ValidateInbound(inbound.GenXrayInboundConfig())
+}
+
 func (s *InboundService) GetInbound(id int) (*model.Inbound, error) {
 	db := database.GetDB()
 	inbound := &model.Inbound{}
@@ -338,6 +368,11 @@ func (s *InboundService) UpdateInbound(inbound *model.Inbound) (*model.Inbound,
 		oldInbound.Tag = fmt.Sprintf("inbound-%v:%v", inbound.Listen, inbound.Port)
 	}
 
+	err = s.validateInbound(oldInbound)
+	if err != nil {
+		return inbound, false, err
+	}
+
 	needRestart := false
 	s.xrayApi.Init(p.GetAPIPort())
 	if s.xrayApi.DelInbound(tag) == nil {
@@ -469,6 +504,11 @@ func (s *InboundService) AddInboundClient(data *model.Inbound) (bool, error) {
 
 	oldInbound.Settings = string(newSettings)
 
+	err = s.validateInbound(oldInbound)
+	if err != nil {
+		return false, err
+	}
+
 	db := database.GetDB()
 	tx := db.Begin()
 
@@ -678,6 +718,12 @@ func (s *InboundService) UpdateInboundClient(data *model.Inbound, clientId strin
 	}
 
 	oldInbound.Settings = string(newSettings)
+
+	err = s.validateInbound(oldInbound)
+	if err != nil {
+		return false, err
+	}
+
 	db := database.GetDB()
 	tx := db.Begin()
 
@@ -832,6 +878,8 @@ func (s *InboundService) addClientTraffic(tx *gorm.DB, traffics []*xray.ClientTr
 	}
 
 	var onlineClients []string
+	var activeTraffics []*xray.ClientTraffic
+	now := time.Now().Unix() * 1000
 
 	emails := make([]string, 0, len(traffics))
 	for _, traffic := range traffics {
@@ -862,6 +910,13 @@ func (s *InboundService) addClientTraffic(tx *gorm.DB, traffics []*xray.ClientTr
 				// Add user in onlineUsers array on traffic
 				if traffics[traffic_index].Up+traffics[traffic_index].Down > 0 {
 					onlineClients = append(onlineClients, traffics[traffic_index].Email)
+					dbClientTraffics[dbTraffic_index].LastOnline = now
+					activeTraffics = append(activeTraffics, &xray.ClientTraffic{
+						InboundId: dbClientTraffics[dbTraffic_index].InboundId,
+						Email:     traffics[traffic_index].Email,
+						Up:        traffics[traffic_index].Up,
+						Down:      traffics[traffic_index].Down,
+					})
 				}
 				break
 			}
@@ -876,9 +931,60 @@ func (s *InboundService) addClientTraffic(tx *gorm.DB, traffics []*xray.ClientTr
 		logger.Warning("AddClientTraffic update data ", err)
 	}
 
+	err = s.updateClientSessions(tx, activeTraffics, now)
+	if err != nil {
+		logger.Warning("AddClientTraffic update sessions ", err)
+	}
+
 	return nil
 }
 
+// updateClientSessions extends the open session of every active client with
+// the traffic of the last poll, or starts a new session if the previous one
+// has been idle for longer than clientSessionTimeout.
+func (s *InboundService) updateClientSessions(tx *gorm.DB, traffics []*xray.ClientTraffic, now int64) error {
+	if len(traffics) == 0 {
+		return nil
+	}
+
+	emails := make([]string, 0, len(traffics))
+	for _, traffic := range traffics {
+		emails = append(emails, traffic.Email)
+	}
+
+	var openSessions []*model.ClientSession
+	err := tx.Model(model.ClientSession{}).
+		Where("email IN (?) AND end_time >= ?", emails, now-clientSessionTimeout).
+		Order("end_time asc").
+		Find(&openSessions).Error
+	if err != nil {
+		return err
+	}
+
+	sessionsByEmail := make(map[string]*model.ClientSession, len(openSessions))
+	for _, session := range openSessions {
+		sessionsByEmail[session.Email] = session
+	}
+
+	sessions := make([]*model.ClientSession, 0, len(traffics))
+	for _, traffic := range traffics {
+		session, ok := sessionsByEmail[traffic.Email]
+		if !ok {
+			session = &model.ClientSession{
+				Email:     traffic.Email,
+				InboundId: traffic.InboundId,
+				StartTime: now,
+			}
+		}
+		session.EndTime = now
+		session.Up += traffic.Up
+		session.Down += traffic.Down
+		sessions = append(sessions, session)
+	}
+
+	return tx.Save(sessions).Error
+}
+
 func (s *InboundService) adjustTraffics(tx *gorm.DB, dbClientTraffics []*xray.ClientTraffic) ([]*xray.ClientTraffic, error) {
 	inboundIds := make([]int, 0, len(dbClientTraffics))
 	for _, dbClientTraffic := range dbClientTraffics {
@@ -1156,19 +1262,50 @@ func (s *InboundService) UpdateClientStat(tx *gorm.DB, email string, client *mod
 			"reset":       client.Reset,
 		})
 	err := result.Error
-	return err
+	if err != nil {
+		return err
+	}
+	err = tx.Model(model.ClientSession{}).Where("email = ?", email).Update("email", client.Email).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Model(model.ClientAccessStat{}).Where("email = ?", email).Update("email", client.Email).Error
+	if err != nil {
+		return err
+	}
+	return tx.Model(model.AbuseEvent{}).Where("email = ?", email).Update("email", client.Email).Error
 }
 
 func (s *InboundService) UpdateClientIPs(tx *gorm.DB, oldEmail string, newEmail string) error {
-	return tx.Model(model.InboundClientIps{}).Where("client_email = ?", oldEmail).Update("client_email", newEmail).Error
+	err := tx.Model(model.InboundClientIps{}).Where("client_email = ?", oldEmail).Update("client_email", newEmail).Error
+	if err != nil {
+		return err
+	}
+	return tx.Model(model.ClientIpHistory{}).Where("email = ?", oldEmail).Update("email", newEmail).Error
 }
 
 func (s *InboundService) DelClientStat(tx *gorm.DB, email string) error {
+	err := tx.Where("email = ?", email).Delete(model.ClientSession{}).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Where("email = ?", email).Delete(model.AbuseEvent{}).Error
+	if err != nil {
+		return err
+	}
+	err = tx.Where("email = ?", email).Delete(model.ClientAccessStat{}).Error
+	if err != nil {
+		return err
+	}
 	return tx.Where("email = ?", email).Delete(xray.ClientTraffic{}).Error
 }
 
 func (s *InboundService) DelClientIPs(tx *gorm.DB, email string) error {
-	return tx.Where("client_email = ?", email).Delete(model.InboundClientIps{}).Error
+	err := tx.Where("client_email = ?", email).Delete(model.InboundClientIps{}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Where("email = ?", email).Delete(model.ClientIpHistory{}).Error
 }
 
 func (s *InboundService) GetClientInboundByTrafficID(trafficId int) (traffic *xray.ClientTraffic, inbound *model.Inbound, err error) {
@@ -1653,6 +1790,30 @@ func (s *InboundService) ResetAllTraffics() error {
 }
 
 func (s *InboundService) DelDepletedClients(id int) (err error) {
+	_, err = s.delClientsWhere(id, false, "reset = 0 and enable = ?", false)
+	return err
+}
+
+// inactiveClientsCondition matches the clients not online since a cutoff.
+// Clients never seen online count from when they were created, and those
+// older than the creation time itself from when it was first recorded.
+const inactiveClientsCondition = "((last_online > 0 and last_online < ?) or (last_online = 0 and created_at < ?))"
+
+// DelInactiveClients removes the clients of the given inbound (or of all
+// inbounds if id is negative) that have not been online for the given number
+// of days. Inbounds are kept, even when no client remains.
+func (s *InboundService) DelInactiveClients(id int, days int) (bool, error) {
+	if days <= 0 {
+		return false, common.NewError("invalid number of days:", days)
+	}
+	cutoff := time.Now().AddDate(0, 0, -days).UnixMilli()
+	return s.delClientsWhere(id, true, inactiveClientsCondition, cutoff, cutoff)
+}
+
+// delClientsWhere removes every client whose traffic row matches the given
+// condition from the settings of its inbound, together with its stats. An
+// inbound left without clients is deleted, unless keepInbounds is set.
+func (s *InboundService) delClientsWhere(id int, keepInbounds bool, condition string, args ...any) (needRestart bool, err error) {
 	db := database.GetDB()
 	tx := db.Begin()
 	defer func() {
@@ -1663,71 +1824,111 @@ func (s *InboundService) DelDepletedClients(id int) (err error) {
 		}
 	}()
 
-	whereText := "reset = 0 and inbound_id "
+	whereText := "inbound_id "
 	if id < 0 {
 		whereText += "> ?"
 	} else {
 		whereText += "= ?"
 	}
+	whereText += " and " + condition
+	whereArgs := append([]any{id}, args...)
 
-	depletedClients := []xray.ClientTraffic{}
-	err = db.Model(xray.ClientTraffic{}).Where(whereText+" and enable = ?", id, false).Select("inbound_id, GROUP_CONCAT(email) as email").Group("inbound_id").Find(&depletedClients).Error
+	var traffics []xray.ClientTraffic
+	err = db.Model(xray.ClientTraffic{}).Where(whereText, whereArgs...).Find(&traffics).Error
 	if err != nil {
-		return err
+		return false, err
+	}
+	if len(traffics) == 0 {
+		return false, nil
+	}
+
+	trafficsByInbound := make(map[int][]xray.ClientTraffic)
+	emails := make([]string, 0, len(traffics))
+	for _, traffic := range traffics {
+		trafficsByInbound[traffic.InboundId] = append(trafficsByInbound[traffic.InboundId], traffic)
+		emails = append(emails, traffic.Email)
 	}
 
-	for _, depletedClient := range depletedClients {
-		emails := strings.Split(depletedClient.Email, ",")
-		oldInbound, err := s.GetInbound(depletedClient.InboundId)
+	for inboundId, inboundTraffics := range trafficsByInbound {
+		oldInbound, err := s.GetInbound(inboundId)
 		if err != nil {
-			return err
+			return false, err
 		}
 		var oldSettings map[string]any
 		err = json.Unmarshal([]byte(oldInbound.Settings), &oldSettings)
 		if err != nil {
-			return err
+			return false, err
 		}
 
 		oldClients := oldSettings["clients"].([]any)
 		var newClients []any
 		for _, client := range oldClients {
-			deplete := false
+			remove := false
 			c := client.(map[string]any)
-			for _, email := range emails {
-				if email == c["email"].(string) {
-					deplete = true
+			for _, traffic := range inboundTraffics {
+				if traffic.Email == c["email"].(string) {
+					remove = true
 					break
 				}
 			}
-			if !deplete {
+			if !remove {
 				newClients = append(newClients, client)
 			}
 		}
-		if len(newClients) > 0 {
+		if len(newClients) > 0 || keepInbounds {
+			if newClients == nil {
+				newClients = []any{}
+			}
 			oldSettings["clients"] = newClients
 
 			newSettings, err := json.MarshalIndent(oldSettings, "", "  ")
 			if err != nil {
-				return err
+				return false, err
 			}
 
 			oldInbound.Settings = string(newSettings)
 			err = tx.Save(oldInbound).Error
 			if err != nil {
-				return err
+				return false, err
+			}
+
+			if p != nil && oldInbound.Enable {
+				s.xrayApi.Init(p.GetAPIPort())
+				for _, traffic := range inboundTraffics {
+					if !traffic.Enable {
+						continue
+					}
+					err1 := s.xrayApi.RemoveUser(oldInbound.Tag, traffic.Email)
+					if err1 == nil {
+						logger.Debug("Client deleted by api:", traffic.Email)
+					} else if !strings.Contains(err1.Error(), fmt.Sprintf("User %s not found.", traffic.Email)) {
+						logger.Debug("Error in deleting client by api:", err1)
+						needRestart = true
+					}
+				}
+				s.xrayApi.Close()
 			}
 		} else {
 			// Delete inbound if no client remains
-			s.DelInbound(depletedClient.InboundId)
+			needRestart1, _ := s.DelInbound(inboundId)
+			needRestart = needRestart || needRestart1
 		}
 	}
 
-	err = tx.Where(whereText+" and enable = ?", id, false).Delete(xray.ClientTraffic{}).Error
+	err = tx.Where("email IN (?)", emails).Delete(model.ClientSession{}).Error
 	if err != nil {
-		return err
+		return false, err
+	}
+	err = tx.Where("email IN (?)", emails).Delete(model.ClientAccessStat{}).Error
+	if err != nil {
+		return false, err
+	}
+	err = tx.Where("email IN (?)", emails).Delete(xray.ClientTraffic{}).Error
+	if err != nil {
+		return false, err
 	}
 
-	return nil
+	return needRestart, nil
 }
 
 func (s *InboundService) GetClientTrafficTgBot(tgId int64) ([]*xray.ClientTraffic, error) {
@@ -1866,6 +2067,41 @@ func (s *InboundService) GetInboundClientIps(clientEmail string) (string, error)
 	return InboundClientIps.Ips, nil
 }
 
+// GetClientSessions returns the most recent sessions of a client, newest
+// first. A non-positive limit returns all of them.
+func (s *InboundService) GetClientSessions(clientEmail string, limit int) ([]model.ClientSession, error) {
+	db := database.GetDB()
+	var sessions []model.ClientSession
+	query := db.Model(model.ClientSession{}).Where("email = ?", clientEmail).Order("start_time desc")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	err := query.Find(&sessions).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// GetInactiveClients returns the traffics of clients that were not online
+// during the last given number of days, as DelInactiveClients tells them.
+func (s *InboundService) GetInactiveClients(days int) ([]xray.ClientTraffic, error) {
+	if days <= 0 {
+		return nil, common.NewError("invalid number of days:", days)
+	}
+	db := database.GetDB()
+	cutoff := time.Now().AddDate(0, 0, -days).UnixMilli()
+	var traffics []xray.ClientTraffic
+	err := db.Model(xray.ClientTraffic{}).
+		Where(inactiveClientsCondition, cutoff, cutoff).
+		Order("last_online asc").
+		Find(&traffics).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	return traffics, nil
+}
+
 func (s *InboundService) ClearClientIps(clientEmail string) error {
 	db := database.GetDB()
 
@@ -1876,7 +2112,82 @@ func (s *InboundService) ClearClientIps(clientEmail string) error {
 	if err != nil {
 		return err
 	}
-	return nil
+	return db.Where("email = ?", clientEmail).Delete(model.ClientIpHistory{}).Error
+}
+
+// UpdateClientIpHistory records when clients were seen from their IPs, given
+// as the last time in milliseconds per IP per client email, along with the
+// country and network of the IPs.
+func (s *InboundService) UpdateClientIpHistory(seen map[string]map[string]int64) error {
+	histories := make([]*model.ClientIpHistory, 0, len(seen))
+	for email, ips := range seen {
+		for ip, lastSeen := range ips {
+			info := LookupIP(ip)
+			histories = append(histories, &model.ClientIpHistory{
+				Email:     email,
+				IP:        ip,
+				FirstSeen: lastSeen,
+				LastSeen:  lastSeen,
+				Country:   info.Country,
+				ASN:       info.ASN,
+				ASOrg:     info.ASOrg,
+			})
+		}
+	}
+	if len(histories) == 0 {
+		return nil
+	}
+	db := database.GetDB()
+	return db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "email"}, {Name: "ip"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"last_seen": gorm.Expr("max(client_ip_histories.last_seen, excluded.last_seen)"),
+			"country":   gorm.Expr("excluded.country"),
+			"asn":       gorm.Expr("excluded.asn"),
+			"as_org":    gorm.Expr("excluded.as_org"),
+		}),
+	}).CreateInBatches(histories, 100).Error
+}
+
+// GetClientIpHistory returns the IPs a client has been seen from, most
+// recently seen first.
+func (s *InboundService) GetClientIpHistory(clientEmail string) ([]model.ClientIpHistory, error) {
+	db := database.GetDB()
+	var histories []model.ClientIpHistory
+	err := db.Model(model.ClientIpHistory{}).
+		Where("email = ?", clientEmail).
+		Order("last_seen desc").
+		Find(&histories).Error
+	return histories, err
+}
+
+// GetActiveClientIps returns the IPs a client has been seen from since the
+// given time, the first seen first.
+func (s *InboundService) GetActiveClientIps(clientEmail string, since int64) ([]string, error) {
+	db := database.GetDB()
+	var ips []string
+	err := db.Model(model.ClientIpHistory{}).
+		Where("email = ? AND last_seen >= ?", clientEmail, since).
+		Order("first_seen asc").
+		Pluck("ip", &ips).Error
+	return ips, err
+}
+
+// GetClientCountries returns the countries a client has been seen from.
+func (s *InboundService) GetClientCountries(clientEmail string) ([]string, error) {
+	db := database.GetDB()
+	var countries []string
+	err := db.Model(model.ClientIpHistory{}).
+		Where("email = ? AND country != ''", clientEmail).
+		Distinct("country").
+		Pluck("country", &countries).Error
+	return countries, err
+}
+
+// DelOldClientIpHistory forgets the IPs not seen since the given time.
+func (s *InboundService) DelOldClientIpHistory(before int64) error {
+	db := database.GetDB()
+	return db.Where("last_seen < ?", before).Delete(model.ClientIpHistory{}).Error
 }
 
 func (s *InboundService) SearchInbounds(query string) ([]*model.Inbound, error) {
@@ -2027,6 +2338,52 @@ func (s *InboundService) GetOnlineClients() []string {
 	return p.GetOnlineClients()
 }
 
+// GetOnlineClientIps returns the IPs of the online clients as told by xray,
+// or nil when xray cannot tell.
+func (s *InboundService) GetOnlineClientIps() map[string][]string {
+	if p == nil {
+		return nil
+	}
+	return p.GetOnlineClientIps()
+}
+
+// GetEnabledClientEmails returns the emails of the clients allowed to connect.
+func (s *InboundService) GetEnabledClientEmails() ([]string, error) {
+	db := database.GetDB()
+	var emails []string
+	err := db.Model(xray.ClientTraffic{}).Where("enable = ?", true).Pluck("email", &emails).Error
+	return emails, err
+}
+
+// SetOnlineClientIps marks the clients xray reports as connected as online,
+// on top of those found online by their traffic, and keeps their IPs for the
+// IP limit.
+func (s *InboundService) SetOnlineClientIps(onlineIps map[string][]string) error {
+	if p == nil {
+		return nil
+	}
+	p.SetOnlineClientIps(onlineIps)
+	if len(onlineIps) == 0 {
+		return nil
+	}
+
+	// the process keeps the slice it returns, so it is not appended to
+	onlineClients := slices.Clone(p.GetOnlineClients())
+	emails := make([]string, 0, len(onlineIps))
+	for email := range onlineIps {
+		emails = append(emails, email)
+		if !slices.Contains(onlineClients, email) {
+			onlineClients = append(onlineClients, email)
+		}
+	}
+	p.SetOnlineClients(onlineClients)
+
+	db := database.GetDB()
+	return db.Model(xray.ClientTraffic{}).
+		Where("email IN ?", emails).
+		Update("last_online", time.Now().UnixMilli()).Error
+}
+
 func (s *InboundService) FilterAndSortClientEmails(emails []string) ([]string, []string, error) {
 	db := database.GetDB()
 
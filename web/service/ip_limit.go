@@ -0,0 +1,278 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+	"x-ui/util/common"
+)
+
+// The ways a client going over its IP limit is dealt with. fail2ban only logs
+// the offending IPs for an externally installed fail2ban to ban them.
+const (
+	IpLimitModeFail2ban   = "fail2ban"
+	IpLimitModeRemoveUser = "removeUser"
+	IpLimitModeRouting    = "routing"
+	IpLimitModeNftables   = "nftables"
+)
+
+const (
+	ipLimitRuleTag  = "ip-limit"
+	ipLimitNftTable = "x_ui_iplimit"
+)
+
+// ipLimitNftScript recreates the table holding the bans. An IP is only
+// banned from the port of the inbound of the client, leaving the other
+// services of the host, such as SSH and the panel, reachable.
+var ipLimitNftScript = `table inet ` + ipLimitNftTable + `
+delete table inet ` + ipLimitNftTable + `
+table inet ` + ipLimitNftTable + ` {
+	set banned4 { type ipv4_addr . inet_service; flags timeout; }
+	set banned6 { type ipv6_addr . inet_service; flags timeout; }
+	chain input {
+		type filter hook input priority filter; policy accept;
+		meta l4proto { tcp, udp } ip saddr . th dport @banned4 drop
+		meta l4proto { tcp, udp } ip6 saddr . th dport @banned6 drop
+	}
+}
+`
+
+func IsIpLimitMode(mode string) bool {
+	switch mode {
+	case IpLimitModeFail2ban, IpLimitModeRemoveUser, IpLimitModeRouting, IpLimitModeNftables:
+		return true
+	}
+	return false
+}
+
+// IpLimitService bans clients over their IP limit from within the panel.
+// Bans are kept in the database and lifted once they expire.
+type IpLimitService struct {
+	xrayService    XrayService
+	inboundService InboundService
+	settingService SettingService
+}
+
+func (s *IpLimitService) GetMode() string {
+	mode, err := s.settingService.GetIpLimitMode()
+	if err != nil || !IsIpLimitMode(mode) {
+		return IpLimitModeFail2ban
+	}
+	return mode
+}
+
+func (s *IpLimitService) GetBans() ([]model.IpLimitBan, error) {
+	return getIpLimitBans("")
+}
+
+// getIpLimitBans returns the bans in effect, of the given mode if any.
+func getIpLimitBans(mode string) ([]model.IpLimitBan, error) {
+	db := database.GetDB()
+	query := db.Model(model.IpLimitBan{}).Where("until > ?", time.Now().UnixMilli())
+	if mode != "" {
+		query = query.Where("mode = ?", mode)
+	}
+	var bans []model.IpLimitBan
+	err := query.Order("id").Find(&bans).Error
+	return bans, err
+}
+
+// IsBanned tells whether connections of a client from an IP are already
+// being dealt with.
+func (s *IpLimitService) IsBanned(email string, ip string) bool {
+	bans, err := getIpLimitBans("")
+	if err != nil {
+		return false
+	}
+	for _, ban := range bans {
+		if ban.Mode == IpLimitModeRemoveUser && ban.Email == email {
+			return true
+		}
+		if ban.Mode != IpLimitModeRemoveUser && ban.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// Ban deals with a client that connected from the given IPs beyond its limit.
+func (s *IpLimitService) Ban(email string, ips []string) error {
+	mode := s.GetMode()
+	if mode == IpLimitModeFail2ban || len(ips) == 0 {
+		return nil
+	}
+	minutes, err := s.settingService.GetIpLimitBanMinutes()
+	if err != nil || minutes <= 0 {
+		minutes = 30
+	}
+	until := time.Now().Add(time.Duration(minutes) * time.Minute).UnixMilli()
+
+	var bans []*model.IpLimitBan
+	if mode == IpLimitModeRemoveUser {
+		if !s.IsBanned(email, "") {
+			bans = append(bans, &model.IpLimitBan{Email: email, IP: strings.Join(ips, ","), Mode: mode, Until: until})
+		}
+	} else {
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil || s.IsBanned(email, ip) {
+				continue
+			}
+			bans = append(bans, &model.IpLimitBan{Email: email, IP: ip, Mode: mode, Until: until})
+		}
+	}
+	if len(bans) == 0 {
+		return nil
+	}
+
+	if mode == IpLimitModeNftables {
+		current, err := getIpLimitBans(IpLimitModeNftables)
+		if err != nil {
+			return err
+		}
+		for _, ban := range bans {
+			current = append(current, *ban)
+		}
+		if err := s.nftSync(current); err != nil {
+			return err
+		}
+	}
+	if err := database.GetDB().Create(bans).Error; err != nil {
+		return err
+	}
+	for _, ban := range bans {
+		logger.Infof("[LimitIP] Banned %v from %v by %v for %d minutes", ban.Email, ban.IP, mode, minutes)
+	}
+	if mode != IpLimitModeNftables {
+		return s.reloadXray()
+	}
+	return nil
+}
+
+// UnbanExpired drops the expired bans and takes them out of xray.
+func (s *IpLimitService) UnbanExpired() error {
+	db := database.GetDB()
+	var bans []model.IpLimitBan
+	err := db.Where("until <= ?", time.Now().UnixMilli()).Find(&bans).Error
+	if err != nil {
+		return err
+	}
+	if active, err := getIpLimitBans(IpLimitModeNftables); err == nil && len(active) > 0 && !nftHasTable() {
+		// the table is gone, as after a flush of the ruleset
+		if err := s.RestoreBans(); err != nil {
+			logger.Warning("[LimitIP] Failed to restore nftables bans:", err)
+		}
+	}
+	if len(bans) == 0 {
+		return nil
+	}
+	// nftables drops its elements on their own once they time out.
+	if err := db.Delete(&bans).Error; err != nil {
+		return err
+	}
+	for _, ban := range bans {
+		if ban.Mode == IpLimitModeRemoveUser || ban.Mode == IpLimitModeRouting {
+			return s.reloadXray()
+		}
+	}
+	return nil
+}
+
+// Unban lifts a ban before it expires.
+func (s *IpLimitService) Unban(id int) error {
+	db := database.GetDB()
+	ban := &model.IpLimitBan{}
+	err := db.First(ban, id).Error
+	if err != nil {
+		return err
+	}
+	if err := db.Delete(ban).Error; err != nil {
+		return err
+	}
+	if ban.Mode == IpLimitModeNftables {
+		if err := s.RestoreBans(); err != nil {
+			logger.Warning("[LimitIP] Failed to remove nftables ban:", err)
+		}
+		return nil
+	}
+	return s.reloadXray()
+}
+
+// RestoreBans brings the nftables bans in the database back into nftables,
+// which loses them on reboot.
+func (s *IpLimitService) RestoreBans() error {
+	bans, err := getIpLimitBans(IpLimitModeNftables)
+	if err != nil {
+		return err
+	}
+	if len(bans) == 0 && !nftHasTable() {
+		return nil
+	}
+	return s.nftSync(bans)
+}
+
+// nftSync recreates the nftables table with the given bans, each on the
+// port of the inbound of the banned client.
+func (s *IpLimitService) nftSync(bans []model.IpLimitBan) error {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return common.NewError("nftables is not installed")
+	}
+	var elements4, elements6 []string
+	now := time.Now().UnixMilli()
+	for _, ban := range bans {
+		timeout := (ban.Until - now) / 1000
+		if timeout <= 0 || net.ParseIP(ban.IP) == nil {
+			continue
+		}
+		_, inbound, err := s.inboundService.GetClientInboundByEmail(ban.Email)
+		if err != nil || inbound == nil {
+			logger.Warningf("[LimitIP] No inbound of %v to ban %v from", ban.Email, ban.IP)
+			continue
+		}
+		element := fmt.Sprintf("%s . %d timeout %ds", ban.IP, inbound.Port, timeout)
+		if net.ParseIP(ban.IP).To4() != nil {
+			elements4 = append(elements4, element)
+		} else {
+			elements6 = append(elements6, element)
+		}
+	}
+
+	script := ipLimitNftScript
+	if len(elements4) > 0 {
+		script += fmt.Sprintf("add element inet %s banned4 { %s }\n", ipLimitNftTable, strings.Join(elements4, ", "))
+	}
+	if len(elements6) > 0 {
+		script += fmt.Sprintf("add element inet %s banned6 { %s }\n", ipLimitNftTable, strings.Join(elements6, ", "))
+	}
+	return runNft(script)
+}
+
+// reloadXray brings the bans into the running xray, mostly through its API.
+func (s *IpLimitService) reloadXray() error {
+	if !s.xrayService.IsXrayRunning() {
+		return nil
+	}
+	return s.xrayService.RestartXray(false)
+}
+
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return common.NewErrorf("nft: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func nftHasTable() bool {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return false
+	}
+	return exec.Command("nft", "list", "table", "inet", ipLimitNftTable).Run() == nil
+}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -92,6 +93,8 @@ type Release struct {
 type ServerService struct {
 	xrayService    XrayService
 	inboundService InboundService
+	settingService SettingService
+	geoService     GeoService
 	cachedIPv4     string
 	cachedIPv6     string
 	noIPv6         bool
@@ -393,10 +396,25 @@ func (s *ServerService) downloadXRay(version string) (string, error) {
 		return "", err
 	}
 
+	err = verifyDigest(fileName, url+".dgst")
+	if err != nil {
+		os.Remove(fileName)
+		return "", err
+	}
+
 	return fileName, nil
 }
 
+// UpdateXray installs a release next to the already installed versions and
+// switches to it. The previous version is restored if the new one fails.
 func (s *ServerService) UpdateXray(version string) error {
+	if !xrayVersionRegex.MatchString(version) {
+		return common.NewError("invalid xray version:", version)
+	}
+	if _, err := os.Stat(getXrayVersionPath(version)); err == nil {
+		return s.switchXray(version)
+	}
+
 	zipFileName, err := s.downloadXRay(version)
 	if err != nil {
 		return err
@@ -420,20 +438,16 @@ func (s *ServerService) UpdateXray(version string) error {
 		return err
 	}
 
-	s.xrayService.StopXray()
-	defer func() {
-		err := s.xrayService.RestartXray(true)
-		if err != nil {
-			logger.Error("start xray failed:", err)
-		}
-	}()
-
 	copyZipFile := func(zipName string, fileName string) error {
 		zipFile, err := reader.Open(zipName)
 		if err != nil {
 			return err
 		}
-		os.Remove(fileName)
+		defer zipFile.Close()
+		err = os.MkdirAll(filepath.Dir(fileName), 0o755)
+		if err != nil {
+			return err
+		}
 		file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_TRUNC, fs.ModePerm)
 		if err != nil {
 			return err
@@ -443,12 +457,14 @@ func (s *ServerService) UpdateXray(version string) error {
 		return err
 	}
 
-	err = copyZipFile("xray", xray.GetBinaryPath())
+	versionPath := getXrayVersionPath(version)
+	err = copyZipFile("xray", versionPath)
 	if err != nil {
+		os.RemoveAll(filepath.Dir(versionPath))
 		return err
 	}
 
-	return nil
+	return s.switchXray(version)
 }
 
 func (s *ServerService) GetLogs(count string, level string, syslog string) []string {
@@ -625,63 +641,7 @@ func (s *ServerService) ImportDB(file multipart.File) error {
 }
 
 func (s *ServerService) UpdateGeofile(fileName string) error {
-	files := []struct {
-		URL      string
-		FileName string
-	}{
-		{"https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geoip.dat", "geoip.dat"},
-		{"https://github.com/Loyalsoldier/v2ray-rules-dat/releases/latest/download/geosite.dat", "geosite.dat"},
-		{"https://github.com/chocolate4u/Iran-v2ray-rules/releases/latest/download/geoip.dat", "geoip_IR.dat"},
-		{"https://github.com/chocolate4u/Iran-v2ray-rules/releases/latest/download/geosite.dat", "geosite_IR.dat"},
-		{"https://github.com/runetfreedom/russia-v2ray-rules-dat/releases/latest/download/geoip.dat", "geoip_RU.dat"},
-		{"https://github.com/runetfreedom/russia-v2ray-rules-dat/releases/latest/download/geosite.dat", "geosite_RU.dat"},
-	}
-
-	downloadFile := func(url, destPath string) error {
-		resp, err := http.Get(url)
-		if err != nil {
-			return common.NewErrorf("Failed to download Geofile from %s: %v", url, err)
-		}
-		defer resp.Body.Close()
-
-		file, err := os.Create(destPath)
-		if err != nil {
-			return common.NewErrorf("Failed to create Geofile %s: %v", destPath, err)
-		}
-		defer file.Close()
-
-		_, err = io.Copy(file, resp.Body)
-		if err != nil {
-			return common.NewErrorf("Failed to save Geofile %s: %v", destPath, err)
-		}
-
-		return nil
-	}
-
-	var fileURL string
-	for _, file := range files {
-		if file.FileName == fileName {
-			fileURL = file.URL
-			break
-		}
-	}
-
-	if fileURL == "" {
-		return common.NewErrorf("File '%s' not found in the list of Geofiles", fileName)
-	}
-
-	destPath := fmt.Sprintf("%s/%s", config.GetBinFolderPath(), fileName)
-
-	if err := downloadFile(fileURL, destPath); err != nil {
-		return common.NewErrorf("Error downloading Geofile '%s': %v", fileName, err)
-	}
-
-	err := s.RestartXrayService()
-	if err != nil {
-		return common.NewErrorf("Updated Geofile '%s' but Failed to start Xray: %v", fileName, err)
-	}
-
-	return nil
+	return s.geoService.UpdateGeofile(fileName)
 }
 
 func (s *ServerService) GetNewX25519Cert() (any, error) {
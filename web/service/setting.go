@@ -31,6 +31,7 @@ var defaultValueMap = map[string]string{
 	"webCertFile":                 "",
 	"webKeyFile":                  "",
 	"secret":                      random.Seq(32),
+	"subSignSecret":               random.Seq(32),
 	"webBasePath":                 "/",
 	"sessionMaxAge":               "60",
 	"pageSize":                    "50",
@@ -56,6 +57,7 @@ var defaultValueMap = map[string]string{
 	"subPort":                     "2096",
 	"subPath":                     "/sub/",
 	"subDomain":                   "",
+	"subTrustedProxies":           "",
 	"subCertFile":                 "",
 	"subKeyFile":                  "",
 	"subUpdates":                  "12",
@@ -68,10 +70,45 @@ var defaultValueMap = map[string]string{
 	"subJsonNoises":               "",
 	"subJsonMux":                  "",
 	"subJsonRules":                "",
+	"subClashPath":                "/clash/",
+	"subClashURI":                 "",
+	"subClashRules":               "",
+	"subSingboxPath":              "/singbox/",
+	"subSingboxURI":               "",
+	"subSingboxDns":               "",
+	"subSingboxRules":             "",
+	"subFormatRules":              `[{"userAgent":"hiddify","format":"links"},{"userAgent":"clash|mihomo|stash","format":"clash"},{"userAgent":"^sf[aimt]/|sing-box","format":"singbox"},{"userAgent":"streisand","format":"json"},{"userAgent":"v2rayng|v2rayn|shadowrocket|v2box|foxray|nekobox","format":"links"},{"userAgent":"mozilla","format":"page"}]`,
 	"datepicker":                  "gregorian",
 	"warp":                        "",
 	"externalTrafficInformEnable": "false",
 	"externalTrafficInformURI":    "",
+	"jobSettings":                 "",
+	"xrayGoodConfigMinutes":       "5",
+	"xrayCrashLoopCount":          "3",
+	"singboxApiPort":              "62790",
+	"xrayCurrentVersion":          "",
+	"xrayPreviousVersion":         "",
+	"analyticsEnable":             "false",
+	"analyticsRetentionDays":      "30",
+	"analyticsAnonymize":          "false",
+	"ipLimitMode":                 "fail2ban",
+	"ipLimitBanMinutes":           "30",
+	"ipLimitWindowMinutes":        "1",
+	"abuseDetectEnable":           "false",
+	"abuseBittorrent":             "true",
+	"abuseBittorrentBlock":        "false",
+	"abuseSmtp":                   "true",
+	"abuseScanThreshold":          "300",
+	"abuseUploadThreshold":        "0",
+	"abuseSuspend":                "false",
+	"subAccessLog":                "true",
+	"subAccessRetentionDays":      "30",
+	"subShareIpThreshold":         "10",
+	"subDeviceLimit":              "0",
+	"subDeviceRequireHwid":        "false",
+	"subNodes":                    "",
+	"subNodeSecret":               "",
+	"subNodeCacheMinutes":         "5",
 }
 
 type SettingService struct{}
@@ -385,6 +422,17 @@ func (s *SettingService) GetSecret() ([]byte, error) {
 	return []byte(secret), err
 }
 
+func (s *SettingService) GetSubSignSecret() ([]byte, error) {
+	secret, err := s.getString("subSignSecret")
+	if secret == defaultValueMap["subSignSecret"] {
+		err := s.saveSetting("subSignSecret", secret)
+		if err != nil {
+			logger.Warning("save subscription sign secret failed:", err)
+		}
+	}
+	return []byte(secret), err
+}
+
 func (s *SettingService) SetBasePath(basePath string) error {
 	if !strings.HasPrefix(basePath, "/") {
 		basePath = "/" + basePath
@@ -451,6 +499,10 @@ func (s *SettingService) GetSubDomain() (string, error) {
 	return s.getString("subDomain")
 }
 
+func (s *SettingService) GetSubTrustedProxies() (string, error) {
+	return s.getString("subTrustedProxies")
+}
+
 func (s *SettingService) GetSubCertFile() (string, error) {
 	return s.getString("subCertFile")
 }
@@ -499,6 +551,38 @@ func (s *SettingService) GetSubJsonRules() (string, error) {
 	return s.getString("subJsonRules")
 }
 
+func (s *SettingService) GetSubClashPath() (string, error) {
+	return s.getString("subClashPath")
+}
+
+func (s *SettingService) GetSubClashURI() (string, error) {
+	return s.getString("subClashURI")
+}
+
+func (s *SettingService) GetSubClashRules() (string, error) {
+	return s.getString("subClashRules")
+}
+
+func (s *SettingService) GetSubSingboxPath() (string, error) {
+	return s.getString("subSingboxPath")
+}
+
+func (s *SettingService) GetSubSingboxURI() (string, error) {
+	return s.getString("subSingboxURI")
+}
+
+func (s *SettingService) GetSubSingboxDns() (string, error) {
+	return s.getString("subSingboxDns")
+}
+
+func (s *SettingService) GetSubSingboxRules() (string, error) {
+	return s.getString("subSingboxRules")
+}
+
+func (s *SettingService) GetSubFormatRules() (string, error) {
+	return s.getString("subFormatRules")
+}
+
 func (s *SettingService) GetDatepicker() (string, error) {
 	return s.getString("datepicker")
 }
@@ -527,6 +611,128 @@ func (s *SettingService) SetExternalTrafficInformURI(InformURI string) error {
 	return s.setString("externalTrafficInformURI", InformURI)
 }
 
+func (s *SettingService) GetJobSettings() (string, error) {
+	return s.getString("jobSettings")
+}
+
+func (s *SettingService) SetJobSettings(data string) error {
+	return s.setString("jobSettings", data)
+}
+
+func (s *SettingService) GetXrayGoodConfigMinutes() (int, error) {
+	return s.getInt("xrayGoodConfigMinutes")
+}
+
+func (s *SettingService) GetXrayCrashLoopCount() (int, error) {
+	return s.getInt("xrayCrashLoopCount")
+}
+
+// GetSingboxApiPort returns the port of the sing-box stats API, 0 when
+// disabled. The API needs a sing-box built with the with_v2ray_api tag.
+func (s *SettingService) GetSingboxApiPort() (int, error) {
+	return s.getInt("singboxApiPort")
+}
+
+func (s *SettingService) GetXrayCurrentVersion() (string, error) {
+	return s.getString("xrayCurrentVersion")
+}
+
+func (s *SettingService) SetXrayCurrentVersion(version string) error {
+	return s.setString("xrayCurrentVersion", version)
+}
+
+func (s *SettingService) GetXrayPreviousVersion() (string, error) {
+	return s.getString("xrayPreviousVersion")
+}
+
+func (s *SettingService) SetXrayPreviousVersion(version string) error {
+	return s.setString("xrayPreviousVersion", version)
+}
+
+func (s *SettingService) GetAnalyticsEnable() (bool, error) {
+	return s.getBool("analyticsEnable")
+}
+
+func (s *SettingService) GetAnalyticsRetentionDays() (int, error) {
+	return s.getInt("analyticsRetentionDays")
+}
+
+func (s *SettingService) GetAnalyticsAnonymize() (bool, error) {
+	return s.getBool("analyticsAnonymize")
+}
+
+func (s *SettingService) GetIpLimitMode() (string, error) {
+	return s.getString("ipLimitMode")
+}
+
+func (s *SettingService) GetIpLimitBanMinutes() (int, error) {
+	return s.getInt("ipLimitBanMinutes")
+}
+
+func (s *SettingService) GetIpLimitWindowMinutes() (int, error) {
+	return s.getInt("ipLimitWindowMinutes")
+}
+
+func (s *SettingService) GetAbuseDetectEnable() (bool, error) {
+	return s.getBool("abuseDetectEnable")
+}
+
+func (s *SettingService) GetAbuseBittorrent() (bool, error) {
+	return s.getBool("abuseBittorrent")
+}
+
+func (s *SettingService) GetAbuseBittorrentBlock() (bool, error) {
+	return s.getBool("abuseBittorrentBlock")
+}
+
+func (s *SettingService) GetAbuseSmtp() (bool, error) {
+	return s.getBool("abuseSmtp")
+}
+
+func (s *SettingService) GetAbuseScanThreshold() (int, error) {
+	return s.getInt("abuseScanThreshold")
+}
+
+func (s *SettingService) GetAbuseUploadThreshold() (int, error) {
+	return s.getInt("abuseUploadThreshold")
+}
+
+func (s *SettingService) GetAbuseSuspend() (bool, error) {
+	return s.getBool("abuseSuspend")
+}
+
+func (s *SettingService) GetSubAccessLog() (bool, error) {
+	return s.getBool("subAccessLog")
+}
+
+func (s *SettingService) GetSubAccessRetentionDays() (int, error) {
+	return s.getInt("subAccessRetentionDays")
+}
+
+func (s *SettingService) GetSubShareIpThreshold() (int, error) {
+	return s.getInt("subShareIpThreshold")
+}
+
+func (s *SettingService) GetSubDeviceLimit() (int, error) {
+	return s.getInt("subDeviceLimit")
+}
+
+func (s *SettingService) GetSubDeviceRequireHwid() (bool, error) {
+	return s.getBool("subDeviceRequireHwid")
+}
+
+func (s *SettingService) GetSubNodes() (string, error) {
+	return s.getString("subNodes")
+}
+
+func (s *SettingService) GetSubNodeSecret() (string, error) {
+	return s.getString("subNodeSecret")
+}
+
+func (s *SettingService) GetSubNodeCacheMinutes() (int, error) {
+	return s.getInt("subNodeCacheMinutes")
+}
+
 func (s *SettingService) GetIpLimitEnable() (bool, error) {
 	accessLogPath, err := xray.GetAccessLogPath()
 	if err != nil {
@@ -578,6 +784,8 @@ func (s *SettingService) GetDefaultSettings(host string) (any, error) {
 		"subTitle":      func() (any, error) { return s.GetSubTitle() },
 		"subURI":        func() (any, error) { return s.GetSubURI() },
 		"subJsonURI":    func() (any, error) { return s.GetSubJsonURI() },
+		"subClashURI":   func() (any, error) { return s.GetSubClashURI() },
+		"subSingboxURI": func() (any, error) { return s.GetSubSingboxURI() },
 		"remarkModel":   func() (any, error) { return s.GetRemarkModel() },
 		"datepicker":    func() (any, error) { return s.GetDatepicker() },
 		"ipLimitEnable": func() (any, error) { return s.GetIpLimitEnable() },
@@ -593,12 +801,14 @@ func (s *SettingService) GetDefaultSettings(host string) (any, error) {
 		result[key] = value
 	}
 
-	if result["subEnable"].(bool) && (result["subURI"].(string) == "" || result["subJsonURI"].(string) == "") {
+	if result["subEnable"].(bool) && (result["subURI"].(string) == "" || result["subJsonURI"].(string) == "" || result["subClashURI"].(string) == "" || result["subSingboxURI"].(string) == "") {
 		subURI := ""
 		subTitle, _ := s.GetSubTitle()
 		subPort, _ := s.GetSubPort()
 		subPath, _ := s.GetSubPath()
 		subJsonPath, _ := s.GetSubJsonPath()
+		subClashPath, _ := s.GetSubClashPath()
+		subSingboxPath, _ := s.GetSubSingboxPath()
 		subDomain, _ := s.GetSubDomain()
 		subKeyFile, _ := s.GetSubKeyFile()
 		subCertFile, _ := s.GetSubCertFile()
@@ -628,6 +838,12 @@ func (s *SettingService) GetDefaultSettings(host string) (any, error) {
 		if result["subJsonURI"].(string) == "" {
 			result["subJsonURI"] = subURI + subJsonPath
 		}
+		if result["subClashURI"].(string) == "" {
+			result["subClashURI"] = subURI + subClashPath
+		}
+		if result["subSingboxURI"].(string) == "" {
+			result["subSingboxURI"] = subURI + subSingboxPath
+		}
 	}
 
 	return result, nil
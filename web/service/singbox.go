@@ -0,0 +1,159 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"x-ui/logger"
+	"x-ui/singbox"
+	"x-ui/xray"
+)
+
+var (
+	sb     *singbox.Process
+	sbLock sync.Mutex
+)
+
+// SingboxService runs sing-box next to xray for the inbounds whose protocol
+// xray lacks. sing-box is only started while there are such inbounds.
+type SingboxService struct {
+	inboundService InboundService
+	settingService SettingService
+}
+
+func (s *SingboxService) IsSingboxRunning() bool {
+	return sb != nil && sb.IsRunning()
+}
+
+func (s *SingboxService) GetSingboxConfig() (*singbox.Config, error) {
+	inbounds, err := s.inboundService.GetAllInbounds()
+	if err != nil {
+		return nil, err
+	}
+
+	singboxConfig := singbox.NewConfig()
+	var tags, emails []string
+	for _, inbound := range inbounds {
+		if !inbound.Enable || !singbox.IsProtocol(string(inbound.Protocol)) {
+			continue
+		}
+		settings, activeEmails, err := s.activeClientSettings(inbound.Settings, inbound.ClientStats)
+		if err != nil {
+			return nil, err
+		}
+		config, err := singbox.NewInbound(string(inbound.Protocol), inbound.Tag, inbound.Listen, inbound.Port, settings, inbound.StreamSettings)
+		if err != nil {
+			logger.Warning("Skipping sing-box inbound:", err)
+			continue
+		}
+		singboxConfig.Inbounds = append(singboxConfig.Inbounds, config)
+		tags = append(tags, inbound.Tag)
+		emails = append(emails, activeEmails...)
+	}
+
+	apiPort, err := s.settingService.GetSingboxApiPort()
+	if err == nil && apiPort > 0 {
+		singboxConfig.Experimental = &singbox.Experimental{
+			V2RayAPI: &singbox.V2RayAPI{
+				Listen: fmt.Sprintf("127.0.0.1:%d", apiPort),
+				Stats: &singbox.V2RayStats{
+					Enabled:  true,
+					Inbounds: tags,
+					Users:    emails,
+				},
+			},
+		}
+	}
+	return singboxConfig, nil
+}
+
+// activeClientSettings drops the disabled and depleted clients from the
+// inbound settings, as is done for xray.
+func (s *SingboxService) activeClientSettings(settings string, clientStats []xray.ClientTraffic) (string, []string, error) {
+	fields := map[string]any{}
+	if err := json.Unmarshal([]byte(settings), &fields); err != nil {
+		return "", nil, err
+	}
+	disabled := make(map[string]bool)
+	for _, clientTraffic := range clientStats {
+		if !clientTraffic.Enable {
+			disabled[clientTraffic.Email] = true
+		}
+	}
+
+	clients, _ := fields["clients"].([]any)
+	activeClients := make([]any, 0, len(clients))
+	var emails []string
+	for _, client := range clients {
+		c, ok := client.(map[string]any)
+		if !ok {
+			continue
+		}
+		email, _ := c["email"].(string)
+		if enable, ok := c["enable"].(bool); (ok && !enable) || disabled[email] {
+			continue
+		}
+		activeClients = append(activeClients, c)
+		emails = append(emails, email)
+	}
+	fields["clients"] = activeClients
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(data), emails, nil
+}
+
+// RestartSingbox brings sing-box in line with the inbounds: it is stopped
+// when there are none, reloaded when its config changed and started when it
+// is not running.
+func (s *SingboxService) RestartSingbox(isForce bool) error {
+	sbLock.Lock()
+	defer sbLock.Unlock()
+
+	singboxConfig, err := s.GetSingboxConfig()
+	if err != nil {
+		return err
+	}
+
+	if len(singboxConfig.Inbounds) == 0 {
+		if s.IsSingboxRunning() {
+			logger.Info("No sing-box inbounds left, stopping sing-box")
+			return sb.Stop()
+		}
+		return nil
+	}
+	if _, err := os.Stat(singbox.GetBinaryPath()); err != nil {
+		return errors.New("sing-box binary not found: " + singbox.GetBinaryPath())
+	}
+
+	if s.IsSingboxRunning() {
+		if !isForce && sb.GetConfig().Equals(singboxConfig) {
+			return nil
+		}
+		if !isForce {
+			data, err := json.Marshal(singboxConfig)
+			if err != nil {
+				return err
+			}
+			return sb.ApplyConfig(data)
+		}
+		sb.Stop()
+	}
+
+	sb = singbox.NewProcess(singboxConfig)
+	return sb.Start()
+}
+
+func (s *SingboxService) StopSingbox() error {
+	sbLock.Lock()
+	defer sbLock.Unlock()
+	if s.IsSingboxRunning() {
+		return sb.Stop()
+	}
+	return errors.New("sing-box is not running")
+}
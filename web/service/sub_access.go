@@ -0,0 +1,151 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/logger"
+)
+
+const (
+	// subShareWindow is the span over which the distinct IPs fetching a
+	// subscription are counted.
+	subShareWindow = 24 * time.Hour
+	// subRecentAccesses is how many of the last requests are shown.
+	subRecentAccesses = 10
+)
+
+var (
+	subShareAlertedLock sync.Mutex
+	// subShareAlerted holds when each shared subscription was last reported.
+	subShareAlerted = make(map[string]time.Time)
+)
+
+// SubAccessStats sums up the requests of a subscription.
+type SubAccessStats struct {
+	SubId string `json:"subId"`
+	// Count is the number of requests within the retention.
+	Count int64 `json:"count"`
+	// DistinctIPs is the number of IPs that fetched it within subShareWindow.
+	DistinctIPs int64             `json:"distinctIPs"`
+	Recent      []model.SubAccess `json:"recent"`
+}
+
+// SubAccessService logs the requests to the subscription server and reports
+// the subscriptions fetched from many IPs, a sign of their links being
+// shared.
+type SubAccessService struct {
+	settingService SettingService
+	tgbotService   Tgbot
+}
+
+// Record logs a request to a subscription, unless the access log is off.
+func (s *SubAccessService) Record(subId string, ip string, userAgent string, format string) {
+	enable, err := s.settingService.GetSubAccessLog()
+	if err != nil || !enable || subId == "" {
+		return
+	}
+	access := &model.SubAccess{
+		SubId:     subId,
+		Time:      time.Now().UnixMilli(),
+		IP:        ip,
+		UserAgent: userAgent,
+		Format:    format,
+	}
+	if err := database.GetDB().Create(access).Error; err != nil {
+		logger.Warning("[Sub] Failed to log the request to", subId, ":", err)
+	}
+}
+
+func (s *SubAccessService) GetStats(subId string) (*SubAccessStats, error) {
+	db := database.GetDB()
+	stats := &SubAccessStats{SubId: subId}
+	err := db.Model(model.SubAccess{}).Where("sub_id = ?", subId).Count(&stats.Count).Error
+	if err != nil {
+		return nil, err
+	}
+	err = db.Model(model.SubAccess{}).
+		Where("sub_id = ? AND time > ?", subId, time.Now().Add(-subShareWindow).UnixMilli()).
+		Distinct("ip").
+		Count(&stats.DistinctIPs).Error
+	if err != nil {
+		return nil, err
+	}
+	err = db.Where("sub_id = ?", subId).Order("id desc").Limit(subRecentAccesses).Find(&stats.Recent).Error
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Prune removes the requests older than the retention.
+func (s *SubAccessService) Prune() error {
+	days, err := s.settingService.GetSubAccessRetentionDays()
+	if err != nil || days <= 0 {
+		return err
+	}
+	since := time.Now().AddDate(0, 0, -days).UnixMilli()
+	return database.GetDB().Where("time < ?", since).Delete(model.SubAccess{}).Error
+}
+
+// CheckSharing reports the subscriptions fetched from more distinct IPs than
+// the threshold within subShareWindow, once per window.
+func (s *SubAccessService) CheckSharing() error {
+	threshold, err := s.settingService.GetSubShareIpThreshold()
+	if err != nil || threshold <= 0 {
+		return err
+	}
+
+	var shared []struct {
+		SubId string
+		Count int64
+	}
+	err = database.GetDB().Model(model.SubAccess{}).
+		Select("sub_id, count(DISTINCT ip) AS count").
+		Where("time > ?", time.Now().Add(-subShareWindow).UnixMilli()).
+		Group("sub_id").
+		Having("count(DISTINCT ip) > ?", threshold).
+		Scan(&shared).Error
+	if err != nil {
+		return err
+	}
+
+	subShareAlertedLock.Lock()
+	defer subShareAlertedLock.Unlock()
+	for subId, alerted := range subShareAlerted {
+		if time.Since(alerted) > subShareWindow {
+			delete(subShareAlerted, subId)
+		}
+	}
+	for _, sub := range shared {
+		if _, ok := subShareAlerted[sub.SubId]; ok {
+			continue
+		}
+		subShareAlerted[sub.SubId] = time.Now()
+		emails, err := s.getSubEmails(sub.SubId)
+		if err != nil {
+			logger.Warning("[Sub] Failed to look up the clients of", sub.SubId, ":", err)
+		}
+		logger.Warningf("[Sub] Subscription %s (%s) was fetched from %d IPs in a day", sub.SubId, strings.Join(emails, ", "), sub.Count)
+		if s.tgbotService.IsRunning() {
+			s.tgbotService.SendMsgToTgbotAdmins(s.tgbotService.I18nBot("tgbot.messages.subShared",
+				"SubId=="+sub.SubId,
+				"Emails=="+strings.Join(emails, ", "),
+				"Count=="+fmt.Sprint(sub.Count)))
+		}
+	}
+	return nil
+}
+
+func (s *SubAccessService) getSubEmails(subId string) ([]string, error) {
+	var emails []string
+	err := database.GetDB().Raw(`SELECT DISTINCT JSON_EXTRACT(client.value, '$.email')
+		FROM inbounds,
+			JSON_EACH(JSON_EXTRACT(inbounds.settings, '$.clients')) AS client
+		WHERE JSON_EXTRACT(client.value, '$.subId') = ?`, subId).Scan(&emails).Error
+	return emails, err
+}
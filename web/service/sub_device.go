@@ -0,0 +1,128 @@
+package service
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+)
+
+// subDeviceFieldLength caps what is stored of the headers an app sends.
+const subDeviceFieldLength = 128
+
+// subDeviceLock keeps two new devices of a subscription from both taking its
+// last free place.
+var subDeviceLock sync.Mutex
+
+// SubDeviceInfo is what an app fetching a subscription tells of the device it
+// runs on, through headers such as x-hwid and x-device-os.
+type SubDeviceInfo struct {
+	Hwid      string
+	Os        string
+	OsVersion string
+	Model     string
+	UserAgent string
+	IP        string
+}
+
+// SubDeviceService binds subscriptions to the devices fetching them and
+// keeps each within the device limit.
+type SubDeviceService struct {
+	settingService SettingService
+}
+
+// Bind records the device fetching a subscription and tells whether it may
+// be served. A device is refused when it is new and the subscription already
+// has as many devices as the limit, or when it sends no HWID while the limit
+// is on and one is required. Apps that send no HWID are otherwise served and
+// not counted.
+func (s *SubDeviceService) Bind(subId string, info SubDeviceInfo) (bool, error) {
+	limit, err := s.settingService.GetSubDeviceLimit()
+	if err != nil {
+		return true, err
+	}
+	if info.Hwid == "" {
+		if limit <= 0 {
+			return true, nil
+		}
+		required, err := s.settingService.GetSubDeviceRequireHwid()
+		if err != nil {
+			return true, err
+		}
+		return !required, nil
+	}
+
+	device := model.SubDevice{
+		SubId:     subId,
+		Hwid:      truncate(info.Hwid, subDeviceFieldLength),
+		Os:        truncate(info.Os, subDeviceFieldLength),
+		OsVersion: truncate(info.OsVersion, subDeviceFieldLength),
+		Model:     truncate(info.Model, subDeviceFieldLength),
+		UserAgent: truncate(info.UserAgent, subDeviceFieldLength),
+		IP:        info.IP,
+		LastSeen:  time.Now().UnixMilli(),
+	}
+
+	subDeviceLock.Lock()
+	defer subDeviceLock.Unlock()
+
+	db := database.GetDB()
+	var devices []model.SubDevice
+	err = db.Where("sub_id = ? AND hwid = ?", subId, device.Hwid).Limit(1).Find(&devices).Error
+	if err != nil {
+		return true, err
+	}
+	if len(devices) > 0 {
+		return true, db.Model(&devices[0]).Updates(map[string]any{
+			"os":         device.Os,
+			"os_version": device.OsVersion,
+			"model":      device.Model,
+			"user_agent": device.UserAgent,
+			"ip":         device.IP,
+			"last_seen":  device.LastSeen,
+		}).Error
+	}
+
+	if limit > 0 {
+		var count int64
+		err = db.Model(model.SubDevice{}).Where("sub_id = ?", subId).Count(&count).Error
+		if err != nil {
+			return true, err
+		}
+		if count >= int64(limit) {
+			return false, nil
+		}
+	}
+	device.FirstSeen = device.LastSeen
+	return true, db.Create(&device).Error
+}
+
+func (s *SubDeviceService) GetDevices(subId string) ([]model.SubDevice, error) {
+	var devices []model.SubDevice
+	err := database.GetDB().Where("sub_id = ?", subId).Order("last_seen desc").Find(&devices).Error
+	return devices, err
+}
+
+// Unbind frees the place of a device of a subscription, or of all of them
+// when id is 0. The device is bound again on its next request if there is
+// room.
+func (s *SubDeviceService) Unbind(subId string, id int) error {
+	if subId == "" {
+		return common.NewError("subscription id is empty")
+	}
+	db := database.GetDB().Where("sub_id = ?", subId)
+	if id > 0 {
+		db = db.Where("id = ?", id)
+	}
+	return db.Delete(model.SubDevice{}).Error
+}
+
+func truncate(s string, length int) string {
+	if len(s) > length {
+		return strings.ToValidUTF8(s[:length], "")
+	}
+	return s
+}
@@ -0,0 +1,267 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/database"
+	"x-ui/database/model"
+	"x-ui/util/common"
+	"x-ui/util/random"
+)
+
+// subTokenLength is the length of the generated subscription tokens.
+const subTokenLength = 16
+
+// SubTokens are the tokens of a subscription. Current is the one the links
+// are given out with, or "" when the subscription is revoked.
+type SubTokens struct {
+	SubId   string           `json:"subId"`
+	Current string           `json:"current"`
+	Tokens  []model.SubToken `json:"tokens"`
+}
+
+// SubTokenService lets the links of a subscription be given out with tokens
+// standing in for its subId. Tokens are rotated with a grace period during
+// which the old ones keep working, and revoked at once. Signed links carry an
+// expiry and an HMAC of a token.
+//
+// A subscription without tokens is fetched by its subId. Once it has any, only
+// its tokens work, including the subId itself while its grace period lasts.
+type SubTokenService struct {
+	settingService SettingService
+}
+
+// Resolve returns the subId a token or signed link stands for.
+func (s *SubTokenService) Resolve(token string) (string, error) {
+	if signed, ok, err := s.verifySigned(token); ok {
+		if err != nil {
+			return "", err
+		}
+		token = signed
+	}
+
+	db := database.GetDB()
+	var subTokens []model.SubToken
+	err := db.Where("token = ?", token).Limit(1).Find(&subTokens).Error
+	if err != nil {
+		return "", err
+	}
+	if len(subTokens) > 0 {
+		subToken := subTokens[0]
+		if subToken.ExpiresAt > 0 && subToken.ExpiresAt <= time.Now().UnixMilli() {
+			return "", common.NewError("subscription token expired:", token)
+		}
+		return subToken.SubId, nil
+	}
+
+	var count int64
+	err = db.Model(model.SubToken{}).Where("sub_id = ?", token).Count(&count).Error
+	if err != nil {
+		return "", err
+	}
+	if count > 0 {
+		return "", common.NewError("subscription is only fetched by its tokens:", token)
+	}
+	return token, nil
+}
+
+func (s *SubTokenService) GetTokens(subId string) (*SubTokens, error) {
+	db := database.GetDB()
+	tokens := &SubTokens{SubId: subId}
+	err := db.Where("sub_id = ?", subId).Order("id desc").Find(&tokens.Tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	tokens.Current = currentSubToken(subId, tokens.Tokens)
+	return tokens, nil
+}
+
+// GetCurrentTokens returns the tokens the links of the given subscriptions
+// are given out with, "" for the revoked ones.
+func (s *SubTokenService) GetCurrentTokens(subIds []string) (map[string]string, error) {
+	var subTokens []model.SubToken
+	err := database.GetDB().Where("sub_id IN ?", subIds).Order("id desc").Find(&subTokens).Error
+	if err != nil {
+		return nil, err
+	}
+	bySubId := make(map[string][]model.SubToken)
+	for _, subToken := range subTokens {
+		bySubId[subToken.SubId] = append(bySubId[subToken.SubId], subToken)
+	}
+	current := make(map[string]string, len(subIds))
+	for _, subId := range subIds {
+		current[subId] = currentSubToken(subId, bySubId[subId])
+	}
+	return current, nil
+}
+
+// currentSubToken picks the current token of a subscription out of its
+// tokens, newest first.
+func currentSubToken(subId string, tokens []model.SubToken) string {
+	if len(tokens) == 0 {
+		return subId
+	}
+	for _, token := range tokens {
+		if token.ExpiresAt == 0 {
+			return token.Token
+		}
+	}
+	return ""
+}
+
+// Rotate gives a subscription a new token. The tokens it had, and its subId
+// if it had none, keep working for graceHours.
+func (s *SubTokenService) Rotate(subId string, graceHours int) (*model.SubToken, error) {
+	if subId == "" {
+		return nil, common.NewError("subscription id is empty")
+	}
+	if graceHours < 0 {
+		return nil, common.NewError("grace period is not valid:", graceHours)
+	}
+	now := time.Now()
+	expiresAt := now.Add(time.Duration(graceHours) * time.Hour).UnixMilli()
+
+	db := database.GetDB()
+	tx := db.Begin()
+	var err error
+	defer func() {
+		if err == nil {
+			tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+	}()
+
+	var count int64
+	err = tx.Model(model.SubToken{}).Where("sub_id = ?", subId).Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		err = tx.Create(&model.SubToken{
+			SubId:     subId,
+			Token:     subId,
+			CreatedAt: now.UnixMilli(),
+			ExpiresAt: expiresAt,
+		}).Error
+	} else {
+		err = tx.Model(model.SubToken{}).
+			Where("sub_id = ? AND (expires_at = 0 OR expires_at > ?)", subId, expiresAt).
+			Update("expires_at", expiresAt).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	subToken := &model.SubToken{
+		SubId:     subId,
+		Token:     random.Seq(subTokenLength),
+		CreatedAt: now.UnixMilli(),
+	}
+	err = tx.Create(subToken).Error
+	if err != nil {
+		return nil, err
+	}
+	return subToken, nil
+}
+
+// Revoke stops a token of a subscription from working at once, or all of
+// them, its subId included, when token is "".
+func (s *SubTokenService) Revoke(subId string, token string) error {
+	if subId == "" {
+		return common.NewError("subscription id is empty")
+	}
+	now := time.Now().UnixMilli()
+	db := database.GetDB()
+	if token != "" {
+		return db.Model(model.SubToken{}).
+			Where("sub_id = ? AND token = ? AND (expires_at = 0 OR expires_at > ?)", subId, token, now).
+			Update("expires_at", now).Error
+	}
+
+	var count int64
+	err := db.Model(model.SubToken{}).Where("sub_id = ?", subId).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return db.Create(&model.SubToken{
+			SubId:     subId,
+			Token:     subId,
+			CreatedAt: now,
+			ExpiresAt: now,
+		}).Error
+	}
+	return db.Model(model.SubToken{}).
+		Where("sub_id = ? AND (expires_at = 0 OR expires_at > ?)", subId, now).
+		Update("expires_at", now).Error
+}
+
+// Prune removes the expired tokens. The last token of each subscription is
+// kept, so that a revoked subscription does not fall back to its subId.
+func (s *SubTokenService) Prune() error {
+	db := database.GetDB()
+	latest := db.Model(model.SubToken{}).Select("MAX(id)").Group("sub_id")
+	return db.Where("expires_at > 0 AND expires_at <= ? AND id NOT IN (?)", time.Now().UnixMilli(), latest).
+		Delete(model.SubToken{}).Error
+}
+
+// Sign returns a link token for the current token of a subscription that
+// stops working after the given days.
+func (s *SubTokenService) Sign(subId string, days int) (string, error) {
+	if days <= 0 {
+		return "", common.NewError("signed link days is not valid:", days)
+	}
+	tokens, err := s.GetTokens(subId)
+	if err != nil {
+		return "", err
+	}
+	if tokens.Current == "" {
+		return "", common.NewError("subscription is revoked:", subId)
+	}
+	expiry := strconv.FormatInt(time.Now().AddDate(0, 0, days).Unix(), 10)
+	signature, err := s.sign(tokens.Current + "." + expiry)
+	if err != nil {
+		return "", err
+	}
+	return tokens.Current + "." + expiry + "." + signature, nil
+}
+
+// verifySigned tells whether a link token is signed, and if so returns the
+// token it carries, or an error when it has expired.
+func (s *SubTokenService) verifySigned(link string) (string, bool, error) {
+	parts := strings.Split(link, ".")
+	if len(parts) < 3 {
+		return "", false, nil
+	}
+	signature := parts[len(parts)-1]
+	payload := strings.Join(parts[:len(parts)-1], ".")
+	expected, err := s.sign(payload)
+	if err != nil || !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", false, nil
+	}
+
+	expiry, err := strconv.ParseInt(parts[len(parts)-2], 10, 64)
+	if err != nil {
+		return "", false, nil
+	}
+	if time.Now().Unix() >= expiry {
+		return "", true, common.NewError("signed subscription link expired")
+	}
+	return strings.Join(parts[:len(parts)-2], "."), true, nil
+}
+
+func (s *SubTokenService) sign(payload string) (string, error) {
+	secret, err := s.settingService.GetSubSignSecret()
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil)[:16]), nil
+}
@@ -71,11 +71,13 @@ const (
 )
 
 type Tgbot struct {
-	inboundService InboundService
-	settingService SettingService
-	serverService  ServerService
-	xrayService    XrayService
-	lastStatus     *Status
+	inboundService   InboundService
+	settingService   SettingService
+	serverService    ServerService
+	xrayService      XrayService
+	analyticsService AnalyticsService
+	subDeviceService SubDeviceService
+	lastStatus       *Status
 }
 
 func (t *Tgbot) NewTgbot() *Tgbot {
@@ -1180,6 +1182,8 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 			case "ip_log":
 				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.getIpLog", "Email=="+email))
 				t.searchClientIps(chatId, email)
+			case "devices", "devices_refresh", "device_unbind", "devices_unbind", "devices_unbind_c":
+				t.answerDevicesCallback(callbackQuery, dataArray)
 			case "tg_user":
 				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.getUserInfo", "Email=="+email))
 				t.clientTelegramUserInfo(chatId, email)
@@ -1304,6 +1308,20 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 		}
 	}
 
+	if !isAdmin {
+		// clients may only manage the devices of their own subscriptions
+		decodedQuery, err := t.decodeQuery(callbackQuery.Data)
+		dataArray := strings.Split(decodedQuery, " ")
+		if err == nil && len(dataArray) >= 2 && strings.HasPrefix(dataArray[0], "device") {
+			if t.isClientOf(callbackQuery.From.ID, dataArray[1]) {
+				t.answerDevicesCallback(callbackQuery, dataArray)
+			} else {
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.noResult"))
+			}
+			return
+		}
+	}
+
 	switch callbackQuery.Data {
 	case "get_usage":
 		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.serverUsage"))
@@ -1327,6 +1345,9 @@ func (t *Tgbot) answerCallback(callbackQuery *telego.CallbackQuery, isAdmin bool
 		tgUserID := callbackQuery.From.ID
 		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.clientUsage"))
 		t.getClientUsage(chatId, tgUserID)
+	case "client_devices":
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.devices"))
+		t.getClientDevices(chatId, callbackQuery.From.ID)
 	case "client_commands":
 		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.buttons.commands"))
 		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.commands.helpClientCommands"))
@@ -1806,6 +1827,9 @@ func (t *Tgbot) SendAnswer(chatId int64, msg string, isAdmin bool) {
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.clientUsage")).WithCallbackData(t.encodeQuery("client_traffic")),
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.commands")).WithCallbackData(t.encodeQuery("client_commands")),
 		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.devices")).WithCallbackData(t.encodeQuery("client_devices")),
+		),
 	)
 
 	var ReplyMarkup telego.ReplyMarkup
@@ -2217,6 +2241,9 @@ func (t *Tgbot) clientInfoMsg(
 	}
 	if printOnline {
 		output += t.I18nBot("tgbot.messages.online", "Status=="+status)
+		if traffic.LastOnline > 0 {
+			output += t.I18nBot("tgbot.messages.lastOnline", "Time=="+time.Unix(traffic.LastOnline/1000, 0).Format("2006-01-02 15:04:05"))
+		}
 	}
 	if printActive {
 		output += t.I18nBot("tgbot.messages.active", "Enable=="+active)
@@ -2283,9 +2310,28 @@ func (t *Tgbot) getClientUsage(chatId int64, tgUserID int64, email ...string) {
 }
 
 func (t *Tgbot) searchClientIps(chatId int64, email string, messageID ...int) {
-	ips, err := t.inboundService.GetInboundClientIps(email)
-	if err != nil || len(ips) == 0 {
-		ips = t.I18nBot("tgbot.noIpRecord")
+	ips := ""
+	histories, err := t.inboundService.GetClientIpHistory(email)
+	if err == nil && len(histories) > 0 {
+		for _, history := range histories {
+			location := history.Country
+			if history.ASN > 0 {
+				location = strings.TrimSpace(fmt.Sprintf("%s AS%d %s", location, history.ASN, history.ASOrg))
+			}
+			if location != "" {
+				location = " [" + location + "]"
+			}
+			ips += fmt.Sprintf("%s%s  %s → %s\r\n",
+				history.IP,
+				location,
+				time.UnixMilli(history.FirstSeen).Format("2006-01-02 15:04"),
+				time.UnixMilli(history.LastSeen).Format("2006-01-02 15:04"))
+		}
+	} else {
+		ips, err = t.inboundService.GetInboundClientIps(email)
+		if err != nil || len(ips) == 0 {
+			ips = t.I18nBot("tgbot.noIpRecord")
+		}
 	}
 
 	output := ""
@@ -2309,6 +2355,146 @@ func (t *Tgbot) searchClientIps(chatId int64, email string, messageID ...int) {
 	}
 }
 
+// answerDevicesCallback handles the buttons listing and unbinding the devices
+// of the subscription of a client.
+func (t *Tgbot) answerDevicesCallback(callbackQuery *telego.CallbackQuery, dataArray []string) {
+	chatId := callbackQuery.Message.GetChat().ID
+	messageID := callbackQuery.Message.GetMessageID()
+	email := dataArray[1]
+
+	switch dataArray[0] {
+	case "devices":
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.getDevices", "Email=="+email))
+		t.searchSubDevices(chatId, email)
+	case "devices_refresh":
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.devicesRefreshSuccess", "Email=="+email))
+		t.searchSubDevices(chatId, email, messageID)
+	case "device_unbind", "devices_unbind_c":
+		id := 0
+		if dataArray[0] == "device_unbind" {
+			if len(dataArray) < 3 {
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+				return
+			}
+			id, _ = strconv.Atoi(dataArray[2])
+			if id <= 0 {
+				t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+				return
+			}
+		}
+		_, client, err := t.inboundService.GetClientByEmail(email)
+		if err != nil || client == nil || t.subDeviceService.Unbind(client.SubID, id) != nil {
+			t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.errorOperation"))
+			return
+		}
+		t.sendCallbackAnswerTgBot(callbackQuery.ID, t.I18nBot("tgbot.answers.unbindDeviceSuccess", "Email=="+email))
+		t.searchSubDevices(chatId, email, messageID)
+	case "devices_unbind":
+		inlineKeyboard := tu.InlineKeyboard(
+			tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.cancel")).WithCallbackData(t.encodeQuery("devices_refresh "+email)),
+			),
+			tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.confirmUnbindDevices")).WithCallbackData(t.encodeQuery("devices_unbind_c "+email)),
+			),
+		)
+		t.editMessageCallbackTgBot(chatId, messageID, inlineKeyboard)
+	}
+}
+
+// searchSubDevices lists the devices the subscription of a client is bound
+// to, with a button unbinding each.
+func (t *Tgbot) searchSubDevices(chatId int64, email string, messageID ...int) {
+	_, client, err := t.inboundService.GetClientByEmail(email)
+	if err != nil || client == nil {
+		logger.Warning(err)
+		msg := t.I18nBot("tgbot.wentWrong")
+		t.SendMsgToTgbot(chatId, msg)
+		return
+	}
+
+	var devices []model.SubDevice
+	if client.SubID != "" {
+		devices, err = t.subDeviceService.GetDevices(client.SubID)
+		if err != nil {
+			logger.Warning(err)
+		}
+	}
+
+	rows := make([][]telego.InlineKeyboardButton, 0, len(devices)+2)
+	list := ""
+	for _, device := range devices {
+		name := device.Model
+		if name == "" {
+			name = device.Hwid
+		}
+		system := strings.TrimSpace(device.Os + " " + device.OsVersion)
+		if system != "" {
+			name += " (" + system + ")"
+		}
+		list += fmt.Sprintf("%s  %s\r\n", name, time.UnixMilli(device.LastSeen).Format("2006-01-02 15:04"))
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("❌ "+name).WithCallbackData(t.encodeQuery(fmt.Sprintf("device_unbind %s %d", email, device.Id))),
+		))
+	}
+	if list == "" {
+		list = t.I18nBot("tgbot.noDevices")
+	}
+
+	output := ""
+	output += t.I18nBot("tgbot.messages.email", "Email=="+email)
+	output += t.I18nBot("tgbot.messages.devices", "Devices=="+list)
+	output += t.I18nBot("tgbot.messages.refreshedOn", "Time=="+time.Now().Format("2006-01-02 15:04:05"))
+
+	rows = append(rows, tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.refresh")).WithCallbackData(t.encodeQuery("devices_refresh "+email)),
+	))
+	if len(devices) > 0 {
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.unbindAllDevices")).WithCallbackData(t.encodeQuery("devices_unbind "+email)),
+		))
+	}
+	inlineKeyboard := tu.InlineKeyboard(rows...)
+
+	if len(messageID) > 0 {
+		t.editMessageTgBot(chatId, messageID[0], output, inlineKeyboard)
+	} else {
+		t.SendMsgToTgbot(chatId, output, inlineKeyboard)
+	}
+}
+
+// getClientDevices lists the devices of each client of a Telegram user.
+func (t *Tgbot) getClientDevices(chatId int64, tgUserID int64) {
+	traffics, err := t.inboundService.GetClientTrafficTgBot(tgUserID)
+	if err != nil {
+		logger.Warning(err)
+		msg := t.I18nBot("tgbot.wentWrong")
+		t.SendMsgToTgbot(chatId, msg)
+		return
+	}
+	if len(traffics) == 0 {
+		t.SendMsgToTgbot(chatId, t.I18nBot("tgbot.answers.askToAddUserId", "TgUserID=="+strconv.FormatInt(tgUserID, 10)))
+		return
+	}
+	for _, traffic := range traffics {
+		t.searchSubDevices(chatId, traffic.Email)
+	}
+}
+
+// isClientOf tells whether a client belongs to a Telegram user.
+func (t *Tgbot) isClientOf(tgUserID int64, email string) bool {
+	traffics, err := t.inboundService.GetClientTrafficTgBot(tgUserID)
+	if err != nil {
+		return false
+	}
+	for _, traffic := range traffics {
+		if traffic.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *Tgbot) clientTelegramUserInfo(chatId int64, email string, messageID ...int) {
 	traffic, client, err := t.inboundService.GetClientByEmail(email)
 	if err != nil {
@@ -2376,6 +2562,10 @@ func (t *Tgbot) searchClient(chatId int64, email string, messageID ...int) {
 	}
 
 	output := t.clientInfoMsg(traffic, true, true, true, true, true, true)
+	destinations, err := t.analyticsService.GetTopDestinations(email, 5)
+	if err == nil && len(destinations) > 0 {
+		output += t.I18nBot("tgbot.messages.topDestinations", "Destinations=="+strings.Join(destinations, ", "))
+	}
 
 	inlineKeyboard := tu.InlineKeyboard(
 		tu.InlineKeyboardRow(
@@ -2392,6 +2582,9 @@ func (t *Tgbot) searchClient(chatId int64, email string, messageID ...int) {
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.ipLog")).WithCallbackData(t.encodeQuery("ip_log "+email)),
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.ipLimit")).WithCallbackData(t.encodeQuery("ip_limit "+email)),
 		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.devices")).WithCallbackData(t.encodeQuery("devices "+email)),
+		),
 		tu.InlineKeyboardRow(
 			tu.InlineKeyboardButton(t.I18nBot("tgbot.buttons.setTGUser")).WithCallbackData(t.encodeQuery("tg_user "+email)),
 		),
@@ -3,8 +3,10 @@ package service
 import (
 	"encoding/json"
 	"errors"
+	"slices"
 	"sync"
 
+	"x-ui/core"
 	"x-ui/logger"
 	"x-ui/xray"
 	"x-ui/database"
@@ -62,14 +64,119 @@ func RemoveIndex(s []any, index int) []any {
 	return append(s[:index], s[index+1:]...)
 }
 
+// appendRoutingRule adds a rule after the routing rules of the config.
+func appendRoutingRule(xrayConfig *xray.Config, rule map[string]any) {
+	var routing map[string]any
+	if err := json.Unmarshal(xrayConfig.RouterConfig, &routing); err != nil {
+		return
+	}
+	rules, _ := routing["rules"].([]any)
+	routing["rules"] = append(rules, rule)
+	if newRouting, err := json.MarshalIndent(routing, "", "  "); err == nil {
+		xrayConfig.RouterConfig = newRouting
+	}
+}
+
+// prependRoutingRule puts a rule before those of the template, so that it
+// takes precedence over them.
+func prependRoutingRule(xrayConfig *xray.Config, rule map[string]any) {
+	var routing map[string]any
+	if err := json.Unmarshal(xrayConfig.RouterConfig, &routing); err != nil {
+		return
+	}
+	rules, _ := routing["rules"].([]any)
+	routing["rules"] = append([]any{rule}, rules...)
+	if newRouting, err := json.MarshalIndent(routing, "", "  "); err == nil {
+		xrayConfig.RouterConfig = newRouting
+	}
+}
+
+// bittorrentOutbound returns the outbound BitTorrent is told apart by. It
+// is a blackhole when blocking is asked for, and otherwise sends BitTorrent
+// where the template does: to the outbound its BitTorrent rule routes to,
+// or else to its default, first outbound.
+func bittorrentOutbound(xrayConfig *xray.Config, block bool) map[string]any {
+	outbound := map[string]any{
+		"tag":      abuseBittorrentTag,
+		"protocol": "freedom",
+		"settings": map[string]any{},
+	}
+	if block {
+		outbound["protocol"] = "blackhole"
+		return outbound
+	}
+
+	var routing struct {
+		Rules []struct {
+			OutboundTag string   `json:"outboundTag"`
+			Protocol    []string `json:"protocol"`
+		} `json:"rules"`
+	}
+	var outbounds []map[string]any
+	json.Unmarshal(xrayConfig.RouterConfig, &routing)
+	if json.Unmarshal(xrayConfig.OutboundConfigs, &outbounds) != nil || len(outbounds) == 0 {
+		return outbound
+	}
+	target := outbounds[0]
+	for _, rule := range routing.Rules {
+		if rule.OutboundTag == "" || !slices.Contains(rule.Protocol, "bittorrent") {
+			continue
+		}
+		for _, templateOutbound := range outbounds {
+			if templateOutbound["tag"] == rule.OutboundTag {
+				target = templateOutbound
+				break
+			}
+		}
+		break
+	}
+
+	tag, _ := target["tag"].(string)
+	switch {
+	case target["protocol"] == "freedom" || target["protocol"] == "blackhole":
+		outbound["protocol"] = target["protocol"]
+		if settings, ok := target["settings"]; ok {
+			outbound["settings"] = settings
+		}
+	case tag != "":
+		// go through the outbound itself, such as WARP or a chain
+		outbound["proxySettings"] = map[string]any{"tag": tag}
+	default:
+		for key, value := range target {
+			outbound[key] = value
+		}
+		outbound["tag"] = abuseBittorrentTag
+	}
+	return outbound
+}
+
+func appendOutbound(xrayConfig *xray.Config, outbound map[string]any) {
+	var outbounds []any
+	if err := json.Unmarshal(xrayConfig.OutboundConfigs, &outbounds); err != nil {
+		return
+	}
+	outbounds = append(outbounds, outbound)
+	if newOutbounds, err := json.MarshalIndent(outbounds, "", "  "); err == nil {
+		xrayConfig.OutboundConfigs = newOutbounds
+	}
+}
+
 func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 	templateConfig, err := s.settingService.GetXrayConfigTemplate()
 	if err != nil {
 		return nil, err
 	}
 
+	s.inboundService.AddTraffic(nil, nil)
+
+	return s.genXrayConfig(templateConfig)
+}
+
+// genXrayConfig builds the xray config from the given template and the
+// blocked domains and inbounds stored in the database.
+func (s *XrayService) genXrayConfig(templateConfig string) (*xray.Config, error) {
 	xrayConfig := &xray.Config{}
-	err = json.Unmarshal([]byte(templateConfig), xrayConfig)
+	err := json.Unmarshal([]byte(templateConfig), xrayConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -82,29 +189,61 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 		for _, d := range blockedDomains {
 			domains = append(domains, d.Domain)
 		}
-		var routing map[string]any
-		if err := json.Unmarshal(xrayConfig.RouterConfig, &routing); err == nil {
-			rules, _ := routing["rules"].([]any)
-			blockRule := map[string]any{
-				"type": "field",
-				"outboundTag": "blocked",
-				"domain": domains,
-			}
-			routing["rules"] = append(rules, blockRule)
-			if newRouting, err := json.MarshalIndent(routing, "", "  "); err == nil {
-				xrayConfig.RouterConfig = newRouting
-			}
+		appendRoutingRule(xrayConfig, map[string]any{
+			"type": "field",
+			"ruleTag": "blocked-domains",
+			"outboundTag": "blocked",
+			"domain": domains,
+		})
+	}
+
+	// Clients and source IPs banned for going over their IP limit
+	bannedEmails := make(map[string]bool)
+	if bans, err := getIpLimitBans(IpLimitModeRemoveUser); err == nil {
+		for _, ban := range bans {
+			bannedEmails[ban.Email] = true
+		}
+	}
+	if bans, err := getIpLimitBans(IpLimitModeRouting); err == nil && len(bans) > 0 {
+		var ips []string
+		for _, ban := range bans {
+			ips = append(ips, ban.IP)
 		}
+		prependRoutingRule(xrayConfig, map[string]any{
+			"type":        "field",
+			"ruleTag":     ipLimitRuleTag,
+			"outboundTag": "blocked",
+			"source":      ips,
+		})
 	}
 
-	s.inboundService.AddTraffic(nil, nil)
+	// Clients suspended for abuse, and BitTorrent routed to its own blackhole
+	// for the access log to tell it apart
+	suspendedEmails := make(map[string]bool)
+	if emails, err := getSuspendedEmails(); err == nil {
+		for _, email := range emails {
+			suspendedEmails[email] = true
+		}
+	}
+	abuseDetect, _ := s.settingService.GetAbuseDetectEnable()
+	abuseBittorrent, _ := s.settingService.GetAbuseBittorrent()
+	if abuseDetect && abuseBittorrent {
+		block, _ := s.settingService.GetAbuseBittorrentBlock()
+		appendOutbound(xrayConfig, bittorrentOutbound(xrayConfig, block))
+		prependRoutingRule(xrayConfig, map[string]any{
+			"type":        "field",
+			"ruleTag":     abuseBittorrentTag,
+			"outboundTag": abuseBittorrentTag,
+			"protocol":    []string{"bittorrent"},
+		})
+	}
 
 	inbounds, err := s.inboundService.GetAllInbounds()
 	if err != nil {
 		return nil, err
 	}
 	for _, inbound := range inbounds {
-		if !inbound.Enable {
+		if !inbound.Enable || core.BackendOf(string(inbound.Protocol)) != core.Xray {
 			continue
 		}
 		// get settings clients
@@ -137,6 +276,14 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 						continue
 					}
 				}
+				if email, _ := c["email"].(string); bannedEmails[email] {
+					logger.Infof("Remove Inbound User %s due to IP limit", email)
+					continue
+				}
+				if email, _ := c["email"].(string); suspendedEmails[email] {
+					logger.Infof("Remove Inbound User %s due to abuse", email)
+					continue
+				}
 				for key := range c {
 					if key != "email" && key != "id" && key != "password" && key != "flow" && key != "method" {
 						delete(c, key)
@@ -188,22 +335,17 @@ func (s *XrayService) GetXrayConfig() (*xray.Config, error) {
 	return xrayConfig, nil
 }
 
-func (s *XrayService) GetXrayTraffic() ([]*xray.Traffic, []*xray.ClientTraffic, error) {
+// GetXrayOnlineIPs asks xray which of the clients are online and from which
+// IPs. xray.ErrOnlineStatsUnavailable is returned when xray cannot tell.
+func (s *XrayService) GetXrayOnlineIPs(emails []string) (map[string][]string, error) {
 	if !s.IsXrayRunning() {
-		err := errors.New("xray is not running")
-		logger.Debug("Attempted to fetch Xray traffic, but Xray is not running:", err)
-		return nil, nil, err
+		return nil, errors.New("xray is not running")
 	}
 	apiPort := p.GetAPIPort()
 	s.xrayAPI.Init(apiPort)
 	defer s.xrayAPI.Close()
 
-	traffic, clientTraffic, err := s.xrayAPI.GetTraffic(true)
-	if err != nil {
-		logger.Debug("Failed to fetch Xray traffic:", err)
-		return nil, nil, err
-	}
-	return traffic, clientTraffic, nil
+	return s.xrayAPI.GetOnlineIPs(emails)
 }
 
 func (s *XrayService) RestartXray(isForce bool) error {
@@ -215,12 +357,21 @@ func (s *XrayService) RestartXray(isForce bool) error {
 	if err != nil {
 		return err
 	}
+	xrayConfig = s.applyRollback(xrayConfig)
 
 	if s.IsXrayRunning() {
 		if !isForce && p.GetConfig().Equals(xrayConfig) {
 			logger.Debug("It does not need to restart xray")
 			return nil
 		}
+		if !isForce {
+			err = s.reloadXray(xrayConfig)
+			if err == nil {
+				logger.Debug("Xray config applied without restart")
+				return nil
+			}
+			logger.Debug("Xray config can not be applied without restart:", err)
+		}
 		p.Stop()
 	}
 
@@ -233,6 +384,12 @@ func (s *XrayService) RestartXray(isForce bool) error {
 	return nil
 }
 
+// reloadXray applies the difference to the running xray through its API.
+// Any error means the process has to be restarted to pick up the config.
+func (s *XrayService) reloadXray(xrayConfig *xray.Config) error {
+	return p.Apply(xrayConfig)
+}
+
 func (s *XrayService) StopXray() error {
 	lock.Lock()
 	defer lock.Unlock()
@@ -0,0 +1,452 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"x-ui/logger"
+	"x-ui/xray"
+)
+
+const (
+	minRestartBackoff = 2 * time.Second
+	maxRestartBackoff = 5 * time.Minute
+	maxDiffLines      = 60
+	// diffContextLines is the number of unchanged lines shown around the
+	// changed ones.
+	diffContextLines = 2
+	// maxDiffCells bounds the work of comparing two configs line by line.
+	maxDiffCells = 1 << 22
+)
+
+// crashLoop keeps track of how the current xray config behaves, so a config
+// that keeps crashing can be replaced by the last one known to work.
+// It is guarded by lock, like p.
+var crashLoop struct {
+	counted     *xray.Process // last process whose exit has been counted
+	running     *xray.Config  // config xray has been running since runningAt
+	runningAt   time.Time
+	crashes     int
+	nextRestart time.Time
+	goodConfig  *xray.Config
+	badConfig   *xray.Config
+	// switching is set while the xray binary is being switched, when the
+	// crashes are those of the binary and not of the config
+	switching bool
+}
+
+// XrayRollback describes an automatic rollback to the last good config.
+type XrayRollback struct {
+	Diff        string
+	CrashReport string
+}
+
+// MarkXrayConfigGood stores the running config as the last good one once
+// xray has been up with it for long enough. Configs applied to the running
+// xray through its API count from when they were applied.
+func (s *XrayService) MarkXrayConfigGood() error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !s.IsXrayRunning() {
+		return nil
+	}
+	config := p.GetConfig()
+	if crashLoop.running == nil || !crashLoop.running.Equals(config) {
+		crashLoop.running = config
+		crashLoop.runningAt = time.Now()
+	}
+	if crashLoop.crashes == 0 && crashLoop.goodConfig != nil && crashLoop.goodConfig.Equals(config) {
+		return nil
+	}
+	minutes, err := s.settingService.GetXrayGoodConfigMinutes()
+	if err != nil {
+		return err
+	}
+	goodAfter := time.Duration(minutes) * time.Minute
+	if p.GetUptime() < uint64(goodAfter.Seconds()) || time.Since(crashLoop.runningAt) < goodAfter {
+		return nil
+	}
+
+	crashLoop.crashes = 0
+	crashLoop.nextRestart = time.Time{}
+	if crashLoop.goodConfig != nil && crashLoop.goodConfig.Equals(config) {
+		return nil
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(xray.GetLastGoodConfigPath(), data, 0o600)
+	if err != nil {
+		return err
+	}
+	crashLoop.goodConfig = config
+	logger.Debug("Saved the running xray config as the last good one")
+	return nil
+}
+
+// RecoverXray restarts a stopped xray with an exponential backoff. When the
+// current config keeps crashing, xray is started with the last good config
+// instead and the returned rollback describes what has been reverted.
+func (s *XrayService) RecoverXray() (*XrayRollback, error) {
+	lock.Lock()
+	if crashLoop.switching {
+		lock.Unlock()
+		return nil, nil
+	}
+	if p != nil && crashLoop.counted != p {
+		crashLoop.counted = p
+		minutes, err := s.settingService.GetXrayGoodConfigMinutes()
+		if err != nil {
+			logger.Warning("Failed to get xray good config minutes:", err)
+		}
+		if p.GetUptime() >= uint64(minutes)*60 {
+			crashLoop.crashes = 0
+		}
+		crashLoop.crashes++
+		crashLoop.nextRestart = time.Now().Add(restartBackoff(crashLoop.crashes))
+	}
+	if time.Now().Before(crashLoop.nextRestart) {
+		lock.Unlock()
+		return nil, nil
+	}
+
+	var rollback *XrayRollback
+	loopCount, err := s.settingService.GetXrayCrashLoopCount()
+	if err != nil {
+		logger.Warning("Failed to get xray crash loop count:", err)
+	}
+	if p != nil && loopCount > 0 && crashLoop.crashes >= loopCount {
+		rollback = s.prepareRollback()
+	}
+	lock.Unlock()
+
+	if rollback != nil {
+		logger.Warning("Xray keeps crashing, rolling back to the last good config")
+	}
+	return rollback, s.RestartXray(false)
+}
+
+// setXraySwitching holds off RecoverXray while the xray binary is switched,
+// which restarts xray by itself. The crashes of the binaries tried are not
+// counted against the config.
+func setXraySwitching(switching bool) {
+	lock.Lock()
+	defer lock.Unlock()
+	crashLoop.switching = switching
+	if !switching && p != nil && !p.IsRunning() {
+		// The exit of the binary the switch ended with was reported by it
+		crashLoop.counted = p
+	}
+}
+
+// prepareRollback marks the config of the crashed process as bad, so that
+// RestartXray falls back to the last good config.
+func (s *XrayService) prepareRollback() *XrayRollback {
+	goodConfig := s.getLastGoodConfig()
+	badConfig := p.GetConfig()
+	if goodConfig == nil || badConfig == nil || goodConfig.Equals(badConfig) {
+		return nil
+	}
+	crashLoop.badConfig = badConfig
+	crashLoop.crashes = 0
+	crashLoop.nextRestart = time.Time{}
+
+	crashReport := p.GetCrashReport()
+	if crashReport == "" {
+		crashReport = p.GetResult()
+	}
+	return &XrayRollback{
+		Diff:        diffXrayConfigs(goodConfig, badConfig),
+		CrashReport: crashReport,
+	}
+}
+
+// applyRollback returns the config to start instead of xrayConfig while it is
+// the same config that has been rolled back. A changed config is always tried.
+func (s *XrayService) applyRollback(xrayConfig *xray.Config) *xray.Config {
+	if crashLoop.badConfig == nil {
+		return xrayConfig
+	}
+	if xrayConfig.Equals(crashLoop.badConfig) {
+		if goodConfig := s.getLastGoodConfig(); goodConfig != nil {
+			return goodConfig
+		}
+	}
+	crashLoop.badConfig = nil
+	return xrayConfig
+}
+
+func (s *XrayService) getLastGoodConfig() *xray.Config {
+	if crashLoop.goodConfig != nil {
+		return crashLoop.goodConfig
+	}
+	data, err := os.ReadFile(xray.GetLastGoodConfigPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warning("Failed to read the last good xray config:", err)
+		}
+		return nil
+	}
+	config := &xray.Config{}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		logger.Warning("Failed to parse the last good xray config:", err)
+		return nil
+	}
+	crashLoop.goodConfig = config
+	return config
+}
+
+func restartBackoff(crashes int) time.Duration {
+	if crashes <= 1 {
+		return 0
+	}
+	backoff := minRestartBackoff
+	for i := 2; i < crashes && backoff < maxRestartBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, maxRestartBackoff)
+}
+
+// diffXrayConfigs describes how two configs differ: first the inbounds and
+// outbounds by tag, the routing rules by index and the other sections that
+// changed, then the changed lines with some context around them.
+func diffXrayConfigs(oldConfig, newConfig *xray.Config) string {
+	var diff []string
+	diff = append(diff, diffInbounds(oldConfig.InboundConfigs, newConfig.InboundConfigs)...)
+	diff = append(diff, diffTagged("outbound", oldConfig.OutboundConfigs, newConfig.OutboundConfigs)...)
+	diff = append(diff, diffRoutingRules(oldConfig.RouterConfig, newConfig.RouterConfig)...)
+	sections := []struct {
+		name     string
+		old, new []byte
+	}{
+		{"log", oldConfig.LogConfig, newConfig.LogConfig},
+		{"dns", oldConfig.DNSConfig, newConfig.DNSConfig},
+		{"transport", oldConfig.Transport, newConfig.Transport},
+		{"policy", oldConfig.Policy, newConfig.Policy},
+		{"api", oldConfig.API, newConfig.API},
+		{"stats", oldConfig.Stats, newConfig.Stats},
+		{"reverse", oldConfig.Reverse, newConfig.Reverse},
+		{"fakedns", oldConfig.FakeDNS, newConfig.FakeDNS},
+		{"observatory", oldConfig.Observatory, newConfig.Observatory},
+		{"burstObservatory", oldConfig.BurstObservatory, newConfig.BurstObservatory},
+		{"metrics", oldConfig.Metrics, newConfig.Metrics},
+	}
+	for _, section := range sections {
+		if !jsonEqual(section.old, section.new) {
+			diff = append(diff, "changed "+section.name)
+		}
+	}
+
+	oldData, _ := json.MarshalIndent(oldConfig, "", "  ")
+	newData, _ := json.MarshalIndent(newConfig, "", "  ")
+	diff = append(diff, diffLines(strings.Split(string(oldData), "\n"), strings.Split(string(newData), "\n"))...)
+	if len(diff) > maxDiffLines {
+		diff = append(diff[:maxDiffLines], fmt.Sprintf("... %d more lines", len(diff)-maxDiffLines))
+	}
+	return strings.Join(diff, "\n")
+}
+
+func diffInbounds(oldInbounds, newInbounds []xray.InboundConfig) []string {
+	var diff []string
+	newByTag := make(map[string]*xray.InboundConfig)
+	for i := range newInbounds {
+		newByTag[newInbounds[i].Tag] = &newInbounds[i]
+	}
+	oldTags := make(map[string]bool)
+	for i := range oldInbounds {
+		oldInbound := &oldInbounds[i]
+		oldTags[oldInbound.Tag] = true
+		if newInbound, ok := newByTag[oldInbound.Tag]; !ok {
+			diff = append(diff, "removed inbound "+oldInbound.Tag)
+		} else if !oldInbound.Equals(newInbound) {
+			diff = append(diff, "changed inbound "+oldInbound.Tag)
+		}
+	}
+	for _, newInbound := range newInbounds {
+		if !oldTags[newInbound.Tag] {
+			diff = append(diff, "added inbound "+newInbound.Tag)
+		}
+	}
+	return diff
+}
+
+// diffTagged compares two JSON arrays of objects by their tags.
+func diffTagged(kind string, oldData, newData []byte) []string {
+	var oldItems, newItems []map[string]any
+	json.Unmarshal(oldData, &oldItems)
+	json.Unmarshal(newData, &newItems)
+	var diff []string
+	newByTag := make(map[string]map[string]any)
+	for _, item := range newItems {
+		tag, _ := item["tag"].(string)
+		newByTag[tag] = item
+	}
+	oldTags := make(map[string]bool)
+	for _, oldItem := range oldItems {
+		tag, _ := oldItem["tag"].(string)
+		oldTags[tag] = true
+		if newItem, ok := newByTag[tag]; !ok {
+			diff = append(diff, "removed "+kind+" "+tag)
+		} else if !valuesEqual(oldItem, newItem) {
+			diff = append(diff, "changed "+kind+" "+tag)
+		}
+	}
+	for _, newItem := range newItems {
+		if tag, _ := newItem["tag"].(string); !oldTags[tag] {
+			diff = append(diff, "added "+kind+" "+tag)
+		}
+	}
+	return diff
+}
+
+// diffRoutingRules compares the routing rules by index, naming them by their
+// ruleTag or outboundTag.
+func diffRoutingRules(oldData, newData []byte) []string {
+	var oldRouting, newRouting map[string]any
+	json.Unmarshal(oldData, &oldRouting)
+	json.Unmarshal(newData, &newRouting)
+	oldRules, _ := oldRouting["rules"].([]any)
+	newRules, _ := newRouting["rules"].([]any)
+
+	ruleName := func(index int, rule any) string {
+		name := fmt.Sprintf("routing rule #%d", index+1)
+		if rule, ok := rule.(map[string]any); ok {
+			if tag, _ := rule["ruleTag"].(string); tag != "" {
+				return name + " " + tag
+			}
+			if tag, _ := rule["outboundTag"].(string); tag != "" {
+				return name + " to " + tag
+			}
+		}
+		return name
+	}
+	var diff []string
+	for i := 0; i < max(len(oldRules), len(newRules)); i++ {
+		switch {
+		case i >= len(newRules):
+			diff = append(diff, "removed "+ruleName(i, oldRules[i]))
+		case i >= len(oldRules):
+			diff = append(diff, "added "+ruleName(i, newRules[i]))
+		case !valuesEqual(oldRules[i], newRules[i]):
+			diff = append(diff, "changed "+ruleName(i, newRules[i]))
+		}
+	}
+	delete(oldRouting, "rules")
+	delete(newRouting, "rules")
+	if !valuesEqual(oldRouting, newRouting) {
+		diff = append(diff, "changed routing")
+	}
+	return diff
+}
+
+func jsonEqual(oldData, newData []byte) bool {
+	var oldValue, newValue any
+	json.Unmarshal(oldData, &oldValue)
+	json.Unmarshal(newData, &newValue)
+	return valuesEqual(oldValue, newValue)
+}
+
+func valuesEqual(oldValue, newValue any) bool {
+	oldData, _ := json.Marshal(oldValue)
+	newData, _ := json.Marshal(newValue)
+	return bytes.Equal(oldData, newData)
+}
+
+// diffLines returns a line diff of two texts, the removed lines with "-",
+// the added ones with "+" and diffContextLines of the unchanged ones around
+// them, hunks separated by "@@". Texts too different to be compared line by
+// line are diffed as a whole.
+func diffLines(oldLines, newLines []string) []string {
+	start := 0
+	for start < len(oldLines) && start < len(newLines) && oldLines[start] == newLines[start] {
+		start++
+	}
+	oldEnd, newEnd := len(oldLines), len(newLines)
+	for oldEnd > start && newEnd > start && oldLines[oldEnd-1] == newLines[newEnd-1] {
+		oldEnd--
+		newEnd--
+	}
+	oldMiddle, newMiddle := oldLines[start:oldEnd], newLines[start:newEnd]
+
+	// ops holds the middle as ' ', '-' and '+' lines, in order
+	type op struct {
+		kind byte
+		line string
+	}
+	var ops []op
+	n, m := len(oldMiddle), len(newMiddle)
+	if n*m > maxDiffCells {
+		for _, line := range oldMiddle {
+			ops = append(ops, op{'-', line})
+		}
+		for _, line := range newMiddle {
+			ops = append(ops, op{'+', line})
+		}
+	} else {
+		// lcs[i][j] is the longest common subsequence of oldMiddle[i:] and
+		// newMiddle[j:]
+		lcs := make([][]int, n+1)
+		for i := range lcs {
+			lcs[i] = make([]int, m+1)
+		}
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				if oldMiddle[i] == newMiddle[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+		i, j := 0, 0
+		for i < n || j < m {
+			switch {
+			case i < n && j < m && oldMiddle[i] == newMiddle[j]:
+				ops = append(ops, op{' ', oldMiddle[i]})
+				i++
+				j++
+			case i < n && (j == m || lcs[i+1][j] >= lcs[i][j+1]):
+				ops = append(ops, op{'-', oldMiddle[i]})
+				i++
+			default:
+				ops = append(ops, op{'+', newMiddle[j]})
+				j++
+			}
+		}
+	}
+
+	// Surround the middle with the context the common start and end give
+	var before, after []op
+	for _, line := range oldLines[max(start-diffContextLines, 0):start] {
+		before = append(before, op{' ', line})
+	}
+	for _, line := range oldLines[oldEnd:min(oldEnd+diffContextLines, len(oldLines))] {
+		after = append(after, op{' ', line})
+	}
+	ops = append(append(before, ops...), after...)
+
+	var diff []string
+	lastShown := -1
+	for index, current := range ops {
+		show := current.kind != ' '
+		for k := max(index-diffContextLines, 0); !show && k <= min(index+diffContextLines, len(ops)-1); k++ {
+			show = ops[k].kind != ' '
+		}
+		if !show {
+			continue
+		}
+		if lastShown >= 0 && index > lastShown+1 {
+			diff = append(diff, "@@")
+		}
+		diff = append(diff, string(current.kind)+" "+current.line)
+		lastShown = index
+	}
+	return diff
+}
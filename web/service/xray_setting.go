@@ -10,6 +10,7 @@ import (
 
 type XraySettingService struct {
 	SettingService
+	xrayService XrayService
 }
 
 func (s *XraySettingService) SaveXraySetting(newXraySettings string) error {
@@ -25,5 +26,14 @@ func (s *XraySettingService) CheckXrayConfig(XrayTemplateConfig string) error {
 	if err != nil {
 		return common.NewError("xray template config invalid:", err)
 	}
+
+	// check the complete config the template would produce
+	xrayConfig, err = s.xrayService.genXrayConfig(XrayTemplateConfig)
+	if err != nil {
+		return common.NewError("xray template config invalid:", err)
+	}
+	if err = xray.ValidateConfig(xrayConfig); err != nil {
+		return common.NewError("xray template config invalid:", err)
+	}
 	return nil
 }
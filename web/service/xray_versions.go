@@ -0,0 +1,257 @@
+package service
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"x-ui/config"
+	"x-ui/logger"
+	"x-ui/util/common"
+	"x-ui/xray"
+)
+
+var xrayVersionRegex = regexp.MustCompile(`^v\d+\.\d+\.\d+$`)
+
+// xrayHealthCheckTime is how long a newly switched xray has to stay up.
+const xrayHealthCheckTime = 5 * time.Second
+
+type InstalledXrayVersion struct {
+	Version  string `json:"version"`
+	Current  bool   `json:"current"`
+	Previous bool   `json:"previous"`
+}
+
+func getXrayVersionsFolder() string {
+	return config.GetBinFolderPath() + "/xray-versions"
+}
+
+func getXrayVersionPath(version string) string {
+	return filepath.Join(getXrayVersionsFolder(), version, xray.GetBinaryName())
+}
+
+// GetInstalledXrayVersions lists the xray versions kept side by side.
+func (s *ServerService) GetInstalledXrayVersions() ([]InstalledXrayVersion, error) {
+	entries, err := os.ReadDir(getXrayVersionsFolder())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	current := s.getCurrentXrayVersion()
+	previous, _ := s.settingService.GetXrayPreviousVersion()
+
+	versions := make([]InstalledXrayVersion, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() || !xrayVersionRegex.MatchString(entry.Name()) {
+			continue
+		}
+		if _, err := os.Stat(getXrayVersionPath(entry.Name())); err != nil {
+			continue
+		}
+		versions = append(versions, InstalledXrayVersion{
+			Version:  entry.Name(),
+			Current:  entry.Name() == current,
+			Previous: entry.Name() == previous,
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return compareXrayVersions(versions[i].Version, versions[j].Version) > 0
+	})
+	return versions, nil
+}
+
+func compareXrayVersions(a string, b string) int {
+	aParts := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bParts := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aNum, _ := strconv.Atoi(aParts[i])
+		bNum, _ := strconv.Atoi(bParts[i])
+		if aNum != bNum {
+			return aNum - bNum
+		}
+	}
+	return len(aParts) - len(bParts)
+}
+
+// RollbackXray switches back to the version that was active before the
+// last switch.
+func (s *ServerService) RollbackXray() error {
+	previous, err := s.settingService.GetXrayPreviousVersion()
+	if err != nil {
+		return err
+	}
+	if previous == "" {
+		return common.NewError("there is no previous xray version")
+	}
+	return s.switchXray(previous)
+}
+
+// switchXray makes an installed version the active one. If it does not stay
+// up, the version that was active before is restored.
+func (s *ServerService) switchXray(version string) error {
+	if !xrayVersionRegex.MatchString(version) {
+		return common.NewError("invalid xray version:", version)
+	}
+	if _, err := os.Stat(getXrayVersionPath(version)); err != nil {
+		return common.NewErrorf("xray %v is not installed", version)
+	}
+
+	setXraySwitching(true)
+	defer setXraySwitching(false)
+
+	current := s.getCurrentXrayVersion()
+	if current != "" {
+		if err := s.archiveActiveXray(current); err != nil {
+			logger.Warning("Failed to keep the active xray binary:", err)
+		}
+	}
+
+	if err := activateXrayBinary(version); err != nil {
+		return err
+	}
+	err := s.restartAndCheckXray()
+	if err != nil && current != "" && current != version {
+		logger.Warningf("xray %v failed to start, reverting to %v: %v", version, current, err)
+		if revertErr := activateXrayBinary(current); revertErr != nil {
+			return common.Combine(err, revertErr)
+		}
+		if revertErr := s.restartAndCheckXray(); revertErr != nil {
+			logger.Error("start reverted xray failed:", revertErr)
+		}
+		return common.NewErrorf("xray %v failed to start and has been reverted to %v: %v", version, current, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	if current != version {
+		s.settingService.SetXrayPreviousVersion(current)
+	}
+	return s.settingService.SetXrayCurrentVersion(version)
+}
+
+func (s *ServerService) restartAndCheckXray() error {
+	s.xrayService.StopXray()
+	err := s.xrayService.RestartXray(true)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(xrayHealthCheckTime)
+	for time.Now().Before(deadline) {
+		time.Sleep(500 * time.Millisecond)
+		if !s.xrayService.IsXrayRunning() {
+			result := s.xrayService.GetXrayResult()
+			if result == "" {
+				result = "xray exited"
+			}
+			return common.NewError(result)
+		}
+	}
+	return nil
+}
+
+// getCurrentXrayVersion returns the active version, as recorded on the last
+// switch or as reported by the running binary.
+func (s *ServerService) getCurrentXrayVersion() string {
+	current, _ := s.settingService.GetXrayCurrentVersion()
+	if current != "" {
+		return current
+	}
+	version := s.xrayService.GetXrayVersion()
+	if version == "" || version == "Unknown" {
+		return ""
+	}
+	return "v" + version
+}
+
+// archiveActiveXray keeps a copy of the active binary, which may have been
+// installed before versions were kept side by side.
+func (s *ServerService) archiveActiveXray(version string) error {
+	if !xrayVersionRegex.MatchString(version) {
+		return nil
+	}
+	if _, err := os.Stat(getXrayVersionPath(version)); err == nil {
+		return nil
+	}
+	if _, err := os.Stat(xray.GetBinaryPath()); err != nil {
+		return nil
+	}
+	return copyFile(xray.GetBinaryPath(), getXrayVersionPath(version))
+}
+
+// activateXrayBinary atomically replaces the active binary with a copy of the
+// given installed version.
+func activateXrayBinary(version string) error {
+	tmpPath := xray.GetBinaryPath() + ".new"
+	if err := copyFile(getXrayVersionPath(version), tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, xray.GetBinaryPath())
+}
+
+func copyFile(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o755)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	return common.Combine(err, out.Close())
+}
+
+// verifyDigest checks a downloaded release file against the SHA2-256 line of
+// the .dgst file published next to it.
+func verifyDigest(fileName string, dgstURL string) error {
+	resp, err := http.Get(dgstURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return common.NewErrorf("failed to download digest: %v", resp.Status)
+	}
+
+	expected := ""
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), "=")
+		if ok && strings.TrimSpace(name) == "SHA2-256" {
+			expected = strings.ToLower(strings.TrimSpace(value))
+			break
+		}
+	}
+	if expected == "" {
+		return common.NewError("no SHA2-256 digest found for", fileName)
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if actual != expected {
+		return common.NewErrorf("checksum mismatch for %s: expected %s, got %s", fileName, expected, actual)
+	}
+	return nil
+}
@@ -42,6 +42,12 @@ var i18nFS embed.FS
 
 var startTime = time.Now()
 
+// EmbeddedAssets returns the static assets of the panel, for the
+// subscription server to reuse them.
+func EmbeddedAssets() embed.FS {
+	return assetsFS
+}
+
 type wrapAssetsFS struct {
 	embed.FS
 }
@@ -88,10 +94,13 @@ type Server struct {
 	api    *controller.APIController
 
 	xrayService    service.XrayService
+	singboxService service.SingboxService
 	settingService service.SettingService
 	tgbotService   service.Tgbot
+	ipLimitService service.IpLimitService
 
 	cron *cron.Cron
+	jobs *job.Registry
 
 	ctx    context.Context
 	cancel context.CancelFunc
@@ -249,33 +258,64 @@ func (s *Server) startTask() {
 	if err != nil {
 		logger.Warning("start xray failed:", err)
 	}
+	err = s.singboxService.RestartSingbox(true)
+	if err != nil {
+		logger.Warning("start sing-box failed:", err)
+	}
+	err = s.ipLimitService.RestoreBans()
+	if err != nil {
+		logger.Warning("restore nftables bans failed:", err)
+	}
+
 	// Check whether xray is running every second
-	s.cron.AddJob("@every 1s", job.NewCheckXrayRunningJob())
+	s.registerJob("checkXrayRunning", "@every 1s", job.NewCheckXrayRunningJob())
 
 	// Check if xray needs to be restarted every 30 seconds
-	s.cron.AddFunc("@every 30s", func() {
+	s.registerJob("restartXrayIfNeeded", "@every 30s", cron.FuncJob(func() {
 		if s.xrayService.IsNeedRestartAndSetFalse() {
 			err := s.xrayService.RestartXray(false)
 			if err != nil {
 				logger.Error("restart xray failed:", err)
 			}
 		}
-	})
+	}))
+
+	// Keep sing-box in line with its inbounds every 30 seconds
+	s.registerJob("syncSingbox", "@every 30s", cron.FuncJob(func() {
+		err := s.singboxService.RestartSingbox(false)
+		if err != nil {
+			logger.Error("sync sing-box failed:", err)
+		}
+	}))
 
 	go func() {
 		time.Sleep(time.Second * 5)
 		// Statistics every 10 seconds, start the delay for 5 seconds for the first time, and staggered with the time to restart xray
-		s.cron.AddJob("@every 10s", job.NewXrayTrafficJob())
+		s.registerJob("xrayTraffic", "@every 10s", job.NewXrayTrafficJob())
 	}()
 
+	// Update the custom geo files whose schedule is due
+	s.registerJob("geodataUpdate", "@every 1m", job.NewGeoUpdateJob())
+
+	// Parse new access log lines every 5 seconds
+	s.registerJob("accessLog", "@every 5s", job.NewAccessLogJob())
+
+	// Save the per client destination counts every minute
+	s.registerJob("clientAnalytics", "@every 1m", job.NewAnalyticsJob())
+
+	// Check the clients against the abuse rules every minute
+	s.registerJob("abuse", "@every 1m", job.NewAbuseJob())
+
+	// Report the subscriptions fetched from many IPs every 10 minutes
+	s.registerJob("subAccess", "@every 10m", job.NewSubAccessJob())
+
 	// check client ips from log file every 10 sec
-	s.cron.AddJob("@every 10s", job.NewCheckClientIpJob())
+	s.registerJob("checkClientIp", "@every 10s", job.NewCheckClientIpJob())
 
 	// check client ips from log file every day
-	s.cron.AddJob("@daily", job.NewClearLogsJob())
+	s.registerJob("clearLogs", "@daily", job.NewClearLogsJob())
 
 	// Make a traffic condition every day, 8:30
-	var entry cron.EntryID
 	isTgbotenabled, err := s.settingService.GetTgbotEnabled()
 	if (err == nil) && (isTgbotenabled) {
 		runtime, err := s.settingService.GetTgbotRuntime()
@@ -284,22 +324,26 @@ func (s *Server) startTask() {
 			runtime = "@daily"
 		}
 		logger.Infof("Tg notify enabled,run at %s", runtime)
-		_, err = s.cron.AddJob(runtime, job.NewStatsNotifyJob())
+		err = s.jobs.Register("statsNotify", runtime, job.NewStatsNotifyJob())
 		if err != nil {
 			logger.Warning("Add NewStatsNotifyJob error", err)
 			return
 		}
 
 		// check for Telegram bot callback query hash storage reset
-		s.cron.AddJob("@every 2m", job.NewCheckHashStorageJob())
+		s.registerJob("checkHashStorage", "@every 2m", job.NewCheckHashStorageJob())
 
 		// Check CPU load and alarm to TgBot if threshold passes
 		cpuThreshold, err := s.settingService.GetTgCpu()
 		if (err == nil) && (cpuThreshold > 0) {
-			s.cron.AddJob("@every 10s", job.NewCheckCpuJob())
+			s.registerJob("checkCpu", "@every 10s", job.NewCheckCpuJob())
 		}
-	} else {
-		s.cron.Remove(entry)
+	}
+}
+
+func (s *Server) registerJob(name string, spec string, j cron.Job) {
+	if err := s.jobs.Register(name, spec, j); err != nil {
+		logger.Warningf("Add job %s failed: %v", name, err)
 	}
 }
 
@@ -317,6 +361,7 @@ func (s *Server) Start() (err error) {
 	}
 	s.cron = cron.New(cron.WithLocation(loc), cron.WithSeconds())
 	s.cron.Start()
+	s.jobs = job.InitRegistry(s.cron)
 
 	engine, err := s.initRouter()
 	if err != nil {
@@ -384,6 +429,7 @@ func (s *Server) Start() (err error) {
 func (s *Server) Stop() error {
 	s.cancel()
 	s.xrayService.StopXray()
+	s.singboxService.StopSingbox()
 	if s.cron != nil {
 		s.cron.Stop()
 	}
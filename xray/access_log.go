@@ -0,0 +1,178 @@
+package xray
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// accessLogReadLimit bounds how much of the access log is read at once.
+const accessLogReadLimit = 16 << 20
+
+var (
+	accessLineRegex  = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)?) from (\S+) (accepted|rejected)\s+(.*)$`)
+	accessRouteRegex = regexp.MustCompile(`^\[([^\]]*?)\s*(?:>>|->)\s*([^\]]*)\]\s*`)
+	accessEmailRegex = regexp.MustCompile(`(?:^|\s)email: (.+)$`)
+)
+
+// AccessRecord is a connection logged in the xray access log.
+type AccessRecord struct {
+	Time        time.Time `json:"time"`
+	Email       string    `json:"email"`
+	SourceIP    string    `json:"sourceIp"`
+	InboundTag  string    `json:"inboundTag"`
+	Network     string    `json:"network"`
+	Destination string    `json:"destination"`
+	OutboundTag string    `json:"outboundTag"`
+	Accepted    bool      `json:"accepted"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// ParseAccessLine parses a line of the access log, such as
+//
+//	2025/01/02 15:04:05.123456 from tcp:1.2.3.4:5678 accepted tcp:example.com:443 [in >> direct] email: user
+//
+// Lines that are not about a connection are reported as not ok.
+func ParseAccessLine(line string) (*AccessRecord, bool) {
+	matches := accessLineRegex.FindStringSubmatch(strings.TrimSpace(line))
+	if matches == nil {
+		return nil, false
+	}
+	t, err := time.ParseInLocation("2006/01/02 15:04:05", matches[1], time.Local)
+	if err != nil {
+		return nil, false
+	}
+
+	record := &AccessRecord{
+		Time:     t,
+		Accepted: matches[3] == "accepted",
+	}
+	record.SourceIP = parseAccessSource(matches[2])
+	if record.SourceIP == "" {
+		return nil, false
+	}
+
+	rest := matches[4]
+	if emailMatches := accessEmailRegex.FindStringSubmatchIndex(rest); emailMatches != nil {
+		record.Email = strings.TrimSpace(rest[emailMatches[2]:emailMatches[3]])
+		rest = strings.TrimSpace(rest[:emailMatches[0]])
+	}
+	if !record.Accepted {
+		record.Reason = rest
+		return record, true
+	}
+
+	destination, rest, _ := strings.Cut(rest, " ")
+	if network, address, ok := strings.Cut(destination, ":"); ok && (network == "tcp" || network == "udp") {
+		record.Network = network
+		destination = address
+	}
+	record.Destination = destination
+	if routeMatches := accessRouteRegex.FindStringSubmatch(strings.TrimSpace(rest)); routeMatches != nil {
+		record.InboundTag = strings.TrimSpace(routeMatches[1])
+		record.OutboundTag = strings.TrimSpace(routeMatches[2])
+	}
+	return record, true
+}
+
+// parseAccessSource returns the IP of a source such as tcp:1.2.3.4:5678 or
+// [::1]:5678.
+func parseAccessSource(source string) string {
+	source = strings.TrimPrefix(strings.TrimPrefix(source, "tcp:"), "udp:")
+	host, _, err := net.SplitHostPort(source)
+	if err != nil {
+		host = strings.Trim(source, "[]")
+	}
+	if net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
+
+// AccessLogTailer reads the lines appended to the access log since the last
+// read. It starts at the end of the file and follows the file when it is
+// truncated or replaced, as when it is rotated, by its inode and size.
+type AccessLogTailer struct {
+	path   string
+	info   os.FileInfo
+	offset int64
+}
+
+func NewAccessLogTailer() *AccessLogTailer {
+	return &AccessLogTailer{}
+}
+
+// Read returns the records appended since the last read. The lines read are
+// also copied to w, unless it is nil; failing to copy them is reported along
+// with the records.
+func (t *AccessLogTailer) Read(path string, w io.Writer) ([]*AccessRecord, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case t.info == nil || t.path != path:
+		t.offset = info.Size()
+	case !os.SameFile(t.info, info) || info.Size() < t.offset:
+		t.offset = 0
+	}
+	t.path = path
+	t.info = info
+	if info.Size() == t.offset {
+		return nil, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(t.offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	var records []*AccessRecord
+	var copyErr error
+	reader := bufio.NewReader(io.LimitReader(file, accessLogReadLimit))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// A line without its newline is still being written.
+			break
+		}
+		t.offset += int64(len(line))
+		if w != nil && copyErr == nil {
+			_, copyErr = io.WriteString(w, line)
+		}
+		if record, ok := ParseAccessLine(line); ok {
+			records = append(records, record)
+		}
+	}
+	return records, copyErr
+}
+
+// Truncate empties the access log once it has been read entirely and has
+// grown past limit. xray appends to the log, so it goes on writing at the
+// start of the emptied file, where the next read picks it up.
+func (t *AccessLogTailer) Truncate(limit int64) error {
+	if t.info == nil || t.offset < limit {
+		return nil
+	}
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	if !os.SameFile(t.info, info) || info.Size() != t.offset {
+		// lines written since the last read are left to the next one
+		return nil
+	}
+	if err := os.Truncate(t.path, 0); err != nil {
+		return err
+	}
+	t.offset = 0
+	return nil
+}
@@ -3,8 +3,10 @@ package xray
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
+	"sync"
 	"time"
 	"math"
 
@@ -12,6 +14,7 @@ import (
 	"x-ui/util/common"
 
 	"github.com/xtls/xray-core/app/proxyman/command"
+	routerService "github.com/xtls/xray-core/app/router/command"
 	statsService "github.com/xtls/xray-core/app/stats/command"
 	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/serial"
@@ -22,12 +25,15 @@ import (
 	"github.com/xtls/xray-core/proxy/vless"
 	"github.com/xtls/xray-core/proxy/vmess"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 type XrayAPI struct {
 	HandlerServiceClient *command.HandlerServiceClient
 	StatsServiceClient   *statsService.StatsServiceClient
+	RoutingServiceClient *routerService.RoutingServiceClient
 	grpcClient           *grpc.ClientConn
 	isConnected          bool
 }
@@ -48,9 +54,11 @@ func (x *XrayAPI) Init(apiPort int) error {
 
 	hsClient := command.NewHandlerServiceClient(conn)
 	ssClient := statsService.NewStatsServiceClient(conn)
+	rsClient := routerService.NewRoutingServiceClient(conn)
 
 	x.HandlerServiceClient = &hsClient
 	x.StatsServiceClient = &ssClient
+	x.RoutingServiceClient = &rsClient
 
 	return nil
 }
@@ -61,6 +69,7 @@ func (x *XrayAPI) Close() {
 	}
 	x.HandlerServiceClient = nil
 	x.StatsServiceClient = nil
+	x.RoutingServiceClient = nil
 	x.isConnected = false
 }
 
@@ -93,6 +102,85 @@ func (x *XrayAPI) DelInbound(tag string) error {
 	return err
 }
 
+func (x *XrayAPI) AddOutbound(outbound []byte) error {
+	client := *x.HandlerServiceClient
+
+	conf := new(conf.OutboundDetourConfig)
+	err := json.Unmarshal(outbound, conf)
+	if err != nil {
+		logger.Debug("Failed to unmarshal outbound:", err)
+		return err
+	}
+	config, err := conf.Build()
+	if err != nil {
+		logger.Debug("Failed to build outbound Detour:", err)
+		return err
+	}
+
+	_, err = client.AddOutbound(context.Background(), &command.AddOutboundRequest{Outbound: config})
+	return err
+}
+
+func (x *XrayAPI) DelOutbound(tag string) error {
+	client := *x.HandlerServiceClient
+	_, err := client.RemoveOutbound(context.Background(), &command.RemoveOutboundRequest{
+		Tag: tag,
+	})
+	return err
+}
+
+// AddRules appends the given routing rules to the end of the running router.
+func (x *XrayAPI) AddRules(rules []json.RawMessage) error {
+	if x.RoutingServiceClient == nil {
+		return common.NewError("xray RoutingServiceClient is not initialized")
+	}
+	routerConfig := &conf.RouterConfig{RuleList: rules}
+	config, err := routerConfig.Build()
+	if err != nil {
+		logger.Debug("Failed to build routing rules:", err)
+		return err
+	}
+
+	_, err = (*x.RoutingServiceClient).AddRule(context.Background(), &routerService.AddRuleRequest{
+		Config:       serial.ToTypedMessage(config),
+		ShouldAppend: true,
+	})
+	return err
+}
+
+// ReplaceRouting replaces the rules and balancers of the running xray with
+// those of the given routing config.
+func (x *XrayAPI) ReplaceRouting(routing []byte) error {
+	if x.RoutingServiceClient == nil {
+		return common.NewError("xray RoutingServiceClient is not initialized")
+	}
+	routerConfig := &conf.RouterConfig{}
+	if err := json.Unmarshal(routing, routerConfig); err != nil {
+		return err
+	}
+	config, err := routerConfig.Build()
+	if err != nil {
+		logger.Debug("Failed to build routing:", err)
+		return err
+	}
+
+	_, err = (*x.RoutingServiceClient).AddRule(context.Background(), &routerService.AddRuleRequest{
+		Config:       serial.ToTypedMessage(config),
+		ShouldAppend: false,
+	})
+	return err
+}
+
+func (x *XrayAPI) RemoveRule(ruleTag string) error {
+	if x.RoutingServiceClient == nil {
+		return common.NewError("xray RoutingServiceClient is not initialized")
+	}
+	_, err := (*x.RoutingServiceClient).RemoveRule(context.Background(), &routerService.RemoveRuleRequest{
+		RuleTag: ruleTag,
+	})
+	return err
+}
+
 func (x *XrayAPI) AddUser(Protocol string, inboundTag string, user map[string]any) error {
 	var account *serial.TypedMessage
 	switch Protocol {
@@ -205,6 +293,108 @@ func (x *XrayAPI) GetTraffic(reset bool) ([]*Traffic, []*ClientTraffic, error) {
 	return mapToSlice(tagTrafficMap), mapToSlice(emailTrafficMap), nil
 }
 
+// ErrOnlineStatsUnavailable is returned by GetOnlineIPs when the core cannot
+// tell which users are online, either because it is too old to have the
+// online stats API or because statsUserOnline is not enabled in its policy.
+var ErrOnlineStatsUnavailable = errors.New("xray online stats are unavailable")
+
+const (
+	// onlineStatsWorkers bounds the online stats requests in flight at once.
+	onlineStatsWorkers = 16
+	// onlineStatsTimeout bounds each online stats request.
+	onlineStatsTimeout = 3 * time.Second
+)
+
+// GetOnlineIPs returns the IPs each of the given users is connected from,
+// leaving out the users who are offline. Who is online is asked first, and
+// the IPs only of those who are.
+func (x *XrayAPI) GetOnlineIPs(emails []string) (map[string][]string, error) {
+	if x.grpcClient == nil || x.StatsServiceClient == nil {
+		return nil, common.NewError("xray api is not initialized")
+	}
+
+	var (
+		lock      sync.Mutex
+		wg        sync.WaitGroup
+		onlineIPs = make(map[string][]string)
+		found     bool
+		errs      []error
+	)
+	queue := make(chan string)
+	for i := 0; i < min(onlineStatsWorkers, len(emails)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for email := range queue {
+				ips, tracked, err := x.getOnlineIPs(email)
+				lock.Lock()
+				switch {
+				case err != nil:
+					errs = append(errs, err)
+				case tracked:
+					found = true
+					if len(ips) > 0 {
+						onlineIPs[email] = ips
+					}
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	for _, email := range emails {
+		queue <- email
+	}
+	close(queue)
+	wg.Wait()
+
+	for _, err := range errs {
+		if status.Code(err) == codes.Unimplemented {
+			return nil, ErrOnlineStatsUnavailable
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	// Without statsUserOnline no user is ever tracked
+	if !found && len(emails) > 0 {
+		return nil, ErrOnlineStatsUnavailable
+	}
+	return onlineIPs, nil
+}
+
+// getOnlineIPs returns the IPs a user is connected from, and whether xray
+// tracks the user at all.
+func (x *XrayAPI) getOnlineIPs(email string) ([]string, bool, error) {
+	name := "user>>>" + email + ">>>online"
+	ctx, cancel := context.WithTimeout(context.Background(), onlineStatsTimeout)
+	defer cancel()
+
+	resp, err := (*x.StatsServiceClient).GetStatsOnline(ctx, &statsService.GetStatsRequest{Name: name})
+	if err != nil {
+		if status.Code(err) == codes.Unknown {
+			// The user has not connected since xray started
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	if resp.GetStat().GetValue() == 0 {
+		return nil, true, nil
+	}
+
+	ipResp, err := (*x.StatsServiceClient).GetStatsOnlineIpList(ctx, &statsService.GetStatsRequest{Name: name})
+	if err != nil {
+		if status.Code(err) == codes.Unknown {
+			return nil, true, nil
+		}
+		return nil, false, err
+	}
+	ips := make([]string, 0, len(ipResp.GetIps()))
+	for ip := range ipResp.GetIps() {
+		ips = append(ips, ip)
+	}
+	return ips, true, nil
+}
+
 func processTraffic(matches []string, value int64, trafficMap map[string]*Traffic) {
 	isInbound := matches[1] == "inbound"
 	tag := matches[2]
@@ -0,0 +1,53 @@
+package xray
+
+import (
+	"encoding/json"
+)
+
+// The methods below let a running xray be driven as a generic core backend.
+
+func (p *Process) Name() string {
+	return "xray"
+}
+
+// ApplyConfig applies the new config through the API. Any error means it can
+// only take effect after a restart.
+func (p *Process) ApplyConfig(data []byte) error {
+	newConfig := &Config{}
+	if err := json.Unmarshal(data, newConfig); err != nil {
+		return err
+	}
+	return p.Apply(newConfig)
+}
+
+// Apply applies the difference between the running config and newConfig
+// through the API, then keeps newConfig as the running one.
+func (p *Process) Apply(newConfig *Config) error {
+	api, err := p.connectAPI()
+	if err != nil {
+		return err
+	}
+	defer api.Close()
+
+	if err := Reconcile(api, p.GetConfig(), newConfig); err != nil {
+		return err
+	}
+	return p.UpdateConfig(newConfig)
+}
+
+func (p *Process) GetTraffic(reset bool) ([]*Traffic, []*ClientTraffic, error) {
+	api, err := p.connectAPI()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer api.Close()
+	return api.GetTraffic(reset)
+}
+
+func (p *Process) connectAPI() (*XrayAPI, error) {
+	api := new(XrayAPI)
+	if err := api.Init(p.GetAPIPort()); err != nil {
+		return nil, err
+	}
+	return api, nil
+}
@@ -10,4 +10,8 @@ type ClientTraffic struct {
 	ExpiryTime int64  `json:"expiryTime" form:"expiryTime"`
 	Total      int64  `json:"total" form:"total"`
 	Reset      int    `json:"reset" form:"reset" gorm:"default:0"`
+	LastOnline int64  `json:"lastOnline" form:"lastOnline" gorm:"default:0"`
+	// CreatedAt is when the client was created, or for clients created
+	// before it was recorded, when it first was.
+	CreatedAt int64 `json:"createdAt" form:"createdAt" gorm:"autoCreateTime:milli"`
 }
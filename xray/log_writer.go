@@ -12,7 +12,8 @@ func NewLogWriter() *LogWriter {
 }
 
 type LogWriter struct {
-	lastLine string
+	lastLine  string
+	lastCrash string
 }
 
 func (lw *LogWriter) Write(m []byte) (n int, err error) {
@@ -25,6 +26,7 @@ func (lw *LogWriter) Write(m []byte) (n int, err error) {
 	if crashRegex.MatchString(message) {
 		logger.Debug("Core crash detected:\n", message)
 		lw.lastLine = message
+		lw.lastCrash = message
 		err1 := writeCrashReport(m)
 		if err1 != nil {
 			logger.Error("Unable to write crash report:", err1)
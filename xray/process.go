@@ -9,6 +9,7 @@ import (
 	"os"
 	"os/exec"
 	"runtime"
+	"sync"
 	"syscall"
 	"time"
 
@@ -29,6 +30,11 @@ func GetConfigPath() string {
 	return config.GetBinFolderPath() + "/config.json"
 }
 
+// GetLastGoodConfigPath is where the last config that kept xray running is kept.
+func GetLastGoodConfigPath() string {
+	return config.GetBinFolderPath() + "/config.good.json"
+}
+
 func GetGeositePath() string {
 	return config.GetBinFolderPath() + "/geosite.dat"
 }
@@ -101,7 +107,9 @@ type process struct {
 	version string
 	apiPort int
 
-	onlineClients []string
+	onlineLock      sync.RWMutex
+	onlineClients   []string
+	onlineClientIps map[string][]string
 
 	config    *Config
 	logWriter *LogWriter
@@ -139,6 +147,11 @@ func (p *process) GetResult() string {
 	return p.logWriter.lastLine
 }
 
+// GetCrashReport returns the last crash output of the core, if any.
+func (p *process) GetCrashReport() string {
+	return p.logWriter.lastCrash
+}
+
 func (p *process) GetVersion() string {
 	return p.version
 }
@@ -152,13 +165,31 @@ func (p *Process) GetConfig() *Config {
 }
 
 func (p *Process) GetOnlineClients() []string {
+	p.onlineLock.RLock()
+	defer p.onlineLock.RUnlock()
 	return p.onlineClients
 }
 
 func (p *Process) SetOnlineClients(users []string) {
+	p.onlineLock.Lock()
+	defer p.onlineLock.Unlock()
 	p.onlineClients = users
 }
 
+// GetOnlineClientIps returns the IPs of the online clients as last told by
+// the online stats API, or nil when the API is unavailable.
+func (p *Process) GetOnlineClientIps() map[string][]string {
+	p.onlineLock.RLock()
+	defer p.onlineLock.RUnlock()
+	return p.onlineClientIps
+}
+
+func (p *Process) SetOnlineClientIps(clientIps map[string][]string) {
+	p.onlineLock.Lock()
+	defer p.onlineLock.Unlock()
+	p.onlineClientIps = clientIps
+}
+
 func (p *Process) GetUptime() uint64 {
 	return uint64(time.Since(p.startTime).Seconds())
 }
@@ -199,23 +230,12 @@ func (p *process) Start() (err error) {
 		}
 	}()
 
-	data, err := json.MarshalIndent(p.config, "", "  ")
+	err = p.writeConfig()
 	if err != nil {
-		return common.NewErrorf("Failed to generate XRAY configuration files: %v", err)
-	}
-
-	err = os.MkdirAll(config.GetLogFolder(), 0o770)
-	if err != nil {
-		logger.Warningf("Failed to create log folder: %s", err)
-	}
-
-	configPath := GetConfigPath()
-	err = os.WriteFile(configPath, data, fs.ModePerm)
-	if err != nil {
-		return common.NewErrorf("Failed to write configuration file: %v", err)
+		return err
 	}
 
-	cmd := exec.Command(GetBinaryPath(), "-c", configPath)
+	cmd := exec.Command(GetBinaryPath(), "-c", GetConfigPath())
 	p.cmd = cmd
 
 	cmd.Stdout = p.logWriter
@@ -235,6 +255,32 @@ func (p *process) Start() (err error) {
 	return nil
 }
 
+// UpdateConfig replaces the configuration of a running process after it has
+// been applied through the API, so the file on disk stays in sync.
+func (p *process) UpdateConfig(xrayConfig *Config) error {
+	p.config = xrayConfig
+	p.refreshAPIPort()
+	return p.writeConfig()
+}
+
+func (p *process) writeConfig() error {
+	data, err := json.MarshalIndent(p.config, "", "  ")
+	if err != nil {
+		return common.NewErrorf("Failed to generate XRAY configuration files: %v", err)
+	}
+
+	err = os.MkdirAll(config.GetLogFolder(), 0o770)
+	if err != nil {
+		logger.Warningf("Failed to create log folder: %s", err)
+	}
+
+	err = os.WriteFile(GetConfigPath(), data, fs.ModePerm)
+	if err != nil {
+		return common.NewErrorf("Failed to write configuration file: %v", err)
+	}
+	return nil
+}
+
 func (p *process) Stop() error {
 	if !p.IsRunning() {
 		return errors.New("xray is not running")
@@ -0,0 +1,504 @@
+package xray
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"x-ui/logger"
+)
+
+// ErrRestartRequired is returned when the difference between two configs
+// cannot be applied through the API of a running xray.
+var ErrRestartRequired = errors.New("xray restart is required")
+
+// apiUserProtocols are the protocols whose users can be altered at runtime.
+var apiUserProtocols = map[string]bool{
+	"vmess":       true,
+	"vless":       true,
+	"trojan":      true,
+	"shadowsocks": true,
+}
+
+type reconcileOp struct {
+	desc  string
+	apply func(api *XrayAPI) error
+}
+
+// The config the running xray was started with falls behind when inbounds
+// and users are changed through the API directly, so the ops are idempotent:
+// taking away what is missing is done already, and what exists already is
+// replaced.
+
+// isMissing tells whether xray refused to remove something it does not have.
+func isMissing(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "not found") || strings.Contains(msg, "not enough information for making a decision")
+}
+
+// isExisting tells whether xray refused to add something it already has.
+func isExisting(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "existing tag found") || strings.Contains(msg, "already exists") || strings.Contains(msg, "duplicate ruleTag")
+}
+
+// ignoreMissing treats removing what is missing as done.
+func ignoreMissing(err error) error {
+	if err != nil && isMissing(err) {
+		return nil
+	}
+	return err
+}
+
+// Reconcile applies the difference between the running config and the new
+// one through the xray API: inbounds, outbounds, clients and tagged routing
+// rules are added or removed one by one instead of restarting the core.
+// ErrRestartRequired is returned, before anything is touched, when some part
+// of the difference can only be applied by a restart.
+func Reconcile(api *XrayAPI, oldConfig, newConfig *Config) error {
+	ops, err := planReconcile(oldConfig, newConfig)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		logger.Debug("Xray reconcile:", op.desc)
+		if err := op.apply(api); err != nil {
+			return fmt.Errorf("%s: %w", op.desc, err)
+		}
+	}
+	return nil
+}
+
+func planReconcile(oldConfig, newConfig *Config) ([]reconcileOp, error) {
+	if oldConfig == nil || newConfig == nil {
+		return nil, ErrRestartRequired
+	}
+	staticSections := [][2][]byte{
+		{oldConfig.LogConfig, newConfig.LogConfig},
+		{oldConfig.DNSConfig, newConfig.DNSConfig},
+		{oldConfig.Transport, newConfig.Transport},
+		{oldConfig.Policy, newConfig.Policy},
+		{oldConfig.API, newConfig.API},
+		{oldConfig.Stats, newConfig.Stats},
+		{oldConfig.Reverse, newConfig.Reverse},
+		{oldConfig.FakeDNS, newConfig.FakeDNS},
+		{oldConfig.Observatory, newConfig.Observatory},
+		{oldConfig.BurstObservatory, newConfig.BurstObservatory},
+		{oldConfig.Metrics, newConfig.Metrics},
+	}
+	for _, section := range staticSections {
+		if !bytes.Equal(section[0], section[1]) {
+			return nil, ErrRestartRequired
+		}
+	}
+
+	removeRules, addRules, err := planRouting(oldConfig.RouterConfig, newConfig.RouterConfig)
+	if err != nil {
+		return nil, err
+	}
+	removeOutbounds, addOutbounds, err := planOutbounds(oldConfig.OutboundConfigs, newConfig.OutboundConfigs)
+	if err != nil {
+		return nil, err
+	}
+	removeInbounds, addInbounds, err := planInbounds(oldConfig.InboundConfigs, newConfig.InboundConfigs)
+	if err != nil {
+		return nil, err
+	}
+
+	// take things away first, so re-added tags do not collide
+	ops := make([]reconcileOp, 0)
+	ops = append(ops, removeRules...)
+	ops = append(ops, removeInbounds...)
+	ops = append(ops, removeOutbounds...)
+	ops = append(ops, addOutbounds...)
+	ops = append(ops, addInbounds...)
+	ops = append(ops, addRules...)
+	return ops, nil
+}
+
+func planInbounds(oldInbounds, newInbounds []InboundConfig) (removeOps, addOps []reconcileOp, err error) {
+	oldByTag, err := inboundsByTag(oldInbounds)
+	if err != nil {
+		return nil, nil, err
+	}
+	newByTag, err := inboundsByTag(newInbounds)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, oldInbound := range oldInbounds {
+		if _, ok := newByTag[oldInbound.Tag]; !ok {
+			if oldInbound.Tag == "api" {
+				return nil, nil, ErrRestartRequired
+			}
+			removeOps = append(removeOps, delInboundOp(oldInbound.Tag))
+		}
+	}
+
+	for i := range newInbounds {
+		newInbound := &newInbounds[i]
+		oldInbound, ok := oldByTag[newInbound.Tag]
+		if ok && oldInbound.Equals(newInbound) {
+			continue
+		}
+		if newInbound.Tag == "api" {
+			return nil, nil, ErrRestartRequired
+		}
+		if !ok {
+			addOps = append(addOps, addInboundOp(newInbound))
+			continue
+		}
+
+		userRemoves, userAdds, ok := planUsers(oldInbound, newInbound)
+		if ok {
+			removeOps = append(removeOps, userRemoves...)
+			addOps = append(addOps, userAdds...)
+			continue
+		}
+		removeOps = append(removeOps, delInboundOp(oldInbound.Tag))
+		addOps = append(addOps, addInboundOp(newInbound))
+	}
+	return removeOps, addOps, nil
+}
+
+func inboundsByTag(inbounds []InboundConfig) (map[string]*InboundConfig, error) {
+	byTag := make(map[string]*InboundConfig, len(inbounds))
+	for i := range inbounds {
+		tag := inbounds[i].Tag
+		if tag == "" {
+			return nil, ErrRestartRequired
+		}
+		if _, ok := byTag[tag]; ok {
+			return nil, ErrRestartRequired
+		}
+		byTag[tag] = &inbounds[i]
+	}
+	return byTag, nil
+}
+
+func delInboundOp(tag string) reconcileOp {
+	return reconcileOp{
+		desc: "remove inbound " + tag,
+		apply: func(api *XrayAPI) error {
+			return ignoreMissing(api.DelInbound(tag))
+		},
+	}
+}
+
+func addInboundOp(inbound *InboundConfig) reconcileOp {
+	return reconcileOp{
+		desc: "add inbound " + inbound.Tag,
+		apply: func(api *XrayAPI) error {
+			data, err := json.Marshal(inbound)
+			if err != nil {
+				return err
+			}
+			err = api.AddInbound(data)
+			if err != nil && isExisting(err) {
+				if err := ignoreMissing(api.DelInbound(inbound.Tag)); err != nil {
+					return err
+				}
+				err = api.AddInbound(data)
+			}
+			return err
+		},
+	}
+}
+
+// planUsers returns the user operations turning oldInbound into newInbound,
+// or false if anything but the client list has changed.
+func planUsers(oldInbound, newInbound *InboundConfig) (removeOps, addOps []reconcileOp, ok bool) {
+	if !apiUserProtocols[newInbound.Protocol] || oldInbound.Protocol != newInbound.Protocol {
+		return nil, nil, false
+	}
+	if oldInbound.Port != newInbound.Port ||
+		!bytes.Equal(oldInbound.Listen, newInbound.Listen) ||
+		!bytes.Equal(oldInbound.StreamSettings, newInbound.StreamSettings) ||
+		!bytes.Equal(oldInbound.Sniffing, newInbound.Sniffing) ||
+		!bytes.Equal(oldInbound.Allocate, newInbound.Allocate) {
+		return nil, nil, false
+	}
+
+	oldSettings, oldClients, err := splitClients(oldInbound.Settings)
+	if err != nil {
+		return nil, nil, false
+	}
+	newSettings, newClients, err := splitClients(newInbound.Settings)
+	if err != nil {
+		return nil, nil, false
+	}
+	if len(oldSettings) != len(newSettings) {
+		return nil, nil, false
+	}
+	for key, value := range oldSettings {
+		if !bytes.Equal(value, newSettings[key]) {
+			return nil, nil, false
+		}
+	}
+
+	oldByEmail, err := clientsByEmail(oldClients)
+	if err != nil {
+		return nil, nil, false
+	}
+	newByEmail, err := clientsByEmail(newClients)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	cipher := ""
+	if newInbound.Protocol == "shadowsocks" {
+		if err := json.Unmarshal(newSettings["method"], &cipher); err != nil {
+			return nil, nil, false
+		}
+	}
+
+	tag := newInbound.Tag
+	for _, client := range oldClients {
+		email := client["email"].(string)
+		newClient, found := newByEmail[email]
+		if found && bytes.Equal(mustMarshal(client), mustMarshal(newClient)) {
+			continue
+		}
+		removeOps = append(removeOps, reconcileOp{
+			desc: fmt.Sprintf("remove user %s from %s", email, tag),
+			apply: func(api *XrayAPI) error {
+				return ignoreMissing(api.RemoveUser(tag, email))
+			},
+		})
+	}
+	for _, client := range newClients {
+		email := client["email"].(string)
+		oldClient, found := oldByEmail[email]
+		if found && bytes.Equal(mustMarshal(client), mustMarshal(oldClient)) {
+			continue
+		}
+		user := map[string]any{
+			"email":    email,
+			"id":       stringField(client, "id"),
+			"flow":     stringField(client, "flow"),
+			"password": stringField(client, "password"),
+			"cipher":   cipher,
+		}
+		addOps = append(addOps, reconcileOp{
+			desc: fmt.Sprintf("add user %s to %s", email, tag),
+			apply: func(api *XrayAPI) error {
+				// not every protocol refuses a user it already has
+				if err := ignoreMissing(api.RemoveUser(tag, email)); err != nil {
+					return err
+				}
+				return api.AddUser(newInbound.Protocol, tag, user)
+			},
+		})
+	}
+	return removeOps, addOps, true
+}
+
+func splitClients(settings []byte) (map[string]json.RawMessage, []map[string]any, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(settings, &fields); err != nil {
+		return nil, nil, err
+	}
+	var clients []map[string]any
+	if raw, ok := fields["clients"]; ok {
+		if err := json.Unmarshal(raw, &clients); err != nil {
+			return nil, nil, err
+		}
+		delete(fields, "clients")
+	}
+	return fields, clients, nil
+}
+
+func clientsByEmail(clients []map[string]any) (map[string]map[string]any, error) {
+	byEmail := make(map[string]map[string]any, len(clients))
+	for _, client := range clients {
+		email, _ := client["email"].(string)
+		if email == "" {
+			return nil, ErrRestartRequired
+		}
+		if _, ok := byEmail[email]; ok {
+			return nil, ErrRestartRequired
+		}
+		byEmail[email] = client
+	}
+	return byEmail, nil
+}
+
+func stringField(m map[string]any, key string) string {
+	value, _ := m[key].(string)
+	return value
+}
+
+func mustMarshal(v any) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+func planOutbounds(oldRaw, newRaw []byte) (removeOps, addOps []reconcileOp, err error) {
+	if bytes.Equal(oldRaw, newRaw) {
+		return nil, nil, nil
+	}
+	oldOutbounds, oldByTag, err := outboundsByTag(oldRaw)
+	if err != nil {
+		return nil, nil, err
+	}
+	newOutbounds, newByTag, err := outboundsByTag(newRaw)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the first outbound is the default one and can only change on restart
+	if len(oldOutbounds) == 0 || len(newOutbounds) == 0 ||
+		!bytes.Equal(oldOutbounds[0], newOutbounds[0]) {
+		return nil, nil, ErrRestartRequired
+	}
+
+	for tag := range oldByTag {
+		if newOutbound, ok := newByTag[tag]; !ok || !bytes.Equal(oldByTag[tag], newOutbound) {
+			removeOps = append(removeOps, reconcileOp{
+				desc: "remove outbound " + tag,
+				apply: func(api *XrayAPI) error {
+					return ignoreMissing(api.DelOutbound(tag))
+				},
+			})
+		}
+	}
+	for tag, outbound := range newByTag {
+		if oldOutbound, ok := oldByTag[tag]; !ok || !bytes.Equal(oldOutbound, outbound) {
+			addOps = append(addOps, reconcileOp{
+				desc: "add outbound " + tag,
+				apply: func(api *XrayAPI) error {
+					err := api.AddOutbound(outbound)
+					if err != nil && isExisting(err) {
+						if err := ignoreMissing(api.DelOutbound(tag)); err != nil {
+							return err
+						}
+						err = api.AddOutbound(outbound)
+					}
+					return err
+				},
+			})
+		}
+	}
+	return removeOps, addOps, nil
+}
+
+func outboundsByTag(raw []byte) ([]json.RawMessage, map[string]json.RawMessage, error) {
+	var outbounds []json.RawMessage
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &outbounds); err != nil {
+			return nil, nil, ErrRestartRequired
+		}
+	}
+	byTag := make(map[string]json.RawMessage, len(outbounds))
+	for _, outbound := range outbounds {
+		var header struct {
+			Tag string `json:"tag"`
+		}
+		if err := json.Unmarshal(outbound, &header); err != nil || header.Tag == "" {
+			return nil, nil, ErrRestartRequired
+		}
+		if _, ok := byTag[header.Tag]; ok {
+			return nil, nil, ErrRestartRequired
+		}
+		byTag[header.Tag] = outbound
+	}
+	return outbounds, byTag, nil
+}
+
+// planRouting applies changes at the end of the rule list one by one: the
+// rules after the common prefix must carry a ruleTag so they can be removed,
+// and the new ones are appended afterwards. Other changes to the rules, such
+// as a tagged rule put ahead of the others, replace the whole routing.
+func planRouting(oldRaw, newRaw []byte) (removeOps, addOps []reconcileOp, err error) {
+	if bytes.Equal(oldRaw, newRaw) {
+		return nil, nil, nil
+	}
+	oldFields, oldRules, err := splitRules(oldRaw)
+	if err != nil {
+		return nil, nil, err
+	}
+	newFields, newRules, err := splitRules(newRaw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(oldFields) != len(newFields) {
+		return nil, nil, ErrRestartRequired
+	}
+	for key, value := range oldFields {
+		if !bytes.Equal(value, newFields[key]) {
+			return nil, nil, ErrRestartRequired
+		}
+	}
+
+	common := 0
+	for common < len(oldRules) && common < len(newRules) && bytes.Equal(oldRules[common], newRules[common]) {
+		common++
+	}
+
+	for _, rule := range oldRules[common:] {
+		var header struct {
+			RuleTag string `json:"ruleTag"`
+		}
+		if err := json.Unmarshal(rule, &header); err != nil || header.RuleTag == "" {
+			return nil, replaceRoutingOps(newRaw), nil
+		}
+		removeOps = append(removeOps, reconcileOp{
+			desc: "remove routing rule " + header.RuleTag,
+			apply: func(api *XrayAPI) error {
+				return ignoreMissing(api.RemoveRule(header.RuleTag))
+			},
+		})
+	}
+	if added := newRules[common:]; len(added) > 0 {
+		addOps = append(addOps, reconcileOp{
+			desc: fmt.Sprintf("add %d routing rule(s)", len(added)),
+			apply: func(api *XrayAPI) error {
+				err := api.AddRules(added)
+				if err != nil && isExisting(err) {
+					for _, rule := range added {
+						var header struct {
+							RuleTag string `json:"ruleTag"`
+						}
+						if json.Unmarshal(rule, &header) == nil && header.RuleTag != "" {
+							if err := ignoreMissing(api.RemoveRule(header.RuleTag)); err != nil {
+								return err
+							}
+						}
+					}
+					err = api.AddRules(added)
+				}
+				return err
+			},
+		})
+	}
+	return removeOps, addOps, nil
+}
+
+// replaceRoutingOps replaces the rules and balancers at once, after the
+// outbounds they route to are in place.
+func replaceRoutingOps(newRaw []byte) []reconcileOp {
+	return []reconcileOp{{
+		desc: "replace routing",
+		apply: func(api *XrayAPI) error {
+			return api.ReplaceRouting(newRaw)
+		},
+	}}
+}
+
+func splitRules(raw []byte) (map[string]json.RawMessage, []json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, nil, ErrRestartRequired
+		}
+	}
+	var rules []json.RawMessage
+	if raw, ok := fields["rules"]; ok {
+		if err := json.Unmarshal(raw, &rules); err != nil {
+			return nil, nil, ErrRestartRequired
+		}
+		delete(fields, "rules")
+	}
+	return fields, rules, nil
+}
@@ -0,0 +1,106 @@
+package xray
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"x-ui/config"
+	"x-ui/util/common"
+
+	"github.com/xtls/xray-core/common/platform"
+	"github.com/xtls/xray-core/infra/conf"
+)
+
+var assetLocationOnce sync.Once
+
+// useBinAssets makes the embedded xray-core look up geo files in the bin
+// folder, where the panel keeps them for the core.
+func useBinAssets() {
+	assetLocationOnce.Do(func() {
+		if _, ok := os.LookupEnv(platform.AssetLocation); !ok {
+			os.Setenv(platform.AssetLocation, config.GetBinFolderPath())
+		}
+	})
+}
+
+// ValidateConfig checks a complete config before it is used. The installed
+// xray binary is asked to test it when available, so the check matches the
+// running core version; otherwise the config is built with the xray-core
+// library the panel is compiled with.
+func ValidateConfig(xrayConfig *Config) error {
+	data, err := json.MarshalIndent(xrayConfig, "", "  ")
+	if err != nil {
+		return common.NewErrorf("Failed to generate XRAY configuration: %v", err)
+	}
+	if _, err := os.Stat(GetBinaryPath()); err == nil {
+		return testConfig(data)
+	}
+
+	useBinAssets()
+	jsonConfig := new(conf.Config)
+	err = json.Unmarshal(data, jsonConfig)
+	if err != nil {
+		return err
+	}
+	_, err = jsonConfig.Build()
+	return err
+}
+
+// ValidateInbound checks a single inbound the same way the API builds it.
+func ValidateInbound(inbound *InboundConfig) error {
+	data, err := json.Marshal(inbound)
+	if err != nil {
+		return err
+	}
+	detour := new(conf.InboundDetourConfig)
+	err = json.Unmarshal(data, detour)
+	if err != nil {
+		return common.NewErrorf("inbound %v: %v", inbound.Tag, err)
+	}
+	_, err = detour.Build()
+	if err != nil {
+		return common.NewErrorf("inbound %v: %v", inbound.Tag, err)
+	}
+	return nil
+}
+
+// ValidateRoutingRule checks a single routing rule.
+func ValidateRoutingRule(rule []byte) error {
+	useBinAssets()
+	routerConfig := &conf.RouterConfig{RuleList: []json.RawMessage{rule}}
+	_, err := routerConfig.Build()
+	return err
+}
+
+func testConfig(data []byte) error {
+	file, err := os.CreateTemp("", "xray-test-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.Write(data)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, GetBinaryPath(), "run", "-test", "-c", file.Name()).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	// the first lines are the version banner, the reason comes last
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			return common.NewError(line)
+		}
+	}
+	return err
+}